@@ -2,11 +2,12 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"strings"
@@ -16,15 +17,26 @@ import (
 
 	"github.com/yottta/chat/client/domain"
 	"github.com/yottta/chat/client/infra/data"
+	"github.com/yottta/chat/client/infra/data/bolt"
 	"github.com/yottta/chat/client/infra/data/inmemory"
 	"github.com/yottta/chat/client/infra/http/directory"
+	"github.com/yottta/chat/client/infra/identity"
 	"github.com/yottta/chat/client/infra/socket"
+	"github.com/yottta/chat/client/infra/socket/conn"
 	"github.com/yottta/chat/client/infra/tui"
 )
 
 var (
 	currentUserName = MustEnv("USER_NAME")
 	serverURL       = MustEnv("SERVER_URL")
+	downloadDir     = EnvOrDefault("DOWNLOAD_DIR", "downloads")
+	profileDir      = EnvOrDefault("PROFILE_DIR", filepath.Join("profiles", currentUserName))
+	storeType       = EnvOrDefault("STORE_TYPE", "encrypted")
+	storePath       = EnvOrDefault("STORE_PATH", filepath.Join(profileDir, "chats.db"))
+	heartbeat       = conn.Heartbeat{
+		Interval: DurationEnvOrDefault("HEARTBEAT_INTERVAL", conn.DefaultHeartbeat.Interval),
+		Timeout:  DurationEnvOrDefault("HEARTBEAT_TIMEOUT", conn.DefaultHeartbeat.Timeout),
+	}
 )
 
 func main() {
@@ -48,8 +60,14 @@ func main() {
 		}
 	}()
 
+	// load the identity used to secure the connections with the other users, generating it on the first start
+	id, err := identity.Load(profileDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// create new socket service
-	so, err := socket.NewSocket()
+	so, err := socket.NewSocket(id, socket.Config{Limits: conn.DefaultLimits, DownloadDir: downloadDir, Heartbeat: heartbeat})
 	if err != nil {
 		log.Fatalf("failed to get local address: %s", err)
 	}
@@ -59,18 +77,23 @@ func main() {
 		log.Fatal(err)
 	}
 
-	currentUserId := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s_%d", so.LocalIP(), so.AllocatedPort())))
-	// prepare the store to hold the messages exchanged
-	store := inmemory.NewStore(
+	// prepare the store to hold the messages exchanged.
+	// The user is identified by the fingerprint of its identity, the address being used only to reach it.
+	store, closeStore, err := newStore(
 		ctx,
 		domain.User{
-			Id:      currentUserId,
-			Name:    currentUserName,
-			Address: so.LocalIP(),
-			Port:    so.AllocatedPort(),
+			Id:        id.Fingerprint(),
+			Name:      currentUserName,
+			Address:   so.LocalIP(),
+			Port:      so.AllocatedPort(),
+			PublicKey: id.PublicKey(),
 		},
+		so.MaxMessageLen(),
 	)
-	so.RegisterStore(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	so.RegisterStore(ctx, store)
 
 	// prepare directory client and register
 	dc := directory.NewClient(serverURL)
@@ -89,13 +112,21 @@ func main() {
 				return
 			case <-tick.C:
 				ping(ctx, dc, store.CurrentUser())
-				loadClients(ctx, dc, store)
 			}
 		}
 	}()
 
+	wg.Add(1)
+	go func() {
+		defer func() {
+			log.Println("closing directory watch")
+			wg.Done()
+		}()
+		watchUsers(ctx, dc, store)
+	}()
+
 	// init the UI and start it
-	tui := tui.New(store)
+	tui := tui.New(store, so)
 	ping(ctx, dc, store.CurrentUser())
 	loadClients(ctx, dc, store)
 	if err := tui.Start(ctx); err != nil {
@@ -106,11 +137,55 @@ func main() {
 	wg.Wait()
 	<-time.After(1 * time.Second)
 
+	// the socket stopped, so nothing changes the store anymore
+	if err := closeStore(); err != nil {
+		log.Printf("failed to close the store: %s", err)
+	}
+
 	// just print things out to be sure that there are no leaks
 	debug.PrintStack()
 	fmt.Println("num goroutines", runtime.NumGoroutine())
 }
 
+// newStore returns the store chosen by STORE_TYPE together with the function that closes it.
+func newStore(ctx context.Context, currentUser domain.User, maxMsgLen int) (data.Store, func() error, error) {
+	switch storeType {
+	case "memory":
+		return inmemory.NewStore(ctx, currentUser, maxMsgLen), func() error { return nil }, nil
+	case "bolt":
+		return bolt.NewStore(ctx, storePath, currentUser, maxMsgLen)
+	case "encrypted":
+		return unlockStore(ctx, currentUser, maxMsgLen)
+	default:
+		return nil, nil, fmt.Errorf("unknown STORE_TYPE %q. supported values: memory, bolt, encrypted", storeType)
+	}
+}
+
+// unlockStore asks for the passphrase of the encrypted chats until the right one is given.
+// A new history is protected by the first passphrase given, so this is asked twice to avoid typos.
+func unlockStore(ctx context.Context, currentUser domain.User, maxMsgLen int) (data.Store, func() error, error) {
+	_, err := os.Stat(storePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+	newHistory := err != nil
+	message := "Unlock your chats"
+	if newHistory {
+		message = "Choose a passphrase for your chats"
+	}
+	for {
+		passphrase, err := tui.AskPassphrase(ctx, message, newHistory)
+		if err != nil {
+			return nil, nil, err
+		}
+		store, closeStore, err := bolt.NewStore(ctx, storePath, currentUser, maxMsgLen, bolt.WithPassphrase(passphrase))
+		if !errors.Is(err, bolt.WrongPassphraseErr) {
+			return store, closeStore, err
+		}
+		message = "Wrong passphrase, try again"
+	}
+}
+
 func MustEnv(key string) string {
 	e := strings.TrimSpace(os.Getenv(key))
 	if len(e) == 0 {
@@ -119,6 +194,26 @@ func MustEnv(key string) string {
 	return e
 }
 
+func EnvOrDefault(key, def string) string {
+	e := strings.TrimSpace(os.Getenv(key))
+	if len(e) == 0 {
+		return def
+	}
+	return e
+}
+
+func DurationEnvOrDefault(key string, def time.Duration) time.Duration {
+	e := strings.TrimSpace(os.Getenv(key))
+	if len(e) == 0 {
+		return def
+	}
+	d, err := time.ParseDuration(e)
+	if err != nil {
+		panic(fmt.Errorf("invalid %s env var: %w", key, err))
+	}
+	return d
+}
+
 func ping(ctx context.Context, dc directory.Client, currentUser domain.User) {
 	if err := dc.Ping(ctx, currentUser); err != nil {
 		log.Printf("failed to ping directory %s: %s", serverURL, err)
@@ -136,3 +231,58 @@ func loadClients(ctx context.Context, dc directory.Client, store data.Store) {
 		return
 	}
 }
+
+// watchUsers keeps a stream open with the directory and applies the presence changes to the store.
+// Whenever the stream is interrupted, it is opened again after a short delay.
+func watchUsers(ctx context.Context, dc directory.Client, store data.Store) {
+	const retryDelay = 5 * time.Second
+	for {
+		events, err := dc.Watch(ctx)
+		if err != nil {
+			log.Printf("failed to watch clients from %s: %s", serverURL, err)
+			// fallback to the full list to have the users updated while the stream is not available
+			loadClients(ctx, dc, store)
+		} else {
+			consumeUserEvents(events, store)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+func consumeUserEvents(events <-chan domain.UserEvent, store data.Store) {
+	var (
+		synced      bool
+		onlineUsers []domain.User
+	)
+	for e := range events {
+		if e.User == nil && e.Type != domain.UsersSynced {
+			continue
+		}
+		if !synced {
+			switch e.Type {
+			case domain.UserJoined:
+				onlineUsers = append(onlineUsers, *e.User)
+			case domain.UsersSynced:
+				synced = true
+				if err := store.RefreshUsers(onlineUsers); err != nil {
+					log.Printf("failed to get refresh store users: %s", err)
+				}
+			}
+			continue
+		}
+		var err error
+		switch e.Type {
+		case domain.UserJoined, domain.UserUpdated:
+			err = store.UpsertUser(*e.User)
+		case domain.UserLeft:
+			err = store.SetUserOffline(e.User.Id)
+		}
+		if err != nil {
+			log.Printf("failed to apply the %s event to the store: %s", e.Type, err)
+		}
+	}
+}
@@ -8,10 +8,18 @@ var ChatUserNotFoundErr = fmt.Errorf("chat user not found")
 
 type Chat struct {
 	Id        string
+	Name      string
+	Group     bool
 	OwnerUser User
 	Users     []User
 	Content   []Message
 	Offline   bool
+	// CreatorId is the id of the user that created the group chat, the only one allowed to change its members
+	CreatorId string
+	// LastRead is the id of the latest message that the current user has read in the chat
+	LastRead string
+	// Unread is the number of messages of the other users after LastRead. It's counted by the store, not persisted.
+	Unread int `json:"-"`
 }
 
 func (c Chat) GetOtherUsers() []User {
@@ -33,3 +41,29 @@ func (c Chat) GetUser(id string) (*User, error) {
 func (c Chat) GetAllUsers() []User {
 	return append(c.Users, c.OwnerUser)
 }
+
+// IsDirectWith returns true when the chat is the one-to-one chat with the given user.
+func (c Chat) IsDirectWith(userId string) bool {
+	return !c.Group && len(c.Users) == 1 && c.Users[0].Id == userId
+}
+
+// NewChatId generates a random id for a group chat
+func NewChatId() string {
+	return randomId()
+}
+
+type ChatEventType string
+
+const (
+	// TypingStarted is received when a user started typing in a chat. It's repeated while the user keeps typing.
+	TypingStarted ChatEventType = "typing_started"
+	// TypingStopped is received when a user stopped typing in a chat, either by sending the message or by clearing it
+	TypingStopped ChatEventType = "typing_stopped"
+)
+
+// ChatEvent describes something that a user does in a chat and that is not kept as a message, like typing
+type ChatEvent struct {
+	Type   ChatEventType
+	ChatId string
+	UserId string
+}
@@ -1,12 +1,196 @@
 package domain
 
-import "time"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"time"
+)
+
+// MessageStatus describes the delivery state of a message.
+// For the messages of the current user it's the state reported by the other party, for the rest of the messages
+// it's the state that we are going to report back to the author.
+type MessageStatus string
+
+const (
+	// MessageStatusNone is used for the messages that are not tracked, like the error ones
+	MessageStatusNone MessageStatus = ""
+	// MessageStatusPending is used for the messages that are waiting to be written to the other party
+	MessageStatusPending MessageStatus = "pending"
+	// MessageStatusFailed is used for the messages that could not be written even after retrying
+	MessageStatusFailed MessageStatus = "failed"
+	// MessageStatusSent is used for the messages that were written successfully to the other party
+	MessageStatusSent MessageStatus = "sent"
+	// MessageStatusDelivered is used for the messages that were accepted by the store of the other party
+	MessageStatusDelivered MessageStatus = "delivered"
+	// MessageStatusRead is used for the messages that were displayed to the other party
+	MessageStatusRead MessageStatus = "read"
+)
+
+var messageStatusRanks = map[MessageStatus]int{
+	MessageStatusNone:      0,
+	MessageStatusPending:   1,
+	MessageStatusFailed:    2,
+	MessageStatusSent:      3,
+	MessageStatusDelivered: 4,
+	MessageStatusRead:      5,
+}
+
+// Precedes returns true when the status s is earlier in the lifecycle of a message than the other one.
+// The status of a message can only move forward, so late updates, like the sent status arriving after the delivered one, are ignored.
+func (s MessageStatus) Precedes(other MessageStatus) bool {
+	return messageStatusRanks[s] < messageStatusRanks[other]
+}
+
+// MessageKind describes what a message is carrying
+type MessageKind string
+
+const (
+	// MessageKindText is used for the messages typed by the users
+	MessageKindText MessageKind = ""
+	// MessageKindMembership is used for the messages announcing the members of a group chat
+	MessageKindMembership MessageKind = "membership"
+	// MessageKindFile is used for the messages offering a file to the other user of a direct chat
+	MessageKindFile MessageKind = "file"
+	// MessageKindEdit is used for the messages replacing the text of the earlier message with the same id.
+	// They are never added to a chat, they change the earlier message instead.
+	MessageKindEdit MessageKind = "edit"
+	// MessageKindDelete is used for the messages retracting the earlier message with the same id.
+	// They are never added to a chat, they remove the text of the earlier message instead.
+	MessageKindDelete MessageKind = "delete"
+	// MessageKindReaction is used for the messages reacting with the emoji from their text to the earlier message with the same id.
+	// They are never added to a chat, they change the reactions of the earlier message instead. An empty text removes the reaction.
+	MessageKindReaction MessageKind = "reaction"
+)
+
+// IsRevision returns true for the kinds of the messages with which the author changes an earlier message.
+func (k MessageKind) IsRevision() bool {
+	return k == MessageKindEdit || k == MessageKindDelete
+}
+
+// IsAddedToChat returns false for the kinds of the messages that change an earlier message instead of being added to a chat.
+func (k MessageKind) IsAddedToChat() bool {
+	return !k.IsRevision() && k != MessageKindReaction
+}
+
+// FileState describes where the transfer of an offered file is
+type FileState string
+
+const (
+	// FileStateOffered is used for the files that were not accepted or declined yet by the receiver
+	FileStateOffered FileState = "offered"
+	// FileStateAccepted is used for the files that the receiver accepted and are streamed
+	FileStateAccepted FileState = "accepted"
+	// FileStateDeclined is used for the files that the receiver declined
+	FileStateDeclined FileState = "declined"
+	// FileStateCompleted is used for the files that were received whole and with the expected checksum
+	FileStateCompleted FileState = "completed"
+	// FileStateFailed is used for the files that could not be read or written or did not match the checksum
+	FileStateFailed FileState = "failed"
+)
 
 type Message struct {
+	Id           string
 	ChatId       string
 	UserId       string
 	UserName     string
 	Text         string
 	At           time.Time
 	ErrorMessage bool
+	Status       MessageStatus
+	Kind         MessageKind
+	// Membership is set only for the MessageKindMembership messages
+	Membership *Membership
+	// File is set only for the MessageKindFile messages
+	File *FileTransfer
+	// Edited is set once the text of the message was replaced by its author
+	Edited bool
+	// Deleted is set once the message was retracted by its author, together with removing its text
+	Deleted bool
+	// Reactions holds the reaction of each user that reacted to the message, ordered by the id of the user
+	Reactions []Reaction
+	// ParentId is set only for the replies and it's the id of the message replied to, from the same chat
+	ParentId string
+}
+
+// Reaction is the emoji with which a user reacted to a message
+type Reaction struct {
+	UserId string
+	Emoji  string
+}
+
+// ReactionCount is how many users reacted to a message with the same emoji
+type ReactionCount struct {
+	Emoji string
+	Count int
+}
+
+// Membership describes a group chat together with all of its members, after a change done by the author of the message
+type Membership struct {
+	ChatName string
+	Members  []User
+}
+
+// FileTransfer describes a file offered in a chat and how much of it was transferred.
+// Path is local to each side: the file that is offered for the sender and the downloaded file for the receiver, once completed.
+type FileTransfer struct {
+	Name        string
+	Size        int64
+	Checksum    string
+	Path        string
+	State       FileState
+	Transferred int64
+}
+
+// Progress returns the percentage of the file that was transferred.
+func (f FileTransfer) Progress() int {
+	if f.Size == 0 {
+		return 100
+	}
+	return int(f.Transferred * 100 / f.Size)
+}
+
+// ReactionCounts aggregates the reactions of the message by emoji. The most used emoji is the first one.
+func (m Message) ReactionCounts() []ReactionCount {
+	var counts []ReactionCount
+	idx := map[string]int{}
+	for _, r := range m.Reactions {
+		i, ok := idx[r.Emoji]
+		if !ok {
+			i = len(counts)
+			idx[r.Emoji] = i
+			counts = append(counts, ReactionCount{Emoji: r.Emoji})
+		}
+		counts[i].Count++
+	}
+	sort.SliceStable(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Emoji < counts[j].Emoji
+	})
+	return counts
+}
+
+// Before gives the order of the messages in a chat. The messages are ordered by their time and, when equal,
+// by their author and id so that all the members of a chat are seeing the same order.
+func (m Message) Before(other Message) bool {
+	if !m.At.Equal(other.At) {
+		return m.At.Before(other.At)
+	}
+	if m.UserId != other.UserId {
+		return m.UserId < other.UserId
+	}
+	return m.Id < other.Id
+}
+
+// NewMessageId generates a random id for a message
+func NewMessageId() string {
+	return randomId()
+}
+
+func randomId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
 }
@@ -1,8 +1,28 @@
 package domain
 
 type User struct {
-	Id      string `json:"id"`
-	Name    string `json:"name"`
-	Address string `json:"address"`
-	Port    int    `json:"port"`
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	Port      int    `json:"port"`
+	PublicKey []byte `json:"public_key"`
+}
+
+type UserEventType string
+
+const (
+	// UserJoined is received when a user goes online
+	UserJoined UserEventType = "join"
+	// UserLeft is received when a user goes offline
+	UserLeft UserEventType = "leave"
+	// UserUpdated is received when an online user changed its details
+	UserUpdated UserEventType = "update"
+	// UsersSynced is received after the UserJoined events of the users that were online when the watch started
+	UsersSynced UserEventType = "synced"
+)
+
+// UserEvent describes a presence change of a user as streamed by the directory
+type UserEvent struct {
+	Type UserEventType `json:"type"`
+	User *User         `json:"client,omitempty"`
 }
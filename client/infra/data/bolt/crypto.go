@@ -0,0 +1,194 @@
+package bolt
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+var (
+	WrongPassphraseErr = errors.New("wrong passphrase")
+	EmptyPassphraseErr = errors.New("the passphrase cannot be empty")
+	NotEncryptedErr    = errors.New("the chats database is not encrypted")
+	EncryptedErr       = errors.New("the chats database is encrypted and needs a passphrase")
+)
+
+var (
+	// keysBucket holds the data key, wrapped with the key derived from the passphrase
+	keysBucket   = []byte("keys")
+	dataKeyEntry = []byte("data")
+)
+
+const (
+	dataKeySize = 32
+	saltSize    = 16
+	// wrappedKeyAD binds the wrapped data key to its purpose, so it cannot be confused with a record
+	wrappedKeyAD = "go-chat history data key"
+)
+
+// kdfParams are the Argon2id parameters used to derive the key wrapping the data key from the passphrase.
+// They are saved together with the wrapped key, so the defaults can be changed without breaking the existing databases.
+type kdfParams struct {
+	Salt    []byte
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// defaultKdfParams are the ones recommended by RFC 9106 for memory constrained environments
+var defaultKdfParams = kdfParams{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// wrappedKey is the form in which the data key is saved: sealed with the key derived from the passphrase.
+// Changing the passphrase replaces only this, the records staying encrypted with the same data key.
+type wrappedKey struct {
+	KDF   kdfParams
+	Nonce []byte
+	Key   []byte
+}
+
+// newDataKey generates the random key from which the keys of the records are derived
+func newDataKey() ([]byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	return dataKey, nil
+}
+
+// wrapKey seals the data key with a key derived from the passphrase using a new salt.
+func wrapKey(dataKey []byte, passphrase string) (*wrappedKey, error) {
+	if len(passphrase) == 0 {
+		return nil, EmptyPassphraseErr
+	}
+	params := defaultKdfParams
+	params.Salt = make([]byte, saltSize)
+	if _, err := rand.Read(params.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := params.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &wrappedKey{
+		KDF:   params,
+		Nonce: nonce,
+		Key:   aead.Seal(nil, nonce, dataKey, []byte(wrappedKeyAD)),
+	}, nil
+}
+
+// unwrap opens the data key with the key derived from the passphrase. WrongPassphraseErr is returned when it cannot be opened.
+func (w *wrappedKey) unwrap(passphrase string) ([]byte, error) {
+	aead, err := w.KDF.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(w.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid wrapped data key")
+	}
+	dataKey, err := aead.Open(nil, w.Nonce, w.Key, []byte(wrappedKeyAD))
+	if err != nil {
+		return nil, WrongPassphraseErr
+	}
+	return dataKey, nil
+}
+
+func (p kdfParams) aead(passphrase string) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(passphrase), p.Salt, p.Time, p.Memory, p.Threads, chacha20poly1305.KeySize)
+	return chacha20poly1305.NewX(key)
+}
+
+func decodeWrappedKey(b []byte) (*wrappedKey, error) {
+	var w wrappedKey
+	if err := json.Unmarshal(b, &w); err != nil {
+		return nil, fmt.Errorf("invalid wrapped data key: %w", err)
+	}
+	return &w, nil
+}
+
+// records converts the ids and the values to the form in which they are saved into the database.
+type records interface {
+	// key returns the key under which the record with the given id is saved
+	key(id string) []byte
+	// seal returns the saved form of the value. The ad is the data the value is bound to, like its key.
+	seal(value, ad []byte) ([]byte, error)
+	// open returns the value from its saved form, checking that it's bound to the same ad used when sealed.
+	open(sealed, ad []byte) ([]byte, error)
+}
+
+// plainRecords saves everything as it is
+type plainRecords struct{}
+
+func (plainRecords) key(id string) []byte {
+	return []byte(id)
+}
+
+func (plainRecords) seal(value, _ []byte) ([]byte, error) {
+	return value, nil
+}
+
+func (plainRecords) open(sealed, _ []byte) ([]byte, error) {
+	return sealed, nil
+}
+
+// sealedRecords encrypts each record with XChaCha20-Poly1305 under a key derived from the data key.
+// The keys of the records are the HMAC of their ids, so the ids of the chats do not reveal who the chats are with.
+// Each record is bound to its key, so the records cannot be swapped between chats or messages without being noticed.
+type sealedRecords struct {
+	aead  cipher.AEAD
+	idKey []byte
+}
+
+func newSealedRecords(dataKey []byte) (*sealedRecords, error) {
+	kdf := hkdf.New(sha256.New, dataKey, nil, []byte("go-chat history records"))
+	encKey := make([]byte, chacha20poly1305.KeySize)
+	idKey := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(kdf, encKey); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(kdf, idKey); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(encKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedRecords{aead: aead, idKey: idKey}, nil
+}
+
+func (r *sealedRecords) key(id string) []byte {
+	mac := hmac.New(sha256.New, r.idKey)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)
+}
+
+func (r *sealedRecords) seal(value, ad []byte) ([]byte, error) {
+	nonce := make([]byte, r.aead.NonceSize(), r.aead.NonceSize()+len(value)+r.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return r.aead.Seal(nonce, nonce, value, ad), nil
+}
+
+func (r *sealedRecords) open(sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < r.aead.NonceSize() {
+		return nil, fmt.Errorf("record too short")
+	}
+	nonce, ciphertext := sealed[:r.aead.NonceSize()], sealed[r.aead.NonceSize():]
+	value, err := r.aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt record: %w", err)
+	}
+	return value, nil
+}
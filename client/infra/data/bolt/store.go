@@ -0,0 +1,266 @@
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/data"
+	"github.com/yottta/chat/client/infra/data/inmemory"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"time"
+)
+
+var (
+	// chatsBucket holds the details of each chat, keyed by the id of the chat
+	chatsBucket = []byte("chats")
+	// messagesBucket holds one bucket for each chat with its messages, keyed by the id of the message
+	messagesBucket = []byte("messages")
+)
+
+// store is the data.PassphraseStore returned by NewStore, adding the passphrase management to the inmemory one
+type store struct {
+	data.Store
+	j *journal
+}
+
+// journal is the inmemory.Journal saving the changes of the store into the bbolt database
+type journal struct {
+	db         *bolt.DB
+	records    records
+	passphrase string
+}
+
+// WithPassphrase encrypts the chats with a data key that is unlocked by the given passphrase.
+// A new database is encrypted with a new data key, protected by this passphrase.
+func WithPassphrase(passphrase string) func(j *journal) {
+	return func(j *journal) {
+		j.passphrase = passphrase
+	}
+}
+
+// NewStore opens (or creates) the bbolt database at the given path and returns a data.Store backed by it.
+// The chats persisted earlier are loaded back, together with their messages, and every change is saved before being applied.
+// Other than that, the store works exactly as the one returned by inmemory.NewStore.
+// The direct chats are loaded as offline since the users are online only after the directory reports them.
+// The returned function closes the database. Call it once nothing changes the store anymore, like after the socket stopped,
+// since the changes made afterwards cannot be saved.
+//
+// With WithPassphrase, the database is encrypted. WrongPassphraseErr is returned when the passphrase does not unlock it.
+// An encrypted database cannot be opened without a passphrase, nor a plain one with a passphrase.
+func NewStore(ctx context.Context, path string, currentUser domain.User, maxMsgLen int, opts ...func(j *journal)) (data.PassphraseStore, func() error, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open the chats database %s: %w", path, err)
+	}
+	j := &journal{db: db, records: plainRecords{}}
+	for _, o := range opts {
+		o(j)
+	}
+	chats, err := j.load(currentUser)
+	if err != nil {
+		_ = db.Close()
+		return nil, nil, err
+	}
+	s := inmemory.NewStore(ctx, currentUser, maxMsgLen, inmemory.WithChats(chats), inmemory.WithJournal(j))
+	return &store{Store: s, j: j}, db.Close, nil
+}
+
+// ChangePassphrase protects the data key with a new passphrase. The chats are not encrypted again since the data key stays the same.
+func (s *store) ChangePassphrase(current, next string) error {
+	return s.j.db.Update(func(tx *bolt.Tx) error {
+		v := tx.Bucket(keysBucket).Get(dataKeyEntry)
+		if v == nil {
+			return NotEncryptedErr
+		}
+		w, err := decodeWrappedKey(v)
+		if err != nil {
+			return err
+		}
+		dataKey, err := w.unwrap(current)
+		if err != nil {
+			return err
+		}
+		return putWrappedKey(tx, dataKey, next)
+	})
+}
+
+func (j *journal) SaveChat(chat domain.Chat) error {
+	b, err := json.Marshal(chat)
+	if err != nil {
+		return err
+	}
+	key := j.records.key(chat.Id)
+	sealed, err := j.records.seal(b, key)
+	if err != nil {
+		return err
+	}
+	return j.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(chatsBucket).Put(key, sealed)
+	})
+}
+
+func (j *journal) SaveMessages(chatId string, messages ...domain.Message) error {
+	chatKey := j.records.key(chatId)
+	return j.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(messagesBucket).CreateBucketIfNotExists(chatKey)
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			v, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			key := j.records.key(m.Id)
+			sealed, err := j.records.seal(v, messageAD(chatKey, key))
+			if err != nil {
+				return err
+			}
+			if err := b.Put(key, sealed); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// load unlocks the database, when encrypted, and reads all the chats from it, together with their messages.
+// The entries that cannot be read are skipped, so a single broken record does not make the whole history unavailable.
+func (j *journal) load(currentUser domain.User) ([]domain.Chat, error) {
+	var chats []domain.Chat
+	err := j.db.Update(func(tx *bolt.Tx) error {
+		cb, err := tx.CreateBucketIfNotExists(chatsBucket)
+		if err != nil {
+			return err
+		}
+		mb, err := tx.CreateBucketIfNotExists(messagesBucket)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(keysBucket); err != nil {
+			return err
+		}
+		if err := j.unlock(tx); err != nil {
+			return err
+		}
+		return cb.ForEach(func(k, v []byte) error {
+			c, err := j.readChat(k, v)
+			if err != nil {
+				log.Printf("skipping unreadable chat entry %x: %s", k, err)
+				return nil
+			}
+			c.OwnerUser = currentUser
+			if !c.Group {
+				c.Offline = true
+			}
+			b := mb.Bucket(k)
+			if b == nil {
+				chats = append(chats, *c)
+				return nil
+			}
+			if err := b.ForEach(func(mk, v []byte) error {
+				m, err := j.readMessage(k, mk, v)
+				if err != nil {
+					log.Printf("skipping unreadable message entry %x of chat %s: %s", mk, c.Id, err)
+					return nil
+				}
+				c.Content = append(c.Content, *m)
+				return nil
+			}); err != nil {
+				return err
+			}
+			chats = append(chats, *c)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the chats: %w", err)
+	}
+	return chats, nil
+}
+
+// unlock sets up the records of the journal based on how the database is saved.
+// When a passphrase is given for a new database, a new data key is generated and protected with the passphrase.
+func (j *journal) unlock(tx *bolt.Tx) error {
+	passphrase := j.passphrase
+	// the passphrase is not needed anymore once the data key is unlocked
+	j.passphrase = ""
+	v := tx.Bucket(keysBucket).Get(dataKeyEntry)
+	if len(passphrase) == 0 {
+		if v != nil {
+			return EncryptedErr
+		}
+		return nil
+	}
+	var dataKey []byte
+	if v == nil {
+		if k, _ := tx.Bucket(chatsBucket).Cursor().First(); k != nil {
+			return NotEncryptedErr
+		}
+		var err error
+		if dataKey, err = newDataKey(); err != nil {
+			return err
+		}
+		if err := putWrappedKey(tx, dataKey, passphrase); err != nil {
+			return err
+		}
+	} else {
+		w, err := decodeWrappedKey(v)
+		if err != nil {
+			return err
+		}
+		if dataKey, err = w.unwrap(passphrase); err != nil {
+			return err
+		}
+	}
+	r, err := newSealedRecords(dataKey)
+	if err != nil {
+		return err
+	}
+	j.records = r
+	return nil
+}
+
+func (j *journal) readChat(k, v []byte) (*domain.Chat, error) {
+	b, err := j.records.open(v, k)
+	if err != nil {
+		return nil, err
+	}
+	var c domain.Chat
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (j *journal) readMessage(chatKey, k, v []byte) (*domain.Message, error) {
+	b, err := j.records.open(v, messageAD(chatKey, k))
+	if err != nil {
+		return nil, err
+	}
+	var m domain.Message
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func putWrappedKey(tx *bolt.Tx, dataKey []byte, passphrase string) error {
+	w, err := wrapKey(dataKey, passphrase)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(keysBucket).Put(dataKeyEntry, b)
+}
+
+// messageAD binds a message to both its key and the key of its chat
+func messageAD(chatKey, key []byte) []byte {
+	ad := make([]byte, 0, len(chatKey)+len(key))
+	return append(append(ad, chatKey...), key...)
+}
@@ -0,0 +1,255 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/data"
+	"github.com/yottta/chat/client/infra/data/storetest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const maxMsgLen = 15000
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, ctx context.Context, currentUser domain.User, maxMsgLen int) data.Store {
+		s, _ := openStore(t, ctx, filepath.Join(t.TempDir(), "chats.db"), currentUser)
+		return s
+	})
+}
+
+func TestStore_Encrypted(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, ctx context.Context, currentUser domain.User, maxMsgLen int) data.Store {
+		s, _ := openStore(t, ctx, filepath.Join(t.TempDir(), "chats.db"), currentUser, WithPassphrase("secret"))
+		return s
+	})
+}
+
+func TestStore_Reopen(t *testing.T) {
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1 := domain.User{Id: "user1", Name: "user1"}
+	testUser2 := domain.User{Id: "user2", Name: "user2"}
+
+	t.Run(`Given a store with a direct chat and a group chat with messages, replies, edits and reactions, the group being read,
+	When the store is closed and opened again,
+	Then the chats are loaded back with all their messages and their last read one and the direct chat is offline`, func(t *testing.T) {
+		// Given
+		path := filepath.Join(t.TempDir(), "chats.db")
+		ctx, cancel := context.WithCancel(context.Background())
+		s, closeStore := openStore(t, ctx, path, currentUser)
+		if err := s.RefreshUsers([]domain.User{testUser1, testUser2}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		direct, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		group, err := s.CreateGroupChat("friends", []domain.User{testUser1, testUser2})
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		now := time.Now()
+		for _, m := range []domain.Message{
+			{Id: "d1", ChatId: direct.Id, UserId: currentUser.Id, Text: "hi", At: now},
+			{Id: "d2", ChatId: direct.Id, UserId: testUser1.Id, Text: "hello", At: now.Add(time.Second), ParentId: "d1"},
+			{Id: "g1", ChatId: group.Id, UserId: testUser2.Id, Text: "tpyo", At: now},
+		} {
+			if err := s.AddChatLine(m); err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+		if err := s.AddChatLine(domain.Message{Id: "g1", ChatId: group.Id, UserId: testUser2.Id, Text: "typo", Kind: domain.MessageKindEdit}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if err := s.React(group.Id, "g1", "👍"); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if err := s.SetMessageStatus(direct.Id, "d1", domain.MessageStatusDelivered); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if err := s.MarkChatRead(group.Id); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// When
+		cancel()
+		closeStore()
+		ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+		s, _ = openStore(t, ctx, path, currentUser)
+
+		// Then
+		chats := s.GetChats()
+		if len(chats) != 3 {
+			t.Fatalf("expected 3 chats to be loaded but found %d", len(chats))
+		}
+		direct, err = s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if !direct.Offline {
+			t.Fatalf("expected the direct chat to be offline until the user is online again")
+		}
+		if len(direct.Content) != 2 || direct.Content[0].Id != "d1" || direct.Content[1].Id != "d2" {
+			t.Fatalf("expected the messages d1 and d2 in order but found %+v", direct.Content)
+		}
+		if direct.Content[0].Status != domain.MessageStatusDelivered {
+			t.Fatalf("expected the status of d1 to be %s but is %s", domain.MessageStatusDelivered, direct.Content[0].Status)
+		}
+		if direct.Unread != 1 {
+			t.Fatalf("expected d2 to be still unread but found %d unread messages", direct.Unread)
+		}
+		thread, err := s.GetThread(direct.Id, "d1")
+		if err != nil || len(thread) != 2 {
+			t.Fatalf("expected the thread of d1 to contain the reply but received %+v, %v", thread, err)
+		}
+		group, err = s.GetChat(group.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if group.Name != "friends" || len(group.Users) != 2 || group.OwnerUser.Id != currentUser.Id {
+			t.Fatalf("expected the group details to be loaded but found %+v", group)
+		}
+		if group.LastRead != "g1" || group.Unread != 0 {
+			t.Fatalf("expected g1 to be the last read message but found %q with %d unread messages", group.LastRead, group.Unread)
+		}
+		m, err := s.GetMessage(group.Id, "g1")
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if m.Text != "typo" || !m.Edited || len(m.Reactions) != 1 {
+			t.Fatalf("expected the edited message with a reaction but found %+v", m)
+		}
+		found, err := s.Search(data.SearchQuery{Terms: []string{"typo"}}, 10)
+		if err != nil || len(found) != 1 || found[0].Id != "g1" {
+			t.Fatalf("expected the edited message to be found by its text but received %+v, %v", found, err)
+		}
+
+		// the loaded chats keep working as before
+		if err := s.AddChatLine(domain.Message{Id: "g2", ChatId: group.Id, UserId: currentUser.Id, Text: "back", At: now.Add(time.Minute)}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+	})
+}
+
+func TestStore_Passphrase(t *testing.T) {
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1 := domain.User{Id: "user1", Name: "user1"}
+
+	// prepare saves a secret message into a new encrypted store and closes it
+	prepare := func(t *testing.T) string {
+		path := filepath.Join(t.TempDir(), "chats.db")
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s, closeStore := openStore(t, ctx, path, currentUser, WithPassphrase("old secret"))
+		defer closeStore()
+		if err := s.UpsertUser(testUser1); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chat, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if err := s.AddChatLine(domain.Message{Id: "message-about-the-oak", ChatId: chat.Id, UserId: testUser1.Id, Text: "the treasure is buried under the oak", At: time.Now()}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		return path
+	}
+
+	t.Run(`Given an encrypted store with a message,
+	When the store is opened again with a wrong passphrase, without passphrase and with the right one,
+	Then only the right passphrase unlocks it and nothing is saved in clear`, func(t *testing.T) {
+		// Given
+		path := prepare(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// When
+		_, _, wrongErr := NewStore(ctx, path, currentUser, maxMsgLen, WithPassphrase("guess"))
+		_, _, plainErr := NewStore(ctx, path, currentUser, maxMsgLen)
+		s, _ := openStore(t, ctx, path, currentUser, WithPassphrase("old secret"))
+
+		// Then
+		if !errors.Is(wrongErr, WrongPassphraseErr) {
+			t.Fatalf("expected %s but received %v", WrongPassphraseErr, wrongErr)
+		}
+		if !errors.Is(plainErr, EncryptedErr) {
+			t.Fatalf("expected %s but received %v", EncryptedErr, plainErr)
+		}
+		chat, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if len(chat.Content) != 1 || chat.Content[0].Text != "the treasure is buried under the oak" {
+			t.Fatalf("expected the message to be loaded but found %+v", chat.Content)
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read the database: %s", err)
+		}
+		// the secrets are long enough to not be found by chance in the encrypted records
+		for _, secret := range []string{"treasure", testUser1.Id, "message-about-the-oak"} {
+			if bytes.Contains(raw, []byte(secret)) {
+				t.Fatalf("expected %q to not be saved in clear", secret)
+			}
+		}
+	})
+
+	t.Run(`Given an encrypted store with a message,
+	When the passphrase is changed, once with a wrong current passphrase and once with the right one,
+	Then only the new passphrase unlocks the same messages`, func(t *testing.T) {
+		// Given
+		path := prepare(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		s, closeStore := openStore(t, ctx, path, currentUser, WithPassphrase("old secret"))
+
+		// When
+		wrongErr := s.ChangePassphrase("guess", "new secret")
+		err := s.ChangePassphrase("old secret", "new secret")
+
+		// Then
+		if !errors.Is(wrongErr, WrongPassphraseErr) {
+			t.Fatalf("expected %s but received %v", WrongPassphraseErr, wrongErr)
+		}
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		cancel()
+		closeStore()
+		ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+		if _, _, err := NewStore(ctx, path, currentUser, maxMsgLen, WithPassphrase("old secret")); !errors.Is(err, WrongPassphraseErr) {
+			t.Fatalf("expected %s but received %v", WrongPassphraseErr, err)
+		}
+		s, _ = openStore(t, ctx, path, currentUser, WithPassphrase("new secret"))
+		chat, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		m, err := s.GetMessage(chat.Id, "message-about-the-oak")
+		if err != nil || !strings.Contains(m.Text, "treasure") {
+			t.Fatalf("expected the message to be readable with the new passphrase but received %+v, %v", m, err)
+		}
+	})
+}
+
+// openStore opens the store at the given path, which is closed once the test is done.
+// The returned function closes the store earlier, like before opening it again.
+func openStore(t *testing.T, ctx context.Context, path string, currentUser domain.User, opts ...func(j *journal)) (data.PassphraseStore, func()) {
+	s, closeDB, err := NewStore(ctx, path, currentUser, maxMsgLen, opts...)
+	if err != nil {
+		t.Fatalf("failed to open the store: %s", err)
+	}
+	closeStore := func() {
+		if err := closeDB(); err != nil {
+			t.Fatalf("failed to close the store: %s", err)
+		}
+	}
+	t.Cleanup(closeStore)
+	return s, closeStore
+}
@@ -0,0 +1,318 @@
+package export
+
+import (
+	"errors"
+	"fmt"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/data"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	UnknownFormatErr = errors.New("unknown export format, use .jsonl, .md or .html")
+	InvalidFileErr   = errors.New("invalid export file")
+)
+
+// timeLayout is how the times are written in the Markdown and HTML exports
+const timeLayout = "2006-01-02 15:04:05 MST"
+
+// Format is the kind of file to which the chats are exported
+type Format string
+
+const (
+	// JSONLines writes a Record on each line. It's the only format that can be imported back, check Import.
+	JSONLines Format = "jsonl"
+	// Markdown writes a section for each chat with its messages as a list
+	Markdown Format = "markdown"
+	// HTML writes a single page, without any external resource, with a table of messages for each chat
+	HTML Format = "html"
+)
+
+// FormatOf returns the format matching the extension of the given path: .jsonl, .md or .html.
+func FormatOf(path string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".json":
+		return JSONLines, nil
+	case ".md", ".markdown":
+		return Markdown, nil
+	case ".html", ".htm":
+		return HTML, nil
+	default:
+		return "", fmt.Errorf("%w: %s", UnknownFormatErr, path)
+	}
+}
+
+// Write exports the given chats from the store, or all of its chats when none is given, in the given format.
+// The chats are written with their details, like their participants, and with all their messages, in order.
+// The error lines and the lines added by the application, like the ones announcing the members of a group, are flagged.
+func Write(w io.Writer, s data.Store, format Format, chatIds ...string) error {
+	exportedAt := time.Now()
+	chats, err := exportedChats(s, chatIds, exportedAt)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case JSONLines:
+		return writeJSONLines(w, chats)
+	case Markdown:
+		return writeMarkdown(w, s.CurrentUser(), exportedAt, chats)
+	case HTML:
+		return writeHTML(w, s.CurrentUser(), exportedAt, chats)
+	default:
+		return fmt.Errorf("%w: %s", UnknownFormatErr, format)
+	}
+}
+
+// Import reads the chats exported in the JSON Lines format and adds them to the store.
+// The messages that the store already has are skipped, check data.Store ImportChats. The number of messages added is returned.
+func Import(r io.Reader, s data.Store) (int, error) {
+	chats, err := Read(r)
+	if err != nil {
+		return 0, err
+	}
+	return s.ImportChats(chats)
+}
+
+// RecordType tells what a line of the JSON Lines export describes
+type RecordType string
+
+const (
+	RecordChat    RecordType = "chat"
+	RecordMessage RecordType = "message"
+)
+
+// Record is a line of the JSON Lines export. Each chat is followed by all of its messages, in order.
+type Record struct {
+	Type    RecordType     `json:"type"`
+	Chat    *ChatRecord    `json:"chat,omitempty"`
+	Message *MessageRecord `json:"message,omitempty"`
+}
+
+// ChatRecord describes an exported chat
+type ChatRecord struct {
+	Id    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Group bool   `json:"group"`
+	// Owner is the user that exported the chat
+	Owner Participant `json:"owner"`
+	// Creator is the id of the user that created the group chat
+	Creator string `json:"creator,omitempty"`
+	// Participants are the other users of the chat
+	Participants []Participant `json:"participants"`
+	Messages     int           `json:"messages"`
+	// FirstMessageAt and LastMessageAt are set only when the chat has messages
+	FirstMessageAt *time.Time `json:"first_message_at,omitempty"`
+	LastMessageAt  *time.Time `json:"last_message_at,omitempty"`
+	ExportedAt     time.Time  `json:"exported_at"`
+}
+
+// Participant is a user of an exported chat
+type Participant struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// MessageRecord describes an exported message
+type MessageRecord struct {
+	Id       string               `json:"id"`
+	ChatId   string               `json:"chat_id"`
+	ParentId string               `json:"parent_id,omitempty"`
+	UserId   string               `json:"user_id"`
+	UserName string               `json:"user_name"`
+	Text     string               `json:"text"`
+	At       time.Time            `json:"at"`
+	Kind     domain.MessageKind   `json:"kind,omitempty"`
+	Status   domain.MessageStatus `json:"status,omitempty"`
+	// Error flags the lines reporting an error, which were never sent to the other users
+	Error bool `json:"error,omitempty"`
+	// System flags the lines added by the application, like the ones announcing the members of a group
+	System     bool              `json:"system,omitempty"`
+	Edited     bool              `json:"edited,omitempty"`
+	Deleted    bool              `json:"deleted,omitempty"`
+	Reactions  []ReactionRecord  `json:"reactions,omitempty"`
+	File       *FileRecord       `json:"file,omitempty"`
+	Membership *MembershipRecord `json:"membership,omitempty"`
+}
+
+// ReactionRecord is the emoji with which a user reacted to an exported message
+type ReactionRecord struct {
+	UserId string `json:"user_id"`
+	Emoji  string `json:"emoji"`
+}
+
+// FileRecord describes a file offered in an exported chat. The paths are local to each user, so they are not exported.
+type FileRecord struct {
+	Name     string           `json:"name"`
+	Size     int64            `json:"size"`
+	Checksum string           `json:"checksum"`
+	State    domain.FileState `json:"state"`
+}
+
+// MembershipRecord describes the members of a group, as announced by an exported message
+type MembershipRecord struct {
+	ChatName string        `json:"chat_name"`
+	Members  []Participant `json:"members"`
+}
+
+// exportedChat is a chat together with its messages, ready to be written in any format
+type exportedChat struct {
+	ChatRecord
+	messages []MessageRecord
+}
+
+// title returns the name of the group or the names of the other users of a direct chat
+func (c exportedChat) title() string {
+	if c.Group {
+		return "#" + c.Name
+	}
+	names := make([]string, len(c.Participants))
+	for i, p := range c.Participants {
+		names[i] = p.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// exportedChats reads the given chats from the store, or all of them when none is given, ordered by their title.
+func exportedChats(s data.Store, chatIds []string, exportedAt time.Time) ([]exportedChat, error) {
+	var chats []domain.Chat
+	if len(chatIds) == 0 {
+		for _, c := range s.GetChats() {
+			chats = append(chats, c)
+		}
+	}
+	for _, id := range chatIds {
+		c, err := s.GetChat(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export chat %s: %w", id, err)
+		}
+		chats = append(chats, *c)
+	}
+	res := make([]exportedChat, len(chats))
+	for i, c := range chats {
+		res[i] = newExportedChat(c, exportedAt)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].title() != res[j].title() {
+			return res[i].title() < res[j].title()
+		}
+		return res[i].Id < res[j].Id
+	})
+	return res, nil
+}
+
+func newExportedChat(c domain.Chat, exportedAt time.Time) exportedChat {
+	res := exportedChat{
+		ChatRecord: ChatRecord{
+			Id:           c.Id,
+			Name:         c.Name,
+			Group:        c.Group,
+			Owner:        newParticipant(c.OwnerUser),
+			Creator:      c.CreatorId,
+			Participants: make([]Participant, len(c.Users)),
+			Messages:     len(c.Content),
+			ExportedAt:   exportedAt,
+		},
+		messages: make([]MessageRecord, len(c.Content)),
+	}
+	for i, u := range c.Users {
+		res.Participants[i] = newParticipant(u)
+	}
+	for i, m := range c.Content {
+		res.messages[i] = newMessageRecord(m)
+	}
+	if n := len(c.Content); n > 0 {
+		first, last := c.Content[0].At, c.Content[n-1].At
+		res.FirstMessageAt, res.LastMessageAt = &first, &last
+	}
+	return res
+}
+
+func newParticipant(u domain.User) Participant {
+	return Participant{Id: u.Id, Name: u.Name}
+}
+
+func newMessageRecord(m domain.Message) MessageRecord {
+	res := MessageRecord{
+		Id:       m.Id,
+		ChatId:   m.ChatId,
+		ParentId: m.ParentId,
+		UserId:   m.UserId,
+		UserName: m.UserName,
+		Text:     m.Text,
+		At:       m.At,
+		Kind:     m.Kind,
+		Status:   m.Status,
+		Error:    m.ErrorMessage,
+		System:   m.Kind == domain.MessageKindMembership,
+		Edited:   m.Edited,
+		Deleted:  m.Deleted,
+	}
+	for _, r := range m.Reactions {
+		res.Reactions = append(res.Reactions, ReactionRecord{UserId: r.UserId, Emoji: r.Emoji})
+	}
+	if m.File != nil {
+		res.File = &FileRecord{Name: m.File.Name, Size: m.File.Size, Checksum: m.File.Checksum, State: m.File.State}
+	}
+	if m.Membership != nil {
+		res.Membership = &MembershipRecord{ChatName: m.Membership.ChatName}
+		for _, u := range m.Membership.Members {
+			res.Membership.Members = append(res.Membership.Members, newParticipant(u))
+		}
+	}
+	return res
+}
+
+// message converts the record back into the message that it was exported from
+func (r MessageRecord) message() domain.Message {
+	res := domain.Message{
+		Id:           r.Id,
+		ChatId:       r.ChatId,
+		ParentId:     r.ParentId,
+		UserId:       r.UserId,
+		UserName:     r.UserName,
+		Text:         r.Text,
+		At:           r.At,
+		Kind:         r.Kind,
+		Status:       r.Status,
+		ErrorMessage: r.Error,
+		Edited:       r.Edited,
+		Deleted:      r.Deleted,
+	}
+	for _, rr := range r.Reactions {
+		res.Reactions = append(res.Reactions, domain.Reaction{UserId: rr.UserId, Emoji: rr.Emoji})
+	}
+	if r.File != nil {
+		res.File = &domain.FileTransfer{Name: r.File.Name, Size: r.File.Size, Checksum: r.File.Checksum, State: r.File.State}
+	}
+	if r.Membership != nil {
+		res.Membership = &domain.Membership{ChatName: r.Membership.ChatName}
+		for _, p := range r.Membership.Members {
+			res.Membership.Members = append(res.Membership.Members, p.user())
+		}
+	}
+	return res
+}
+
+// chat converts the record back into the chat that it was exported from, without its messages
+func (r ChatRecord) chat() domain.Chat {
+	res := domain.Chat{
+		Id:        r.Id,
+		Name:      r.Name,
+		Group:     r.Group,
+		OwnerUser: r.Owner.user(),
+		CreatorId: r.Creator,
+		Users:     make([]domain.User, len(r.Participants)),
+	}
+	for i, p := range r.Participants {
+		res.Users[i] = p.user()
+	}
+	return res
+}
+
+func (p Participant) user() domain.User {
+	return domain.User{Id: p.Id, Name: p.Name}
+}
@@ -0,0 +1,222 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/data"
+	"github.com/yottta/chat/client/infra/data/inmemory"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const maxMsgLen = 1000
+
+var (
+	currentUser = domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1   = domain.User{Id: "user1", Name: "user1"}
+	testUser2   = domain.User{Id: "user2", Name: "user2"}
+)
+
+// newTestStore returns a store with a direct chat, holding a reply, an edit, a reaction and an error line, and a group chat
+func newTestStore(t *testing.T, ctx context.Context) (data.Store, *domain.Chat, *domain.Chat) {
+	s := inmemory.NewStore(ctx, currentUser, maxMsgLen)
+	if err := s.RefreshUsers([]domain.User{testUser1, testUser2}); err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	direct, err := s.DirectChat(testUser1.Id)
+	if err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	group, err := s.CreateGroupChat("team", []domain.User{testUser1, testUser2})
+	if err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	now := time.Now()
+	for _, m := range []domain.Message{
+		{Id: "d1", ChatId: direct.Id, UserId: testUser1.Id, Text: "is <script>alert(1)</script> *safe*?", At: now},
+		{Id: "d2", ChatId: direct.Id, UserId: currentUser.Id, Text: "tpyo", At: now.Add(time.Second), ParentId: "d1"},
+		{Id: "d3", ChatId: direct.Id, UserId: testUser1.Id, Text: "the connection failed", At: now.Add(2 * time.Second), ErrorMessage: true},
+		{Id: "g1", ChatId: group.Id, UserId: testUser2.Id, Text: "hello team", At: now.Add(time.Minute)},
+	} {
+		if err := s.AddChatLine(m); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+	}
+	if err := s.EditMessage(direct.Id, "d2", "typo"); err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	if err := s.React(direct.Id, "d1", "👍"); err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	return s, direct, group
+}
+
+func TestImport(t *testing.T) {
+	t.Run(`Given a store with a direct chat and a group chat,
+	When all the chats are exported to JSON Lines and imported twice into a new store,
+	Then the new store has the same messages, added only once`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s, direct, group := newTestStore(t, ctx)
+		var exported bytes.Buffer
+		if err := Write(&exported, s, JSONLines); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		imported := inmemory.NewStore(ctx, currentUser, maxMsgLen)
+
+		// When
+		added, err := Import(bytes.NewReader(exported.Bytes()), imported)
+		addedAgain, againErr := Import(bytes.NewReader(exported.Bytes()), imported)
+
+		// Then
+		if err != nil || againErr != nil {
+			t.Fatalf("expected to receive no error but received %v and %v", err, againErr)
+		}
+		if added != 5 || addedAgain != 0 {
+			t.Fatalf("expected 5 messages to be added and none afterwards but %d and %d were", added, addedAgain)
+		}
+		for _, c := range []*domain.Chat{direct, group} {
+			expected, err := s.GetChat(c.Id)
+			if err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+			found, err := imported.GetChat(c.Id)
+			if err != nil {
+				t.Fatalf("expected the chat %s to be imported but received %s", c.Id, err)
+			}
+			if len(found.Content) != len(expected.Content) {
+				t.Fatalf("expected %d messages in chat %s but found %d", len(expected.Content), c.Id, len(found.Content))
+			}
+			for i := range expected.Content {
+				e, f := expected.Content[i], found.Content[i]
+				// the times are compared by their instant since the monotonic clock readings are not exported
+				if !e.At.Equal(f.At) {
+					t.Fatalf("expected message %s to be written at %s but found %s", e.Id, e.At, f.At)
+				}
+				e.At = f.At
+				// the messages that were not sent yet are not tracked once imported, check data.Store ImportChats
+				if e.Status == domain.MessageStatusPending {
+					e.Status = domain.MessageStatusNone
+				}
+				if !reflect.DeepEqual(e, f) {
+					t.Fatalf("expected message %+v but found %+v", e, f)
+				}
+			}
+		}
+	})
+
+	t.Run(`Given exports with a message before its chat and an unknown record,
+	When they are read,
+	Then InvalidFileErr is returned`, func(t *testing.T) {
+		for _, content := range []string{
+			`{"type":"message","message":{"id":"m1","chat_id":"c1"}}`,
+			`{"type":"chat","chat":{"id":"c1"}}` + "\n" + `{"type":"reaction"}`,
+			`not json`,
+		} {
+			// When
+			_, err := Read(strings.NewReader(content))
+
+			// Then
+			if !errors.Is(err, InvalidFileErr) {
+				t.Fatalf("expected %s for %q but received %v", InvalidFileErr, content, err)
+			}
+		}
+	})
+}
+
+func TestWrite(t *testing.T) {
+	t.Run(`Given a store with a direct chat and a group chat,
+	When the direct chat is exported to Markdown and HTML,
+	Then only the direct chat is written, with its participants, and its text is escaped and the error line flagged`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s, direct, _ := newTestStore(t, ctx)
+
+		for format, expected := range map[Format][]string{
+			Markdown: {
+				"## user1\n",
+				"- Participants: current\\_user\\_name (current\\_user\\_id), user1 (user1)\n",
+				`**user1**: is \<script\>alert(1)\</script\> \*safe\*? _(👍 by current\_user\_name)_`,
+				`**current\_user\_name**: typo _(reply to user1, edited)_`,
+				`**error**: the connection failed`,
+			},
+			HTML: {
+				"<h2>user1</h2>",
+				"<dd>current_user_name (current_user_id), user1 (user1)</dd>",
+				"is &lt;script&gt;alert(1)&lt;/script&gt; *safe*? <span class=\"notes\">(👍 by current_user_name)</span>",
+				`class="error"`,
+			},
+		} {
+			var out bytes.Buffer
+
+			// When
+			err := Write(&out, s, format, direct.Id)
+
+			// Then
+			if err != nil {
+				t.Fatalf("expected to receive no error for %s but received %s", format, err)
+			}
+			for _, e := range expected {
+				if !strings.Contains(out.String(), e) {
+					t.Fatalf("expected the %s export to contain %q but it is:\n%s", format, e, out.String())
+				}
+			}
+			if strings.Contains(out.String(), "team") || strings.Contains(out.String(), "<script>") {
+				t.Fatalf("expected the %s export to contain only the escaped direct chat but it is:\n%s", format, out.String())
+			}
+		}
+	})
+
+	t.Run(`Given a message with lines that start like Markdown blocks, some ended by carriage returns,
+	When its text is prepared for the Markdown export,
+	Then every line stays inside the list item of the message and is displayed as typed`, func(t *testing.T) {
+		// Given
+		text := "first\r\n- not an item\r+ nor this\n2. nor this one\n    1) indented\n![not an image](x)\n===\n\n&amp; last"
+
+		// When
+		escaped := markdownText(text)
+
+		// Then
+		expected := strings.Join([]string{
+			"first",
+			`\- not an item`,
+			`\+ nor this`,
+			`2\. nor this one`,
+			`&nbsp;&nbsp;&nbsp;&nbsp;1\) indented`,
+			`\!\[not an image\](x)`,
+			`\===`,
+			"",
+			`\&amp; last`,
+		}, "  \n  ")
+		if escaped != expected {
+			t.Fatalf("expected %q but got %q", expected, escaped)
+		}
+	})
+
+	t.Run(`Given the paths of exports,
+	When their format is looked up,
+	Then it's found by their extension`, func(t *testing.T) {
+		for path, expected := range map[string]Format{
+			"chat.jsonl":       JSONLines,
+			"incident/chat.MD": Markdown,
+			"chat.html":        HTML,
+		} {
+			// When
+			format, err := FormatOf(path)
+
+			// Then
+			if err != nil || format != expected {
+				t.Fatalf("expected %s for %s but received %s, %v", expected, path, format, err)
+			}
+		}
+		if _, err := FormatOf("chat.txt"); !errors.Is(err, UnknownFormatErr) {
+			t.Fatalf("expected %s but received %v", UnknownFormatErr, err)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package export
+
+import (
+	"github.com/yottta/chat/client/domain"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+)
+
+// htmlTemplate renders the whole export as a single page. The styles are inlined so the page can be attached as it is.
+var htmlTemplate = template.Must(template.New("export").Funcs(template.FuncMap{
+	"join": func(notes []string) string {
+		return strings.Join(notes, ", ")
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Chat export</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+dt { font-weight: bold; float: left; clear: left; width: 8em; }
+dd { margin-left: 9em; }
+table { border-collapse: collapse; width: 100%; margin-top: 1em; }
+th, td { text-align: left; vertical-align: top; padding: .3em .6em; border-bottom: 1px solid #ddd; }
+td.time { white-space: nowrap; color: #666; }
+td.text { white-space: pre-wrap; }
+tr.system td { color: #666; font-style: italic; }
+tr.error td { color: #b00020; }
+.notes { color: #666; font-size: .9em; }
+</style>
+</head>
+<body>
+<h1>Chat export</h1>
+<p>Exported by {{.Owner}} at {{.ExportedAt}}.</p>
+{{range .Chats}}
+<section>
+<h2>{{.Title}}</h2>
+<dl>
+<dt>Id</dt><dd><code>{{.Id}}</code></dd>
+<dt>Participants</dt><dd>{{.Participants}}</dd>
+<dt>Messages</dt><dd>{{.Messages}}</dd>
+</dl>
+{{if .Lines}}
+<table>
+<thead><tr><th>Time</th><th>Author</th><th>Message</th></tr></thead>
+<tbody>
+{{range .Lines}}<tr id="m-{{.Id}}"{{if .Error}} class="error"{{else if .System}} class="system"{{end}}>
+<td class="time">{{.At}}</td>
+<td>{{if .Error}}error{{else if .System}}system{{else}}{{.Author}}{{end}}</td>
+<td class="text">{{.Text}}{{if .Notes}} <span class="notes">({{join .Notes}})</span>{{end}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+{{end}}
+</section>
+{{end}}
+</body>
+</html>
+`))
+
+// htmlChat is a chat as displayed by the HTML export
+type htmlChat struct {
+	Id           string
+	Title        string
+	Participants string
+	Messages     string
+	Lines        []line
+}
+
+// writeHTML writes a page with the details of each chat followed by a table with its messages.
+func writeHTML(w io.Writer, owner domain.User, exportedAt time.Time, chats []exportedChat) error {
+	page := struct {
+		Owner      string
+		ExportedAt string
+		Chats      []htmlChat
+	}{
+		Owner:      participantText(newParticipant(owner)),
+		ExportedAt: exportedAt.Format(timeLayout),
+		Chats:      make([]htmlChat, len(chats)),
+	}
+	for i, c := range chats {
+		page.Chats[i] = htmlChat{
+			Id:           c.Id,
+			Title:        c.title(),
+			Participants: participantsText(c.ChatRecord),
+			Messages:     messagesText(c.ChatRecord),
+			Lines:        newLines(c),
+		}
+	}
+	return htmlTemplate.Execute(w, page)
+}
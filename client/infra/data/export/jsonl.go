@@ -0,0 +1,61 @@
+package export
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/yottta/chat/client/domain"
+	"io"
+)
+
+// writeJSONLines writes each chat as a Record followed by the records of its messages.
+func writeJSONLines(w io.Writer, chats []exportedChat) error {
+	enc := json.NewEncoder(w)
+	// the messages are kept as typed, like the urls with & in them
+	enc.SetEscapeHTML(false)
+	for _, c := range chats {
+		chat := c.ChatRecord
+		if err := enc.Encode(Record{Type: RecordChat, Chat: &chat}); err != nil {
+			return err
+		}
+		for i := range c.messages {
+			if err := enc.Encode(Record{Type: RecordMessage, Message: &c.messages[i]}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Read reads the chats exported in the JSON Lines format, together with their messages.
+// InvalidFileErr is returned when the content is not such an export.
+func Read(r io.Reader) ([]domain.Chat, error) {
+	var (
+		chats []domain.Chat
+		line  int
+	)
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			return chats, nil
+		}
+		line++
+		if err != nil {
+			return nil, fmt.Errorf("%w: record %d: %s", InvalidFileErr, line, err)
+		}
+		switch {
+		case rec.Type == RecordChat && rec.Chat != nil:
+			chats = append(chats, rec.Chat.chat())
+		case rec.Type == RecordMessage && rec.Message != nil:
+			if len(chats) == 0 || chats[len(chats)-1].Id != rec.Message.ChatId {
+				return nil, fmt.Errorf("%w: record %d: message %s is not after its chat", InvalidFileErr, line, rec.Message.Id)
+			}
+			last := &chats[len(chats)-1]
+			last.Content = append(last.Content, rec.Message.message())
+		default:
+			return nil, fmt.Errorf("%w: record %d: unknown record %q", InvalidFileErr, line, rec.Type)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package export
+
+import (
+	"fmt"
+	"strings"
+)
+
+// line is a message as displayed by the Markdown and HTML exports
+type line struct {
+	Id     string
+	At     string
+	Author string
+	Text   string
+	// Notes describe the message, like being edited or a reply, and its reactions
+	Notes  []string
+	Error  bool
+	System bool
+}
+
+// newLines renders the messages of the chat, the replies naming the author of the message they reply to.
+func newLines(c exportedChat) []line {
+	names := map[string]string{c.Owner.Id: c.Owner.Name}
+	for _, p := range c.Participants {
+		names[p.Id] = p.Name
+	}
+	authors := make(map[string]string, len(c.messages))
+	for _, m := range c.messages {
+		authors[m.Id] = m.UserName
+	}
+	res := make([]line, len(c.messages))
+	for i, m := range c.messages {
+		l := line{
+			Id:     m.Id,
+			At:     m.At.Format(timeLayout),
+			Author: m.UserName,
+			Text:   m.Text,
+			Error:  m.Error,
+			System: m.System,
+		}
+		if m.System && len(m.UserName) > 0 {
+			l.Text = m.UserName + " " + m.Text
+		}
+		if len(m.ParentId) > 0 {
+			if author, ok := authors[m.ParentId]; ok {
+				l.Notes = append(l.Notes, "reply to "+author)
+			} else {
+				l.Notes = append(l.Notes, "reply")
+			}
+		}
+		if m.Edited {
+			l.Notes = append(l.Notes, "edited")
+		}
+		if m.Deleted {
+			l.Text = "[message deleted]"
+		}
+		if m.File != nil {
+			l.Notes = append(l.Notes, fmt.Sprintf("file %s", m.File.State))
+		}
+		for _, r := range m.Reactions {
+			name, ok := names[r.UserId]
+			if !ok {
+				name = r.UserId
+			}
+			l.Notes = append(l.Notes, fmt.Sprintf("%s by %s", r.Emoji, name))
+		}
+		res[i] = l
+	}
+	return res
+}
+
+func participantText(p Participant) string {
+	return fmt.Sprintf("%s (%s)", p.Name, p.Id)
+}
+
+// participantsText lists the owner of the chat first and the other users afterwards.
+func participantsText(c ChatRecord) string {
+	texts := []string{participantText(c.Owner)}
+	for _, p := range c.Participants {
+		texts = append(texts, participantText(p))
+	}
+	return strings.Join(texts, ", ")
+}
+
+func messagesText(c ChatRecord) string {
+	if c.FirstMessageAt == nil || c.LastMessageAt == nil {
+		return "0"
+	}
+	return fmt.Sprintf("%d, from %s to %s", c.Messages, c.FirstMessageAt.Format(timeLayout), c.LastMessageAt.Format(timeLayout))
+}
@@ -0,0 +1,84 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/yottta/chat/client/domain"
+	"io"
+	"strings"
+	"time"
+)
+
+// markdownEscaper escapes the characters that Markdown would format inside a line, so the messages are displayed as typed
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `[`, `\[`, `]`, `\]`, `<`, `\<`, `>`, `\>`, `#`, `\#`, `|`, `\|`, `~`, `\~`, `&`, `\&`,
+)
+
+// markdownNewLines normalizes the line endings, so a lone carriage return does not end the list item of a message
+var markdownNewLines = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// markdownText escapes the text so it's displayed as typed. The lines of the text are joined with hard line breaks and
+// indented, so they stay inside the list item of the message, and the markers that would start a block, like a list
+// item or a heading, are escaped at the start of each of them.
+func markdownText(text string) string {
+	lines := strings.Split(markdownNewLines.Replace(text), "\n")
+	for i, l := range lines {
+		lines[i] = markdownEscaper.Replace(l)
+		if i > 0 {
+			lines[i] = markdownLineStart(lines[i])
+		}
+	}
+	return strings.Join(lines, "  \n  ")
+}
+
+// markdownLineStart escapes the marker that would start a block at the beginning of the line. The indentation is kept
+// with non-breaking spaces, since the spaces would nest the line into a list or a code block.
+func markdownLineStart(l string) string {
+	rest := strings.TrimLeft(l, " \t")
+	indent := strings.Repeat("&nbsp;", len(l)-len(rest))
+	digits := len(rest) - len(strings.TrimLeft(rest, "0123456789"))
+	switch {
+	case len(rest) == 0:
+		return ""
+	case strings.ContainsRune("-+=!", rune(rest[0])):
+		rest = `\` + rest
+	case digits > 0 && digits < len(rest) && (rest[digits] == '.' || rest[digits] == ')'):
+		rest = rest[:digits] + `\` + rest[digits:]
+	}
+	return indent + rest
+}
+
+// writeMarkdown writes a section for each chat, with its details followed by its messages as a list.
+func writeMarkdown(w io.Writer, owner domain.User, exportedAt time.Time, chats []exportedChat) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# Chat export\n\n")
+	fmt.Fprintf(bw, "Exported by %s at %s.\n", markdownText(participantText(newParticipant(owner))), exportedAt.Format(timeLayout))
+	for _, c := range chats {
+		fmt.Fprintf(bw, "\n## %s\n\n", markdownText(c.title()))
+		fmt.Fprintf(bw, "- Id: `%s`\n", c.Id)
+		fmt.Fprintf(bw, "- Participants: %s\n", markdownText(participantsText(c.ChatRecord)))
+		fmt.Fprintf(bw, "- Messages: %s\n", messagesText(c.ChatRecord))
+		if len(c.messages) > 0 {
+			fmt.Fprintln(bw)
+		}
+		for _, l := range newLines(c) {
+			fmt.Fprintf(bw, "- %s %s: %s", l.At, markdownAuthor(l), markdownText(l.Text))
+			if len(l.Notes) > 0 {
+				fmt.Fprintf(bw, " _(%s)_", markdownText(strings.Join(l.Notes, ", ")))
+			}
+			fmt.Fprintln(bw)
+		}
+	}
+	return bw.Flush()
+}
+
+func markdownAuthor(l line) string {
+	switch {
+	case l.Error:
+		return "**error**"
+	case l.System:
+		return "_system_"
+	default:
+		return "**" + markdownText(l.Author) + "**"
+	}
+}
@@ -0,0 +1,139 @@
+package inmemory
+
+import (
+	"context"
+	"github.com/yottta/chat/client/infra/data"
+	"sync"
+)
+
+// bus delivers every event published to all of its subscribers, in the order in which the events were published.
+// Each subscriber has its own queue, drained by its own goroutine, so a slow subscriber does not delay the others.
+// Publishing never blocks, so the store can publish while holding its lock.
+type bus[T any] struct {
+	ctx context.Context
+
+	m    *sync.Mutex
+	subs map[*subscriber[T]]struct{}
+}
+
+// subscriber holds the events published for a handler until it gets to them
+type subscriber[T any] struct {
+	handle func(ctx context.Context, e T)
+	limit  int
+
+	m     *sync.Mutex
+	queue []T
+	// wake is signaled when the queue gets new events and done is closed when the handler unsubscribed
+	wake chan struct{}
+	done chan struct{}
+}
+
+// newBus creates a bus whose subscribers stop receiving events once the given context is done.
+func newBus[T any](ctx context.Context) *bus[T] {
+	return &bus[T]{
+		ctx:  ctx,
+		m:    &sync.Mutex{},
+		subs: map[*subscriber[T]]struct{}{},
+	}
+}
+
+// subscribe delivers to the handler all the events published from now on, queued as described by the options.
+func (b *bus[T]) subscribe(handle func(ctx context.Context, e T), opts ...data.SubscribeOption) data.Unsubscribe {
+	var p data.QueuePolicy
+	for _, o := range opts {
+		o(&p)
+	}
+	sub := &subscriber[T]{
+		handle: handle,
+		limit:  p.Limit,
+
+		m:    &sync.Mutex{},
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	b.m.Lock()
+	b.subs[sub] = struct{}{}
+	b.m.Unlock()
+	go sub.run(b.ctx)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.m.Lock()
+			delete(b.subs, sub)
+			b.m.Unlock()
+			close(sub.done)
+		})
+	}
+}
+
+// publish queues the event for all the subscribers.
+// The bus is locked while queueing, so all the subscribers receive the events in the same order.
+func (b *bus[T]) publish(e T) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for sub := range b.subs {
+		sub.push(e)
+	}
+}
+
+func (s *subscriber[T]) push(e T) {
+	s.m.Lock()
+	if s.limit > 0 && len(s.queue) >= s.limit {
+		var zero T
+		s.queue[0] = zero
+		s.queue = s.queue[1:]
+	}
+	s.queue = append(s.queue, e)
+	s.m.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// already signaled, the queue is going to be drained anyway
+	}
+}
+
+// pop returns the oldest event from the queue, if any.
+func (s *subscriber[T]) pop() (T, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var zero T
+	if len(s.queue) == 0 {
+		return zero, false
+	}
+	e := s.queue[0]
+	s.queue[0] = zero
+	s.queue = s.queue[1:]
+	if len(s.queue) == 0 {
+		// release the memory used by a burst of events
+		s.queue = nil
+	}
+	return e, true
+}
+
+// run hands the queued events to the handler, one at a time, until the subscriber is done.
+func (s *subscriber[T]) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-s.wake:
+		}
+		for {
+			e, ok := s.pop()
+			if !ok {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.done:
+				return
+			default:
+			}
+			s.handle(ctx, e)
+		}
+	}
+}
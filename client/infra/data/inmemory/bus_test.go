@@ -0,0 +1,141 @@
+package inmemory
+
+import (
+	"context"
+	"github.com/yottta/chat/client/infra/data"
+	"testing"
+	"time"
+)
+
+func TestBus(t *testing.T) {
+	t.Run(`Given a bus with a handler that is blocked,
+	When many events are published,
+	Then publishing does not block and the handler receives all of them in order once released`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		b := newBus[int](ctx)
+		release := make(chan struct{})
+		received := make(chan int, 10000)
+		b.subscribe(func(ctx context.Context, e int) {
+			<-release
+			received <- e
+		})
+
+		// When
+		published := make(chan struct{})
+		go func() {
+			for i := 0; i < 10000; i++ {
+				b.publish(i)
+			}
+			close(published)
+		}()
+		select {
+		case <-published:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the events to be published without waiting for the handler")
+		}
+		close(release)
+
+		// Then
+		for i := 0; i < 10000; i++ {
+			select {
+			case e := <-received:
+				if e != i {
+					t.Fatalf("expected to receive event %d but received %d", i, e)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected to receive event %d", i)
+			}
+		}
+	})
+
+	t.Run(`Given a bus with a blocked handler subscribed with a queue limit,
+	When more events than the limit are published,
+	Then the handler receives the one it was handling and the latest ones, in order`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		b := newBus[int](ctx)
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+		received := make(chan int, 10)
+		b.subscribe(func(ctx context.Context, e int) {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+			received <- e
+		}, data.WithQueueLimit(3))
+
+		// When
+		b.publish(0)
+		<-started
+		for i := 1; i <= 10; i++ {
+			b.publish(i)
+		}
+		close(release)
+
+		// Then
+		for _, want := range []int{0, 8, 9, 10} {
+			select {
+			case e := <-received:
+				if e != want {
+					t.Fatalf("expected to receive event %d but received %d", want, e)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("expected to receive event %d", want)
+			}
+		}
+		select {
+		case e := <-received:
+			t.Fatalf("expected no other event but received %d", e)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run(`Given a bus with a blocked handler that has events queued,
+	When the handler unsubscribes,
+	Then the event being handled is finished and the queued ones are dropped`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		b := newBus[int](ctx)
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+		received := make(chan int, 10)
+		unsubscribe := b.subscribe(func(ctx context.Context, e int) {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+			received <- e
+		})
+		b.publish(0)
+		<-started
+		b.publish(1)
+		b.publish(2)
+
+		// When
+		unsubscribe()
+		close(release)
+		b.publish(3)
+
+		// Then
+		select {
+		case e := <-received:
+			if e != 0 {
+				t.Fatalf("expected to receive event 0 but received %d", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected to receive the event being handled")
+		}
+		select {
+		case e := <-received:
+			t.Fatalf("expected no other event but received %d", e)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package inmemory
+
+import (
+	"github.com/yottta/chat/client/domain"
+	"sort"
+	"sync"
+)
+
+// chat is a domain.Chat together with the indexes of its content. Each chat has its own lock, so adding messages to a chat
+// does not wait for the other chats.
+//
+// The content is shared with the snapshots returned by the store, so it's not changed in place while shared:
+// the new messages are either appended after the ones that the snapshots see or the content is copied first,
+// check #ownContentNoLock.
+type chat struct {
+	m *sync.Mutex
+	domain.Chat
+	// ids indexes the messages by their id, holding their position in the content
+	ids map[string]int
+	// replies indexes the replies by the id of the message they reply to
+	replies map[string][]string
+	// words indexes the messages that can be searched by the words of their text, check #searchNoLock
+	words map[string]map[string]struct{}
+	// shared is true when the content was returned in a snapshot since it was last copied
+	shared bool
+	// unread counts the messages of the other users placed after the last read one, check domain.Chat.LastRead
+	unread int
+}
+
+func newChat(details domain.Chat) *chat {
+	return &chat{
+		m:       &sync.Mutex{},
+		Chat:    details,
+		ids:     map[string]int{},
+		replies: map[string][]string{},
+		words:   map[string]map[string]struct{}{},
+	}
+}
+
+// snapshotNoLock returns a copy of the chat. The capacity of the content is limited to its length so appending to it
+// does not change the content of the chat.
+func (c *chat) snapshotNoLock() domain.Chat {
+	c.shared = true
+	res := c.Chat
+	res.Content = c.Content[:len(c.Content):len(c.Content)]
+	res.Unread = c.unread
+	return res
+}
+
+// insertNoLock adds the message to the content, keeping the order of the chat, check domain.Message.Before.
+// The messages arrive mostly in order, so the latest one is appended in constant time. The older ones are placed using
+// a binary search and the later messages are moved to make room, which is cheap for the ones delayed only a bit.
+func (c *chat) insertNoLock(m domain.Message) {
+	n := len(c.Content)
+	if n == 0 || !m.Before(c.Content[n-1]) {
+		c.appendNoLock(m)
+		return
+	}
+	i := sort.Search(n, func(i int) bool {
+		return m.Before(c.Content[i])
+	})
+	c.countUnreadNoLock(m, i)
+	c.ownContentNoLock(1)
+	c.Content = append(c.Content, domain.Message{})
+	copy(c.Content[i+1:], c.Content[i:n])
+	c.Content[i] = m
+	for j := i; j <= n; j++ {
+		c.ids[c.Content[j].Id] = j
+	}
+	c.indexReplyNoLock(m)
+	c.indexWordsNoLock(m)
+}
+
+// insertReadNoLock adds the message like #insertNoLock, without counting it as unread, like the imported ones.
+func (c *chat) insertReadNoLock(m domain.Message) {
+	unread := c.unread
+	c.insertNoLock(m)
+	c.unread = unread
+}
+
+// appendNoLock adds the message at the end of the content, so it has to be the latest one.
+func (c *chat) appendNoLock(m domain.Message) {
+	c.countUnreadNoLock(m, len(c.Content))
+	c.Content = append(c.Content, m)
+	c.ids[m.Id] = len(c.Content) - 1
+	c.indexReplyNoLock(m)
+	c.indexWordsNoLock(m)
+}
+
+// replaceNoLock replaces the message from the given position with its changed version.
+func (c *chat) replaceNoLock(i int, m domain.Message) {
+	c.unindexWordsNoLock(c.Content[i])
+	c.ownContentNoLock(0)
+	c.Content[i] = m
+	c.indexWordsNoLock(m)
+}
+
+// ownContentNoLock copies the content when it's shared with a snapshot, so it can be changed in place afterwards.
+// The copy has room for the given number of messages more.
+func (c *chat) ownContentNoLock(more int) {
+	if !c.shared {
+		return
+	}
+	content := make([]domain.Message, len(c.Content), cap(c.Content)+more)
+	copy(content, c.Content)
+	c.Content, c.shared = content, false
+}
+
+// countUnreadNoLock counts the message as unread when it's from another user and it's placed after the last read message.
+// It's called before the message is placed at the given position. While the last read message is not in the content yet,
+// like while the chat is loaded, the messages are placed before it.
+func (c *chat) countUnreadNoLock(m domain.Message, position int) {
+	if m.UserId == c.OwnerUser.Id || m.ErrorMessage || !m.Kind.IsAddedToChat() {
+		return
+	}
+	lastRead := -1
+	if len(c.LastRead) > 0 {
+		if lastRead = c.findNoLock(c.LastRead); lastRead < 0 {
+			return
+		}
+	}
+	if position > lastRead {
+		c.unread++
+	}
+}
+
+// indexReplyNoLock indexes the message as a reply to its parent, if it's a reply.
+func (c *chat) indexReplyNoLock(m domain.Message) {
+	if len(m.ParentId) == 0 {
+		return
+	}
+	c.replies[m.ParentId] = append(c.replies[m.ParentId], m.Id)
+}
+
+// findNoLock returns the position of the message with the given id in the content or -1 when not found.
+func (c *chat) findNoLock(messageId string) int {
+	i, ok := c.ids[messageId]
+	if !ok || i >= len(c.Content) || c.Content[i].Id != messageId {
+		return -1
+	}
+	return i
+}
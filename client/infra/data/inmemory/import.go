@@ -0,0 +1,157 @@
+package inmemory
+
+import (
+	"fmt"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/data"
+	"sort"
+)
+
+// ImportChats adds the given chats, like the ones read from an export, to the store. The chats that are missing are created,
+// the direct ones as offline until their user is online again. The imported messages are never counted as unread.
+// The messages that the store already has, by id, are skipped, so importing the same chats again changes nothing.
+// The current user needs to be a member of each chat.
+// The messages are not new, so they are not scheduled to the handlers registered using #RegisterMessageHandler and are
+// never sent to the other users. Only the chats that changed are scheduled to the handlers registered using #RegisterChatHandler.
+// The number of messages added is returned, even when a later chat could not be imported.
+func (s *store) ImportChats(chats []domain.Chat) (int, error) {
+	var added int
+	for _, c := range chats {
+		n, err := s.importChat(c)
+		added += n
+		if err != nil {
+			return added, err
+		}
+	}
+	return added, nil
+}
+
+func (s *store) importChat(imported domain.Chat) (int, error) {
+	users, err := s.importedUsers(imported)
+	if err != nil {
+		return 0, err
+	}
+	messages := make([]domain.Message, 0, len(imported.Content))
+	for _, m := range imported.Content {
+		if len(m.Id) == 0 || !m.Kind.IsAddedToChat() {
+			return 0, fmt.Errorf("%w: message without id or not added to chat %s", data.InvalidImportErr, imported.Id)
+		}
+		messages = append(messages, importedMessage(imported.Id, m))
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Before(messages[j])
+	})
+	c, created, err := s.importedChat(imported, users, messages)
+	if err != nil {
+		return 0, err
+	}
+	defer c.m.Unlock()
+
+	var added []domain.Message
+	seen := map[string]bool{}
+	for _, m := range messages {
+		if seen[m.Id] || c.findNoLock(m.Id) >= 0 {
+			continue
+		}
+		seen[m.Id] = true
+		added = append(added, m)
+	}
+	if len(added) == 0 {
+		if created {
+			s.sendChatUpdate(c.Id)
+		}
+		return 0, nil
+	}
+	if err := s.saveMessagesNoLock(c.Id, added...); err != nil {
+		return 0, err
+	}
+	read := c.unread == 0
+	for _, m := range added {
+		c.insertReadNoLock(m)
+	}
+	s.sendChatUpdate(c.Id)
+	// a chat that was read stays read, also once loaded again, so its last read message follows the imported ones
+	if latest := c.Content[len(c.Content)-1].Id; read && latest != c.LastRead {
+		details := c.Chat
+		details.LastRead = latest
+		if err := s.saveChatNoLock(details); err != nil {
+			return len(added), err
+		}
+		c.Chat = details
+	}
+	return len(added), nil
+}
+
+// importedChat returns the chat in which the messages are imported, locked, and true when it was created for them.
+// Only the creation of a chat holds the whole store, the messages are imported holding only the chat.
+// The history of a created chat is read, so its last read message is the latest imported one.
+func (s *store) importedChat(imported domain.Chat, users []domain.User, messages []domain.Message) (*chat, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if c, ok := s.chats[imported.Id]; ok {
+		c.m.Lock()
+		if c.Group != imported.Group {
+			c.m.Unlock()
+			return nil, false, fmt.Errorf("%w: chat %s is a group chat only on one side", data.InvalidImportErr, imported.Id)
+		}
+		return c, false, nil
+	}
+	c := newChat(domain.Chat{
+		Id:        imported.Id,
+		Name:      imported.Name,
+		Group:     imported.Group,
+		OwnerUser: s.currentUser,
+		CreatorId: imported.CreatorId,
+		Users:     users,
+		Offline:   !imported.Group,
+	})
+	if len(messages) > 0 {
+		c.LastRead = messages[len(messages)-1].Id
+	}
+	if err := s.saveChatNoLock(c.Chat); err != nil {
+		return nil, false, err
+	}
+	c.m.Lock()
+	s.chats[c.Id] = c
+	return c, true, nil
+}
+
+// importedUsers returns the members of the imported chat other than the current user, who has to be one of them.
+// The direct chats are checked to be the ones with the other user.
+func (s *store) importedUsers(imported domain.Chat) ([]domain.User, error) {
+	var (
+		users    []domain.User
+		isMember bool
+	)
+	for _, u := range imported.GetAllUsers() {
+		if u.Id == s.currentUser.Id {
+			isMember = true
+			continue
+		}
+		users = append(users, domain.User{Id: u.Id, Name: u.Name})
+	}
+	if !isMember {
+		return nil, fmt.Errorf("%w: user %s, chat: %s", data.UserNotInChatErr, s.currentUser.Id, imported.Id)
+	}
+	if !imported.Group && (len(users) != 1 || s.directChatId(users[0].Id) != imported.Id) {
+		return nil, fmt.Errorf("%w: chat %s is not a direct chat with the current user", data.InvalidImportErr, imported.Id)
+	}
+	return users, nil
+}
+
+// importedMessage prepares an imported message to be added to the chat. The messages of the current user that were not
+// sent are not tracked anymore, so they are never sent from the import, and the transfers of the files cannot continue.
+func importedMessage(chatId string, m domain.Message) domain.Message {
+	m.ChatId = chatId
+	if m.Status == domain.MessageStatusPending || m.Status == domain.MessageStatusFailed {
+		m.Status = domain.MessageStatusNone
+	}
+	if m.File != nil {
+		f := *m.File
+		if f.State == domain.FileStateAccepted {
+			f.State = domain.FileStateFailed
+		}
+		m.File = &f
+	}
+	return m
+}
@@ -0,0 +1,249 @@
+package inmemory
+
+import (
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/data"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Search returns the latest messages, from all the chats, that match the query, at most limit of them, the latest first.
+// The words are matched ignoring the case and the punctuation, so "kubectl apply" matches "Kubectl apply -f".
+// Only the messages that still have their text are found, so not the deleted ones.
+func (s *store) Search(query data.SearchQuery, limit int) ([]domain.Message, error) {
+	if limit <= 0 {
+		return nil, data.InvalidLimitErr
+	}
+	q := newSearchQuery(query)
+	if q.isEmpty() {
+		return nil, data.EmptySearchQueryErr
+	}
+	s.m.Lock()
+	chats := make([]*chat, 0, len(s.chats))
+	for _, c := range s.chats {
+		chats = append(chats, c)
+	}
+	s.m.Unlock()
+
+	var res []domain.Message
+	for _, c := range chats {
+		c.m.Lock()
+		found := c.searchNoLock(q)
+		c.m.Unlock()
+		if len(found) > limit {
+			found = found[len(found)-limit:]
+		}
+		res = append(res, found...)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[j].Before(res[i])
+	})
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+// searchQuery is a data.SearchQuery prepared to be matched against the messages
+type searchQuery struct {
+	// words are all the words that the message contains, from both the terms and the phrases
+	words   []string
+	phrases [][]string
+	sender  string
+	since   time.Time
+	until   time.Time
+}
+
+func newSearchQuery(query data.SearchQuery) searchQuery {
+	q := searchQuery{
+		sender: strings.TrimSpace(query.Sender),
+		since:  query.Since,
+		until:  query.Until,
+	}
+	seen := map[string]bool{}
+	addWords := func(ws []string) {
+		for _, w := range ws {
+			if !seen[w] {
+				seen[w] = true
+				q.words = append(q.words, w)
+			}
+		}
+	}
+	for _, t := range query.Terms {
+		addWords(words(t))
+	}
+	for _, p := range query.Phrases {
+		ws := words(p)
+		if len(ws) == 0 {
+			continue
+		}
+		addWords(ws)
+		if len(ws) > 1 {
+			q.phrases = append(q.phrases, ws)
+		}
+	}
+	return q
+}
+
+// isEmpty returns true when nothing is left to match, like when the terms are only punctuation
+func (q searchQuery) isEmpty() bool {
+	return len(q.words) == 0 && len(q.sender) == 0 && q.since.IsZero() && q.until.IsZero()
+}
+
+// matches checks the criteria that are not covered by the index: the sender and the phrases.
+func (q searchQuery) matches(m domain.Message) bool {
+	if !searchable(m) {
+		return false
+	}
+	if len(q.sender) > 0 && m.UserId != q.sender && !strings.EqualFold(m.UserName, q.sender) {
+		return false
+	}
+	if len(q.phrases) == 0 {
+		return true
+	}
+	ws := words(m.Text)
+	for _, p := range q.phrases {
+		if !containsPhrase(ws, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// searchNoLock returns the messages of the chat that match the query, in the order of the chat.
+// When the query has words, only the messages indexed under all of them are checked. Otherwise, all the messages
+// from the time range of the query are.
+func (c *chat) searchNoLock(q searchQuery) []domain.Message {
+	from, to := c.timeRangeNoLock(q.since, q.until)
+	if len(q.words) == 0 {
+		var res []domain.Message
+		for _, m := range c.Content[from:to] {
+			if q.matches(m) {
+				res = append(res, m)
+			}
+		}
+		return res
+	}
+	var positions []int
+	for _, id := range c.candidatesNoLock(q.words) {
+		i := c.findNoLock(id)
+		if i < from || i >= to || !q.matches(c.Content[i]) {
+			continue
+		}
+		positions = append(positions, i)
+	}
+	sort.Ints(positions)
+	res := make([]domain.Message, len(positions))
+	for ri, i := range positions {
+		res[ri] = c.Content[i]
+	}
+	return res
+}
+
+// candidatesNoLock returns the ids of the messages indexed under all the given words.
+func (c *chat) candidatesNoLock(ws []string) []string {
+	sets := make([]map[string]struct{}, len(ws))
+	for i, w := range ws {
+		sets[i] = c.words[w]
+		if len(sets[i]) == 0 {
+			return nil
+		}
+	}
+	// the smallest set is walked, so the words used rarely make the search fast
+	sort.Slice(sets, func(i, j int) bool {
+		return len(sets[i]) < len(sets[j])
+	})
+	var res []string
+	for id := range sets[0] {
+		found := true
+		for _, set := range sets[1:] {
+			if _, found = set[id]; !found {
+				break
+			}
+		}
+		if found {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// timeRangeNoLock returns the positions of the content between which the messages were written in the given time range.
+// The zero times leave the range open.
+func (c *chat) timeRangeNoLock(since, until time.Time) (int, int) {
+	from, to := 0, len(c.Content)
+	// the content is ordered by time first, check domain.Message.Before
+	if !since.IsZero() {
+		from = sort.Search(len(c.Content), func(i int) bool {
+			return !c.Content[i].At.Before(since)
+		})
+	}
+	if !until.IsZero() {
+		to = sort.Search(len(c.Content), func(i int) bool {
+			return c.Content[i].At.After(until)
+		})
+	}
+	if to < from {
+		to = from
+	}
+	return from, to
+}
+
+// indexWordsNoLock indexes the message by the words of its text, when it can be searched.
+func (c *chat) indexWordsNoLock(m domain.Message) {
+	if !searchable(m) {
+		return
+	}
+	for _, w := range words(m.Text) {
+		ids, ok := c.words[w]
+		if !ok {
+			ids = map[string]struct{}{}
+			c.words[w] = ids
+		}
+		ids[m.Id] = struct{}{}
+	}
+}
+
+// unindexWordsNoLock removes the message from the index, like before its text is changed.
+func (c *chat) unindexWordsNoLock(m domain.Message) {
+	if !searchable(m) {
+		return
+	}
+	for _, w := range words(m.Text) {
+		delete(c.words[w], m.Id)
+		if len(c.words[w]) == 0 {
+			delete(c.words, w)
+		}
+	}
+}
+
+// searchable returns true for the messages of the chat that still have their text.
+func searchable(m domain.Message) bool {
+	return m.Kind.IsAddedToChat() && !m.ErrorMessage && !m.Deleted
+}
+
+// words splits the text into its words, in lower case. The punctuation and the spaces separate the words.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// containsPhrase returns true when the phrase is found in the words, its words being one after the other.
+func containsPhrase(ws, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(ws); i++ {
+		found := true
+		for j, p := range phrase {
+			if ws[i+j] != p {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
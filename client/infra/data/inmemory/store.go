@@ -6,27 +6,79 @@ import (
 	"fmt"
 	"github.com/yottta/chat/client/domain"
 	"github.com/yottta/chat/client/infra/data"
-	"log"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
-const maxMsgLen = 15000
+// Journal receives the changes of the store before they are applied, so they can be persisted.
+// When the journal returns an error, the change is not applied and the error is returned to the caller.
+type Journal interface {
+	// SaveChat persists the details of a chat. The chat is given without its content and its unread count.
+	SaveChat(chat domain.Chat) error
+	// SaveMessages persists new or changed messages of the given chat.
+	SaveMessages(chatId string, messages ...domain.Message) error
+}
+
+// WithChats loads the given chats, together with their content, into the store. Useful to restore the chats persisted earlier.
+func WithChats(chats []domain.Chat) func(s *store) {
+	return func(s *store) {
+		for _, c := range chats {
+			content := make([]domain.Message, len(c.Content))
+			copy(content, c.Content)
+			sort.Slice(content, func(i, j int) bool {
+				return content[i].Before(content[j])
+			})
+			c.Content = nil
+			if len(c.LastRead) == 0 {
+				// the chats saved before the last read message was kept have it only in the status of their messages
+				c.LastRead = lastReadByStatus(c.OwnerUser.Id, content)
+			}
+			c.Unread = 0
+			loaded := newChat(c)
+			for _, m := range content {
+				loaded.appendNoLock(m)
+			}
+			s.chats[c.Id] = loaded
+		}
+	}
+}
+
+// lastReadByStatus returns the id of the latest message of the other users that is marked as read, if any.
+func lastReadByStatus(ownerId string, content []domain.Message) string {
+	for i := len(content) - 1; i >= 0; i-- {
+		m := content[i]
+		if m.UserId != ownerId && !m.ErrorMessage && m.Status == domain.MessageStatusRead {
+			return m.Id
+		}
+	}
+	return ""
+}
+
+// WithJournal sets the Journal that receives all the changes of the store.
+func WithJournal(j Journal) func(s *store) {
+	return func(s *store) {
+		s.journal = j
+	}
+}
 
 type store struct {
 	currentUser domain.User
+	maxMsgLen   int
+	journal     Journal
 
+	// m guards only the chats map. Each chat has its own lock, so the chats change independently of each other.
+	// When both are needed, m is locked first.
 	m     *sync.Mutex
-	chats map[string]domain.Chat
+	chats map[string]*chat
 
-	hm                        *sync.Mutex
-	chatLinesUpdatesListeners []data.MessageHandler
-	cm                        *sync.Mutex
-	chatUpdatesListeners      []data.ChatHandler
-
-	chatLineUpdates chan domain.Message
-	chatsUpdates    chan string
+	// the events are published while the chat is locked, so the handlers receive them in the order in which the changes happened
+	lines   *bus[domain.Message]
+	updates *bus[domain.Message]
+	chatIds *bus[string]
+	events  *bus[domain.ChatEvent]
 }
 
 // NewStore creates the object that is the heart of the application.
@@ -34,68 +86,601 @@ type store struct {
 // once your work with the store is done.
 //
 // This also needs the information of the current user. The purpose is to know what actor is the one that is running locally.
-func NewStore(ctx context.Context, currentUser domain.User) data.Store {
+// The messages with a text longer than maxMsgLen are refused, so it should match what the connections with the other users can carry.
+// The options can load the chats persisted earlier, with WithChats, and persist the changes, with WithJournal.
+func NewStore(ctx context.Context, currentUser domain.User, maxMsgLen int, opts ...func(s *store)) data.Store {
 	s := &store{
 		currentUser: currentUser,
+		maxMsgLen:   maxMsgLen,
 
 		m:     &sync.Mutex{},
-		chats: make(map[string]domain.Chat),
-
-		hm:              &sync.Mutex{},
-		chatLineUpdates: make(chan domain.Message, 10),
-		cm:              &sync.Mutex{},
-		chatsUpdates:    make(chan string, 10),
-	}
-
-	go func() {
-		defer log.Printf("store data updates closed")
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case m := <-s.chatLineUpdates:
-				for _, l := range s.chatLinesUpdatesListeners {
-					go l(ctx, m)
-				}
-			case cId := <-s.chatsUpdates:
-				for _, l := range s.chatUpdatesListeners {
-					go l(ctx, cId)
-				}
-			}
-		}
-	}()
+		chats: make(map[string]*chat),
+
+		lines:   newBus[domain.Message](ctx),
+		updates: newBus[domain.Message](ctx),
+		chatIds: newBus[string](ctx),
+		events:  newBus[domain.ChatEvent](ctx),
+	}
+	for _, o := range opts {
+		o(s)
+	}
 	return s
 }
 
 // AddChatLine stores a new domain.Message into the store.
 // In case the chat is not in the store, an error is raised.
 // In case that the targeted chat does not contain the targeted user, an error is raised.
+// Messages without an id receive a new one. The messages of the current user start as domain.MessageStatusPending and
+// the ones of the other users as domain.MessageStatusDelivered.
+// A message that is already in the chat, like one sent again by a user that missed its receipt, is ignored without an error.
+// In case the id is used by a message of another user, data.DuplicateMessageErr is raised.
 // Once the message is added to the store, the message is scheduled to be sent to the handlers registered using #RegisterMessageHandler.
+// The messages that are not domain.MessageKind.IsAddedToChat are not added, they change the earlier message with the same id.
 func (s *store) AddChatLine(message domain.Message) error {
-	if len(message.Text) > maxMsgLen {
-		return fmt.Errorf("messages limited to only %d characters", maxMsgLen)
+	if len(message.Text) > s.maxMsgLen {
+		return fmt.Errorf("messages limited to only %d characters", s.maxMsgLen)
 	}
-	s.m.Lock()
-	defer s.m.Unlock()
-	c, ok := s.chats[message.ChatId]
-	if !ok {
-		return fmt.Errorf("%w: %s", data.ChatNotFoundErr, message.ChatId)
+	var (
+		c   *chat
+		err error
+	)
+	if message.Kind == domain.MessageKindMembership {
+		// the membership can create the chat, so the whole store is locked to not create it twice
+		s.m.Lock()
+		defer s.m.Unlock()
+		c, err = s.applyMembershipNoLock(message)
+	} else {
+		c, err = s.lookup(message.ChatId)
+	}
+	if err != nil {
+		return err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if message.Kind.IsRevision() {
+		return s.reviseNoLock(c, message)
+	}
+	if message.Kind == domain.MessageKindReaction {
+		return s.reactNoLock(c, message)
+	}
+	if message.Kind == domain.MessageKindFile && (message.File == nil || c.Group) {
+		return fmt.Errorf("%w: files can be offered only in direct chats", data.NotFileMessageErr)
 	}
 	u, err := c.GetUser(message.UserId)
 	if err != nil {
 		return fmt.Errorf("%w: user %s, chat: %s", data.UserNotInChatErr, message.UserId, message.ChatId)
 	}
 	message.UserName = u.Name
-	c.Content = append(c.Content, message)
-	sort.Slice(c.Content, func(i, j int) bool {
-		return c.Content[i].At.Before(c.Content[j].At)
+	if i := c.findNoLock(message.Id); len(message.Id) > 0 && i >= 0 {
+		if c.Content[i].UserId != message.UserId {
+			return fmt.Errorf("%w: %s in chat %s", data.DuplicateMessageErr, message.Id, message.ChatId)
+		}
+		return nil
+	}
+	if len(message.Id) == 0 {
+		message.Id = domain.NewMessageId()
+	}
+	if !message.ErrorMessage && message.Status == domain.MessageStatusNone {
+		if message.UserId == s.currentUser.Id {
+			message.Status = domain.MessageStatusPending
+		} else {
+			message.Status = domain.MessageStatusDelivered
+		}
+	}
+	switch message.Kind {
+	case domain.MessageKindMembership:
+		message.Text = membershipText(*message.Membership)
+	case domain.MessageKindFile:
+		f := *message.File
+		message.File = &f
+		message.Text = fmt.Sprintf("offered the file %s (%d bytes)", f.Name, f.Size)
+	}
+	if err := s.saveMessagesNoLock(c.Id, message); err != nil {
+		return err
+	}
+	c.insertNoLock(message)
+	s.sendLineUpdate(message)
+	return nil
+}
+
+// GetMessage returns the message with the given id from the given chat.
+func (s *store) GetMessage(chatId, messageId string) (*domain.Message, error) {
+	c, err := s.lookup(chatId)
+	if err != nil {
+		return nil, err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	i := c.findNoLock(messageId)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: %s in chat %s", data.MessageNotFoundErr, messageId, chatId)
+	}
+	m := c.Content[i]
+	return &m, nil
+}
+
+// GetThread returns the message with the given id followed by all its replies, including the replies to the replies,
+// in the order of the chat.
+func (s *store) GetThread(chatId, messageId string) ([]domain.Message, error) {
+	c, err := s.lookup(chatId)
+	if err != nil {
+		return nil, err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	i := c.findNoLock(messageId)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: %s in chat %s", data.MessageNotFoundErr, messageId, chatId)
+	}
+	positions := []int{i}
+	pending := []string{messageId}
+	seen := map[string]bool{messageId: true}
+	for len(pending) > 0 {
+		id := pending[0]
+		pending = pending[1:]
+		for _, reply := range c.replies[id] {
+			if seen[reply] {
+				continue
+			}
+			seen[reply] = true
+			pending = append(pending, reply)
+			if ri := c.findNoLock(reply); ri >= 0 {
+				positions = append(positions, ri)
+			}
+		}
+	}
+	sort.Ints(positions)
+	thread := make([]domain.Message, len(positions))
+	for ti, pi := range positions {
+		thread[ti] = c.Content[pi]
+	}
+	return thread, nil
+}
+
+// LatestMessages returns the latest messages of the chat, at most limit of them, in the order of the chat.
+func (s *store) LatestMessages(chatId string, limit int) ([]domain.Message, error) {
+	if limit <= 0 {
+		return nil, data.InvalidLimitErr
+	}
+	c, err := s.lookup(chatId)
+	if err != nil {
+		return nil, err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	return page(c.Content, len(c.Content)-limit, len(c.Content)), nil
+}
+
+// MessagesBefore returns at most limit messages of the chat right before the message with the given id, in the order of the chat.
+// Used together with #LatestMessages, it walks the history of the chat backwards.
+func (s *store) MessagesBefore(chatId, messageId string, limit int) ([]domain.Message, error) {
+	if limit <= 0 {
+		return nil, data.InvalidLimitErr
+	}
+	c, err := s.lookup(chatId)
+	if err != nil {
+		return nil, err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	i := c.findNoLock(messageId)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: %s in chat %s", data.MessageNotFoundErr, messageId, chatId)
+	}
+	return page(c.Content, i-limit, i), nil
+}
+
+// MessagesAfter returns at most limit messages of the chat written right after the given time, in the order of the chat.
+func (s *store) MessagesAfter(chatId string, at time.Time, limit int) ([]domain.Message, error) {
+	if limit <= 0 {
+		return nil, data.InvalidLimitErr
+	}
+	c, err := s.lookup(chatId)
+	if err != nil {
+		return nil, err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	// the content is ordered by time first, check domain.Message.Before
+	i := sort.Search(len(c.Content), func(i int) bool {
+		return c.Content[i].At.After(at)
 	})
+	return page(c.Content, i, i+limit), nil
+}
 
-	s.chats[message.ChatId] = c
-	s.sendLineUpdate(message)
+// page returns a copy of the messages between the given positions, limited to the ones in the content.
+func page(content []domain.Message, from, to int) []domain.Message {
+	if from < 0 {
+		from = 0
+	}
+	if to > len(content) {
+		to = len(content)
+	}
+	if from >= to {
+		return []domain.Message{}
+	}
+	res := make([]domain.Message, to-from)
+	copy(res, content[from:to])
+	return res
+}
+
+// EditMessage replaces the text of a message of the current user. Check #AddChatLine for how it's applied.
+func (s *store) EditMessage(chatId, messageId, text string) error {
+	return s.AddChatLine(domain.Message{
+		Id:     messageId,
+		ChatId: chatId,
+		UserId: s.currentUser.Id,
+		Text:   text,
+		At:     time.Now(),
+		Kind:   domain.MessageKindEdit,
+	})
+}
+
+// DeleteMessage retracts a message of the current user. Check #AddChatLine for how it's applied.
+func (s *store) DeleteMessage(chatId, messageId string) error {
+	return s.AddChatLine(domain.Message{
+		Id:     messageId,
+		ChatId: chatId,
+		UserId: s.currentUser.Id,
+		At:     time.Now(),
+		Kind:   domain.MessageKindDelete,
+	})
+}
+
+// React sets the reaction of the current user to a message. An empty emoji removes the reaction. Check #AddChatLine for how it's applied.
+func (s *store) React(chatId, messageId, emoji string) error {
+	return s.AddChatLine(domain.Message{
+		Id:     messageId,
+		ChatId: chatId,
+		UserId: s.currentUser.Id,
+		Text:   emoji,
+		At:     time.Now(),
+		Kind:   domain.MessageKindReaction,
+	})
+}
+
+// maxReactionLen is the length in bytes of the longest emoji accepted as a reaction, enough for the ones composed of more code points
+const maxReactionLen = 32
+
+// reactNoLock applies a domain.MessageKindReaction message on the earlier message with the same id. Each member of the chat
+// has at most one reaction to a message, so a new reaction replaces the previous one of the same user.
+// The changed message is scheduled to be sent to the handlers registered using #RegisterMessageUpdateHandler and the reaction
+// itself to the ones registered using #RegisterMessageHandler, so it can be sent to the other users of the chat.
+func (s *store) reactNoLock(c *chat, reaction domain.Message) error {
+	u, err := c.GetUser(reaction.UserId)
+	if err != nil {
+		return fmt.Errorf("%w: user %s, chat: %s", data.UserNotInChatErr, reaction.UserId, reaction.ChatId)
+	}
+	emoji := strings.TrimSpace(reaction.Text)
+	if len(emoji) > maxReactionLen || strings.ContainsAny(emoji, " \t\n") {
+		return fmt.Errorf("%w: %q", data.InvalidReactionErr, reaction.Text)
+	}
+	i := c.findNoLock(reaction.Id)
+	if i < 0 {
+		return fmt.Errorf("%w: %s in chat %s", data.MessageNotFoundErr, reaction.Id, reaction.ChatId)
+	}
+	m := c.Content[i]
+	if m.ErrorMessage || m.Deleted || !m.Kind.IsAddedToChat() {
+		return fmt.Errorf("%w: message %s in chat %s", data.NotEditableMessageErr, m.Id, m.ChatId)
+	}
+	reactions := make([]domain.Reaction, 0, len(m.Reactions)+1)
+	for _, r := range m.Reactions {
+		if r.UserId != reaction.UserId {
+			reactions = append(reactions, r)
+		}
+	}
+	if len(emoji) > 0 {
+		reactions = append(reactions, domain.Reaction{UserId: reaction.UserId, Emoji: emoji})
+		sort.Slice(reactions, func(i, j int) bool {
+			return reactions[i].UserId < reactions[j].UserId
+		})
+	}
+	m.Reactions = reactions
+	if err := s.saveMessagesNoLock(c.Id, m); err != nil {
+		return err
+	}
+	c.replaceNoLock(i, m)
+	reaction.Text, reaction.UserName = emoji, u.Name
+	s.sendMessageUpdate(m)
+	s.sendLineUpdate(reaction)
+	return nil
+}
+
+// reviseNoLock applies a domain.MessageKindEdit or domain.MessageKindDelete message on the earlier message with the same id.
+// Only the author of a text message can change it and a retracted message cannot be changed anymore.
+// The changed message is scheduled to be sent to the handlers registered using #RegisterMessageUpdateHandler and the revision
+// itself to the ones registered using #RegisterMessageHandler, so it can be sent to the other users of the chat.
+func (s *store) reviseNoLock(c *chat, revision domain.Message) error {
+	i := c.findNoLock(revision.Id)
+	if i < 0 {
+		return fmt.Errorf("%w: %s in chat %s", data.MessageNotFoundErr, revision.Id, revision.ChatId)
+	}
+	m := c.Content[i]
+	if m.UserId != revision.UserId {
+		return fmt.Errorf("%w: message %s in chat %s", data.NotMessageAuthorErr, m.Id, m.ChatId)
+	}
+	if m.ErrorMessage || m.Kind != domain.MessageKindText || m.Deleted {
+		return fmt.Errorf("%w: message %s in chat %s", data.NotEditableMessageErr, m.Id, m.ChatId)
+	}
+	switch revision.Kind {
+	case domain.MessageKindEdit:
+		if len(strings.TrimSpace(revision.Text)) == 0 {
+			return fmt.Errorf("%w: the text of message %s cannot be empty", data.NotEditableMessageErr, m.Id)
+		}
+		m.Text, m.Edited = revision.Text, true
+	case domain.MessageKindDelete:
+		m.Text, m.Deleted, m.Reactions = "", true, nil
+		revision.Text = ""
+	}
+	if err := s.saveMessagesNoLock(c.Id, m); err != nil {
+		return err
+	}
+	c.replaceNoLock(i, m)
+	revision.UserName = m.UserName
+	s.sendMessageUpdate(m)
+	s.sendLineUpdate(revision)
+	return nil
+}
+
+// SetMessageStatus changes the status of an existing message. The status can only move forward, check domain.MessageStatus.Precedes.
+// Since a chat is read in order, domain.MessageStatusRead is applied also to the earlier messages of the same author,
+// walking back only until the first one that was already read.
+// Once changed, the messages are scheduled to be sent to the handlers registered using #RegisterMessageUpdateHandler.
+func (s *store) SetMessageStatus(chatId, messageId string, status domain.MessageStatus) error {
+	c, err := s.lookup(chatId)
+	if err != nil {
+		return err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	idx := c.findNoLock(messageId)
+	if idx < 0 {
+		return fmt.Errorf("%w: %s in chat %s", data.MessageNotFoundErr, messageId, chatId)
+	}
+	var changed []int
+	for i := idx; i >= 0; i-- {
+		m := c.Content[i]
+		if m.UserId != c.Content[idx].UserId || m.ErrorMessage {
+			continue
+		}
+		if m.Status == domain.MessageStatusRead {
+			break
+		}
+		if m.Status.Precedes(status) {
+			changed = append([]int{i}, changed...)
+		}
+		if status != domain.MessageStatusRead {
+			break
+		}
+	}
+	if err := s.saveStatusNoLock(c, changed, status); err != nil {
+		return err
+	}
+	if len(changed) > 0 {
+		c.ownContentNoLock(0)
+	}
+	for _, i := range changed {
+		c.Content[i].Status = status
+		s.sendMessageUpdate(c.Content[i])
+	}
+	return nil
+}
+
+// SetFileTransfer replaces the details of the file offered by an existing domain.MessageKindFile message.
+// Once changed, the message is scheduled to be sent to the handlers registered using #RegisterMessageUpdateHandler.
+func (s *store) SetFileTransfer(chatId, messageId string, transfer domain.FileTransfer) error {
+	c, err := s.lookup(chatId)
+	if err != nil {
+		return err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	i := c.findNoLock(messageId)
+	if i < 0 {
+		return fmt.Errorf("%w: %s in chat %s", data.MessageNotFoundErr, messageId, chatId)
+	}
+	if c.Content[i].Kind != domain.MessageKindFile {
+		return fmt.Errorf("%w: %s in chat %s", data.NotFileMessageErr, messageId, chatId)
+	}
+	m := c.Content[i]
+	m.File = &transfer
+	if err := s.saveMessagesNoLock(c.Id, m); err != nil {
+		return err
+	}
+	c.replaceNoLock(i, m)
+	s.sendMessageUpdate(c.Content[i])
+	return nil
+}
+
+// MarkChatRead marks as read all the messages of the other users from the given chat. Only the messages placed after
+// domain.Chat.LastRead are walked since the ones before it were read already.
+// Only the latest message changed of each author is scheduled to be sent to the handlers registered using #RegisterMessageUpdateHandler
+// since the read status implies that all the messages before it were read too.
+// The latest message of the chat becomes its domain.Chat.LastRead, so the chat has no unread messages afterwards.
+func (s *store) MarkChatRead(chatId string) error {
+	c, err := s.lookup(chatId)
+	if err != nil {
+		return err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	lastByAuthor := map[string]int{}
+	var (
+		authors []string
+		changed []int
+	)
+	for i := c.findNoLock(c.LastRead) + 1; i < len(c.Content); i++ {
+		m := c.Content[i]
+		if m.UserId == s.currentUser.Id || m.ErrorMessage || !m.Status.Precedes(domain.MessageStatusRead) {
+			continue
+		}
+		changed = append(changed, i)
+		if _, ok := lastByAuthor[m.UserId]; !ok {
+			authors = append(authors, m.UserId)
+		}
+		lastByAuthor[m.UserId] = i
+	}
+	if err := s.saveStatusNoLock(c, changed, domain.MessageStatusRead); err != nil {
+		return err
+	}
+	details := c.Chat
+	if n := len(c.Content); n > 0 && c.Content[n-1].Id != c.LastRead {
+		details.LastRead = c.Content[n-1].Id
+		if err := s.saveChatNoLock(details); err != nil {
+			return err
+		}
+	}
+	c.Chat, c.unread = details, 0
+	if len(changed) > 0 {
+		c.ownContentNoLock(0)
+	}
+	for _, i := range changed {
+		c.Content[i].Status = domain.MessageStatusRead
+	}
+	for _, a := range authors {
+		s.sendMessageUpdate(c.Content[lastByAuthor[a]])
+	}
 	return nil
 }
 
+// CreateGroupChat creates a new group chat with the given name and members, the current user being part of it implicitly.
+// A domain.MessageKindMembership message is added to the chat in order to announce the group to all of its members.
+func (s *store) CreateGroupChat(name string, members []domain.User) (*domain.Chat, error) {
+	name = strings.TrimSpace(name)
+	if len(name) == 0 {
+		return nil, fmt.Errorf("%w: the group needs a name", data.InvalidMembershipErr)
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("%w: the group needs at least one other member", data.InvalidMembershipErr)
+	}
+	for _, u := range members {
+		if u.Id == s.currentUser.Id {
+			return nil, data.WrongNewChatUsersErr
+		}
+	}
+	chat := domain.Chat{
+		Id:        domain.NewChatId(),
+		Name:      name,
+		Group:     true,
+		OwnerUser: s.currentUser,
+		CreatorId: s.currentUser.Id,
+		Users:     members,
+	}
+	if err := s.storeChat(chat); err != nil {
+		return nil, err
+	}
+	if err := s.AddChatLine(s.membershipMessage(chat)); err != nil {
+		return nil, err
+	}
+	return s.GetChat(chat.Id)
+}
+
+// AddGroupMembers invites the given users into an existing group chat.
+// A domain.MessageKindMembership message is added to the chat in order to announce the new members list to all of the members.
+func (s *store) AddGroupMembers(chatId string, members []domain.User) error {
+	chat, err := s.GetChat(chatId)
+	if err != nil {
+		return err
+	}
+	if !chat.Group {
+		return fmt.Errorf("%w: %s", data.NotGroupChatErr, chatId)
+	}
+	if chat.CreatorId != s.currentUser.Id {
+		return fmt.Errorf("%w: %s", data.NotGroupCreatorErr, chatId)
+	}
+	for _, u := range members {
+		if _, err := chat.GetUser(u.Id); err == nil {
+			continue
+		}
+		chat.Users = append(chat.Users, u)
+	}
+	return s.AddChatLine(s.membershipMessage(*chat))
+}
+
+// applyMembershipNoLock creates or updates the group chat described by a domain.MessageKindMembership message.
+// The author of the message needs to be a member of the group. The author of the message creating the chat is its creator,
+// and only the creator can change the members of the chat afterwards.
+// The details of the members are taken from the users that the store already knows since the ones received from other users
+// cannot be trusted.
+func (s *store) applyMembershipNoLock(message domain.Message) (*chat, error) {
+	ms := message.Membership
+	if ms == nil {
+		return nil, fmt.Errorf("%w: no members", data.InvalidMembershipErr)
+	}
+	var authorIncluded, currentUserIncluded bool
+	for _, u := range ms.Members {
+		authorIncluded = authorIncluded || u.Id == message.UserId
+		currentUserIncluded = currentUserIncluded || u.Id == s.currentUser.Id
+	}
+	if !authorIncluded || !currentUserIncluded {
+		return nil, fmt.Errorf("%w: the group %s should include both the author and the current user", data.InvalidMembershipErr, message.ChatId)
+	}
+	users := make([]domain.User, 0, len(ms.Members))
+	for _, u := range ms.Members {
+		if u.Id == s.currentUser.Id {
+			continue
+		}
+		if direct, ok := s.chats[s.directChatId(u.Id)]; ok {
+			direct.m.Lock()
+			u = direct.Users[0]
+			direct.m.Unlock()
+		} else {
+			u = domain.User{Id: u.Id, Name: u.Name}
+		}
+		users = append(users, u)
+	}
+
+	c, ok := s.chats[message.ChatId]
+	if !ok {
+		c = newChat(domain.Chat{
+			Id:        message.ChatId,
+			Group:     true,
+			OwnerUser: s.currentUser,
+			CreatorId: message.UserId,
+		})
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if ok {
+		if !c.Group {
+			return nil, fmt.Errorf("%w: %s", data.NotGroupChatErr, message.ChatId)
+		}
+		if message.UserId != c.CreatorId {
+			return nil, fmt.Errorf("%w: user %s, chat: %s", data.NotGroupCreatorErr, message.UserId, message.ChatId)
+		}
+	}
+	details := c.Chat
+	details.Name, details.Users = ms.ChatName, users
+	if err := s.saveChatNoLock(details); err != nil {
+		return nil, err
+	}
+	c.Chat = details
+	s.chats[c.Id] = c
+	s.sendChatUpdate(c.Id)
+	return c, nil
+}
+
+func (s *store) membershipMessage(chat domain.Chat) domain.Message {
+	return domain.Message{
+		ChatId: chat.Id,
+		UserId: s.currentUser.Id,
+		At:     time.Now(),
+		Kind:   domain.MessageKindMembership,
+		Membership: &domain.Membership{
+			ChatName: chat.Name,
+			Members:  chat.GetAllUsers(),
+		},
+	}
+}
+
+func membershipText(ms domain.Membership) string {
+	names := make([]string, len(ms.Members))
+	for i, u := range ms.Members {
+		names[i] = u.Name
+	}
+	return fmt.Sprintf("set the members of %s to %s", ms.ChatName, strings.Join(names, ", "))
+}
+
 // RefreshUsers gets a list of users. It's trying to create new domain.Chat in the store with these.
 // Will be generated one chat per user. Each chat object is requiring an id which is created as base64(join(sort({currentUser.id, users[n]}), "_"))
 // If the users in the store are not in the received list of users, the chats are marked as offline.
@@ -114,24 +699,101 @@ func (s *store) RefreshUsers(users []domain.User) error {
 
 		delete(chats, chat.Id)
 
-		s.storeChat(*chat)
+		if err := s.storeChat(*chat); err != nil {
+			return err
+		}
+		if err := s.updateGroupsUser(u); err != nil {
+			return err
+		}
 	}
 	for _, c := range chats {
+		if c.Group {
+			continue
+		}
 		c.Offline = true
-		s.storeChat(c)
+		if err := s.storeChat(c); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// GetChat gets a chat by the given ID. Error if not found.
-func (s *store) GetChat(chatId string) (*domain.Chat, error) {
+// UpsertUser creates or updates the chat with the given user and marks it as online.
+func (s *store) UpsertUser(user domain.User) error {
+	if user.Id == s.CurrentUser().Id {
+		return nil
+	}
+	chat, err := s.buildChat(user)
+	if err != nil {
+		return err
+	}
+	if err := s.storeChat(*chat); err != nil {
+		return err
+	}
+	return s.updateGroupsUser(user)
+}
+
+// updateGroupsUser refreshes the details of the given user in all the group chats that the user is member of.
+func (s *store) updateGroupsUser(user domain.User) error {
 	s.m.Lock()
 	defer s.m.Unlock()
-	c, ok := s.chats[chatId]
-	if !ok {
-		return nil, fmt.Errorf("%w: %s", data.ChatNotFoundErr, chatId)
+	for _, c := range s.chats {
+		if err := s.updateGroupUser(c, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateGroupUser refreshes the details of the given user in the chat, when it's a group chat that the user is member of.
+func (s *store) updateGroupUser(c *chat, user domain.User) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if !c.Group {
+		return nil
+	}
+	for i, u := range c.Users {
+		if u.Id != user.Id || reflect.DeepEqual(u, user) {
+			continue
+		}
+		details := c.Chat
+		details.Users = make([]domain.User, len(c.Users))
+		copy(details.Users, c.Users)
+		details.Users[i] = user
+		if err := s.saveChatNoLock(details); err != nil {
+			return err
+		}
+		c.Chat = details
+		s.sendChatUpdate(c.Id)
 	}
-	return &c, nil
+	return nil
+}
+
+// SetUserOffline marks as offline the direct chat with the given user.
+func (s *store) SetUserOffline(userId string) error {
+	c, err := s.DirectChat(userId)
+	if err != nil {
+		return nil
+	}
+	c.Offline = true
+	return s.storeChat(*c)
+}
+
+// GetChat gets a chat by the given ID. Error if not found.
+func (s *store) GetChat(chatId string) (*domain.Chat, error) {
+	c, err := s.lookup(chatId)
+	if err != nil {
+		return nil, err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	res := c.snapshotNoLock()
+	return &res, nil
+}
+
+// DirectChat gets the one-to-one chat with the given user. Error if not found.
+func (s *store) DirectChat(userId string) (*domain.Chat, error) {
+	return s.GetChat(s.directChatId(userId))
 }
 
 // GetChats returns a map[string]domain.Chat where the key is the ID of the chat object.
@@ -139,51 +801,116 @@ func (s *store) GetChats() map[string]domain.Chat {
 	s.m.Lock()
 	defer s.m.Unlock()
 	res := make(map[string]domain.Chat, len(s.chats))
-	for k, v := range s.chats {
-		res[k] = v
+	for k, c := range s.chats {
+		c.m.Lock()
+		res[k] = c.snapshotNoLock()
+		c.m.Unlock()
 	}
 	return res
 }
 
+// PublishChatEvent sends the event to the handlers registered using #RegisterChatEventHandler. The event is not stored.
+// In case the chat is not in the store or the user of the event is not in the chat, an error is raised.
+func (s *store) PublishChatEvent(e domain.ChatEvent) error {
+	c, err := s.lookup(e.ChatId)
+	if err != nil {
+		return err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if _, err := c.GetUser(e.UserId); err != nil {
+		return fmt.Errorf("%w: user %s, chat: %s", data.UserNotInChatErr, e.UserId, e.ChatId)
+	}
+	s.sendChatEvent(e)
+	return nil
+}
+
 // CurrentUser gets the current user, the one that was used to initiate the store with.
 func (s *store) CurrentUser() domain.User {
 	return s.currentUser
 }
 
 // RegisterMessageHandler registers a new data.MessageHandler that will be called every time a new message will be saved into the store.
-func (s *store) RegisterMessageHandler(handler data.MessageHandler) {
-	s.hm.Lock()
-	defer s.hm.Unlock()
-	s.chatLinesUpdatesListeners = append(s.chatLinesUpdatesListeners, handler)
+func (s *store) RegisterMessageHandler(handler data.MessageHandler, opts ...data.SubscribeOption) data.Unsubscribe {
+	return s.lines.subscribe(handler, opts...)
+}
+
+// RegisterMessageUpdateHandler registers a new data.MessageUpdateHandler that will be called every time a message from the store changes.
+func (s *store) RegisterMessageUpdateHandler(handler data.MessageUpdateHandler, opts ...data.SubscribeOption) data.Unsubscribe {
+	return s.updates.subscribe(handler, opts...)
 }
 
 // RegisterChatHandler registers a new data.ChatHandler that will be called every time a new chat will be saved into the store.
-func (s *store) RegisterChatHandler(handler data.ChatHandler) {
-	s.cm.Lock()
-	defer s.cm.Unlock()
-	s.chatUpdatesListeners = append(s.chatUpdatesListeners, handler)
+func (s *store) RegisterChatHandler(handler data.ChatHandler, opts ...data.SubscribeOption) data.Unsubscribe {
+	return s.chatIds.subscribe(handler, opts...)
+}
+
+// RegisterChatEventHandler registers a new data.ChatEventHandler that will be called every time a chat event is published.
+func (s *store) RegisterChatEventHandler(handler data.ChatEventHandler, opts ...data.SubscribeOption) data.Unsubscribe {
+	return s.events.subscribe(handler, opts...)
 }
 
 func (s *store) sendLineUpdate(m domain.Message) {
-	if s.chatLineUpdates == nil {
-		return
+	s.lines.publish(m)
+}
+
+func (s *store) sendMessageUpdate(m domain.Message) {
+	s.updates.publish(m)
+}
+
+func (s *store) sendChatUpdate(cId string) {
+	s.chatIds.publish(cId)
+}
+
+func (s *store) sendChatEvent(e domain.ChatEvent) {
+	s.events.publish(e)
+}
+
+// lookup returns the chat with the given id. The chat needs to be locked before being used.
+func (s *store) lookup(chatId string) (*chat, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	c, ok := s.chats[chatId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", data.ChatNotFoundErr, chatId)
+	}
+	return c, nil
+}
+
+// saveChatNoLock hands the details of the chat to the journal, when the store has one.
+func (s *store) saveChatNoLock(chat domain.Chat) error {
+	if s.journal == nil {
+		return nil
+	}
+	chat.Content, chat.Unread = nil, 0
+	if err := s.journal.SaveChat(chat); err != nil {
+		return fmt.Errorf("failed to save chat %s: %w", chat.Id, err)
 	}
-	select {
-	case s.chatLineUpdates <- m:
-	default:
-		log.Printf("chat line update discarded because nobody is listening for it: %+v", m)
+	return nil
+}
+
+// saveMessagesNoLock hands the new or changed messages to the journal, when the store has one.
+func (s *store) saveMessagesNoLock(chatId string, messages ...domain.Message) error {
+	if s.journal == nil || len(messages) == 0 {
+		return nil
 	}
+	if err := s.journal.SaveMessages(chatId, messages...); err != nil {
+		return fmt.Errorf("failed to save the messages of chat %s: %w", chatId, err)
+	}
+	return nil
 }
 
-func (s *store) sendChatUpdate(cId string) {
-	if s.chatsUpdates == nil {
-		return
+// saveStatusNoLock hands to the journal the messages from the given positions of the chat with their status changed.
+func (s *store) saveStatusNoLock(c *chat, positions []int, status domain.MessageStatus) error {
+	if s.journal == nil {
+		return nil
 	}
-	select {
-	case s.chatsUpdates <- cId:
-	default:
-		log.Printf("chat update discarded because nobody is listening for it: %s", cId)
+	messages := make([]domain.Message, len(positions))
+	for i, p := range positions {
+		messages[i] = c.Content[p]
+		messages[i].Status = status
 	}
+	return s.saveMessagesNoLock(c.Id, messages...)
 }
 
 func (s *store) buildChat(users ...domain.User) (*domain.Chat, error) {
@@ -198,8 +925,7 @@ func (s *store) buildChat(users ...domain.User) (*domain.Chat, error) {
 		userIds[idx] = u.Id
 		idx++
 	}
-	sort.Strings(userIds)
-	chatId := base64.StdEncoding.EncodeToString([]byte(strings.Join(userIds, "_")))
+	chatId := chatIdFor(userIds)
 	chat := domain.Chat{
 		Id:        chatId,
 		OwnerUser: s.currentUser,
@@ -210,12 +936,34 @@ func (s *store) buildChat(users ...domain.User) (*domain.Chat, error) {
 	return &chat, nil
 }
 
-func (s *store) storeChat(chat domain.Chat) {
+func (s *store) directChatId(userId string) string {
+	return chatIdFor([]string{s.currentUser.Id, userId})
+}
+
+func chatIdFor(userIds []string) string {
+	sort.Strings(userIds)
+	return base64.StdEncoding.EncodeToString([]byte(strings.Join(userIds, "_")))
+}
+
+func (s *store) storeChat(details domain.Chat) error {
 	s.m.Lock()
 	defer s.m.Unlock()
-	if c, ok := s.chats[chat.Id]; ok {
-		chat.Content = c.Content
+	c, ok := s.chats[details.Id]
+	if !ok {
+		c = newChat(domain.Chat{Id: details.Id})
 	}
-	s.chats[chat.Id] = chat
-	s.sendChatUpdate(chat.Id)
+	c.m.Lock()
+	defer c.m.Unlock()
+	// the last read message is changed only by MarkChatRead and the unread messages are counted by the chat
+	details.Content, details.LastRead, details.Unread = c.Content, c.LastRead, 0
+	// the chats are refreshed often with the same details so save only the changes
+	if !ok || !reflect.DeepEqual(c.Chat, details) {
+		if err := s.saveChatNoLock(details); err != nil {
+			return err
+		}
+	}
+	c.Chat = details
+	s.chats[c.Id] = c
+	s.sendChatUpdate(c.Id)
+	return nil
 }
@@ -2,119 +2,100 @@ package inmemory
 
 import (
 	"context"
+	"fmt"
 	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/data"
+	"github.com/yottta/chat/client/infra/data/storetest"
+	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func TestStore_RefreshUsers(t *testing.T) {
-	currentUser := domain.User{
-		Id:      "current_user_id",
-		Name:    "current_user_name",
-		Address: "192.168.0.1",
-		Port:    1000,
-	}
-	testUser1 := domain.User{
-		Id:      "user1",
-		Name:    "user1",
-		Address: "192.168.0.1",
-		Port:    1001,
-	}
-	testUser2 := domain.User{
-		Id:      "user2",
-		Name:    "user2",
-		Address: "192.168.0.1",
-		Port:    1002,
-	}
-	t.Run(`Given a store, 
-	When RefreshUsers is called with two users but one is the current user, 
-	Then just one chat is added and the chat handler is called`, func(t *testing.T) {
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		s := NewStore(ctx, currentUser)
-		chatHandlerRequests := make(chan string, 1)
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, ctx context.Context, currentUser domain.User, maxMsgLen int) data.Store {
+		return NewStore(ctx, currentUser, maxMsgLen)
+	})
+}
 
-		s.RegisterChatHandler(func(ctx context.Context, chatId string) {
-			chatHandlerRequests <- chatId
-		})
-		err := s.RefreshUsers([]domain.User{
-			testUser1,
-			currentUser,
+// BenchmarkAddChatLine measures how adding a message scales with the history of the chat:
+// * in order: the message is the latest one of the chat, the usual case
+// * delayed: the message is older than the latest few of the chat, like the ones delayed by the network
+// * out of order: the message is older than any of the chat, placed anywhere in its history
+// * parallel chats: each goroutine adds the latest messages to its own chat
+func BenchmarkAddChatLine(b *testing.B) {
+	for _, size := range []int{100, 1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("in order/history=%d", size), func(b *testing.B) {
+			s, chats, start := benchmarkStore(b, 1, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				addBenchmarkLine(b, s, chats[0], start.Add(time.Duration(i)*time.Second))
+			}
 		})
-		if err != nil {
-			t.Fatalf("expected to receive no error but received %s", err)
-		}
-
-		var checksDone int
-	beforeCheck:
-		for {
-			select {
-			case chatId := <-chatHandlerRequests:
-				checksDone++
-				chat, err := s.GetChat(chatId)
-				if err != nil {
-					t.Fatalf("chat not found in store %s", err)
-				}
-				users := chat.GetOtherUsers()
-				if len(users) != 1 {
-					t.Fatalf("wrong number of users in chat %s. expected %d but received %d", chat.Id, 1, len(chat.Users))
-				}
-
-				if testUser1.Id != users[0].Id {
-					t.Fatalf("expected to find user with id %s in chat", testUser1.Id)
-				}
-				break beforeCheck
-			case <-time.After(1 * time.Second):
-				break beforeCheck
+		b.Run(fmt.Sprintf("delayed/history=%d", size), func(b *testing.B) {
+			s, chats, start := benchmarkStore(b, 1, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// a second later than the previous one but before the latest 10 messages
+				addBenchmarkLine(b, s, chats[0], start.Add(time.Duration(i-10)*time.Second+time.Millisecond))
 			}
-		}
-		if checksDone != 1 {
-			t.Fatalf("expected just one chat events. received %d", checksDone)
-		}
-
-	})
-
-	t.Run(`Given a store, 
-	When RefreshUsers is called with two users and afterwards with just one, 
-	Then the user missing from the second request is marked as offline`, func(t *testing.T) {
-		// Given
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		s := NewStore(ctx, currentUser)
-
-		err := s.RefreshUsers([]domain.User{
-			testUser1,
-			testUser2,
 		})
-		if err != nil {
-			t.Fatalf("expected to receive no error but received %s", err)
-		}
-		chats := s.GetChats()
-		if len(chats) != 2 {
-			t.Fatalf("expected to have 2 chats in the store but there are %d", len(chats))
-		}
-		for _, c := range chats {
-			if c.Offline {
-				t.Fatalf("all chats should be online but %s is offline", c.Id)
+		b.Run(fmt.Sprintf("out of order/history=%d", size), func(b *testing.B) {
+			s, chats, start := benchmarkStore(b, 1, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// spread over the whole history, between the existing messages
+				at := start.Add(-time.Duration((i*7919)%size+1)*time.Second + time.Millisecond)
+				addBenchmarkLine(b, s, chats[0], at)
 			}
-		}
-
-		// When
-		err = s.RefreshUsers([]domain.User{
-			testUser1,
 		})
-		if err != nil {
-			t.Fatalf("expected to receive no error but received %s", err)
-		}
-		chats = s.GetChats()
-		if len(chats) != 2 {
-			t.Fatalf("expected to have 2 chats in the store but there are %d", len(chats))
+		b.Run(fmt.Sprintf("parallel chats/history=%d", size), func(b *testing.B) {
+			s, chats, start := benchmarkStore(b, runtime.GOMAXPROCS(0), size)
+			var next int32
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				chat := chats[int(atomic.AddInt32(&next, 1)-1)%len(chats)]
+				for i := 0; pb.Next(); i++ {
+					addBenchmarkLine(b, s, chat, start.Add(time.Duration(i)*time.Second))
+				}
+			})
+		})
+	}
+}
+
+// benchmarkStore creates a store with the given number of direct chats, each with size messages, one every second.
+// It returns the chats and the time right after their latest message.
+func benchmarkStore(b *testing.B, chats, size int) (data.Store, []domain.Chat, time.Time) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Cleanup(cancel)
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	start := time.Now()
+	res := make([]domain.Chat, chats)
+	for c := range res {
+		u := domain.User{Id: fmt.Sprintf("user%d", c), Name: fmt.Sprintf("user%d", c)}
+		chat := domain.Chat{
+			Id:        chatIdFor([]string{currentUser.Id, u.Id}),
+			OwnerUser: currentUser,
+			Users:     []domain.User{u},
+			Content:   make([]domain.Message, size),
 		}
-		for _, c := range chats {
-			if c.Offline == (c.Users[0].Id == testUser2.Id) {
-				continue
+		for i := range chat.Content {
+			chat.Content[i] = domain.Message{
+				Id:     fmt.Sprintf("history-%d", i),
+				ChatId: chat.Id,
+				UserId: u.Id,
+				Text:   "hello",
+				At:     start.Add(time.Duration(i-size) * time.Second),
+				Status: domain.MessageStatusRead,
 			}
-			t.Fatalf("chat %s should have been offline=%t", c.Id, c.Users[0].Id == testUser2.Id)
 		}
-	})
+		res[c] = chat
+	}
+	return NewStore(ctx, currentUser, 1000, WithChats(res)), res, start
+}
+
+func addBenchmarkLine(b *testing.B, s data.Store, chat domain.Chat, at time.Time) {
+	if err := s.AddChatLine(domain.Message{ChatId: chat.Id, UserId: chat.Users[0].Id, Text: "hello", At: at}); err != nil {
+		b.Fatalf("expected to receive no error but received %s", err)
+	}
 }
@@ -0,0 +1,149 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	EmptySearchQueryErr   = errors.New("the search needs at least a word, a phrase, a sender or a date")
+	InvalidSearchQueryErr = errors.New("invalid search")
+)
+
+const (
+	searchDateLayout     = "2006-01-02"
+	searchDateTimeLayout = "2006-01-02T15:04"
+)
+
+// SearchQuery describes the messages looked for by Store.Search. A message matches when it matches all the criteria given.
+type SearchQuery struct {
+	// Terms are the words that the message contains, in any order
+	Terms []string
+	// Phrases are the sequences of words that the message contains, one after the other
+	Phrases []string
+	// Sender is the name or the id of the author of the message
+	Sender string
+	// Since and Until limit the time of the message, when given. Both are inclusive.
+	Since time.Time
+	Until time.Time
+}
+
+// IsEmpty returns true when the query has no criteria, so it would match all the messages.
+func (q SearchQuery) IsEmpty() bool {
+	return len(q.Terms) == 0 && len(q.Phrases) == 0 && len(q.Sender) == 0 && q.Since.IsZero() && q.Until.IsZero()
+}
+
+// ParseSearchQuery reads the query as typed by the user:
+// * word - a word that the message contains
+// * "some words" - the words that the message contains, one after the other
+// * from:name - the name or the id of the author of the message. A name with spaces can be quoted: from:"Jane Doe"
+// * since:date - the messages written at the given date or later. The date is 2006-01-02 or 2006-01-02T15:04, in local time
+// * until:date - the messages written at the given date or earlier. A day includes all of its messages
+func ParseSearchQuery(text string) (SearchQuery, error) {
+	var q SearchQuery
+	fields, err := searchFields(text)
+	if err != nil {
+		return q, err
+	}
+	for _, f := range fields {
+		if f.quoted {
+			q.Phrases = append(q.Phrases, f.text)
+			continue
+		}
+		key, value, ok := strings.Cut(f.text, ":")
+		if !ok {
+			q.Terms = append(q.Terms, f.text)
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "from":
+			q.Sender = value
+		case "since":
+			if q.Since, err = parseSearchTime(value, false); err != nil {
+				return q, err
+			}
+		case "until":
+			if q.Until, err = parseSearchTime(value, true); err != nil {
+				return q, err
+			}
+		default:
+			// like the urls or the times pasted in the messages
+			q.Terms = append(q.Terms, f.text)
+		}
+	}
+	if !q.Since.IsZero() && !q.Until.IsZero() && q.Until.Before(q.Since) {
+		return q, fmt.Errorf("%w: until is before since", InvalidSearchQueryErr)
+	}
+	if q.IsEmpty() {
+		return q, EmptySearchQueryErr
+	}
+	return q, nil
+}
+
+// searchField is a part of the query. It's quoted when the whole field was between quotes.
+type searchField struct {
+	text   string
+	quoted bool
+}
+
+// searchFields splits the query on the spaces that are not between quotes. The quotes are removed.
+func searchFields(text string) ([]searchField, error) {
+	var (
+		fields  []searchField
+		current strings.Builder
+		field   searchField
+		inQuote bool
+		started bool
+	)
+	flush := func() {
+		if started {
+			field.text = current.String()
+			if len(strings.TrimSpace(field.text)) > 0 {
+				fields = append(fields, field)
+			}
+		}
+		current.Reset()
+		field, started = searchField{}, false
+	}
+	for _, r := range text {
+		switch {
+		case r == '"':
+			if !started {
+				field.quoted = true
+			}
+			started, inQuote = true, !inQuote
+		case unicode.IsSpace(r) && !inQuote:
+			flush()
+		default:
+			started = true
+			current.WriteRune(r)
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("%w: a quote is not closed", InvalidSearchQueryErr)
+	}
+	flush()
+	return fields, nil
+}
+
+// parseSearchTime reads a date or a date and time in local time. When only the date is given and end is true,
+// the end of that day is returned.
+func parseSearchTime(value string, end bool) (time.Time, error) {
+	if t, err := time.ParseInLocation(searchDateTimeLayout, value, time.Local); err == nil {
+		if end {
+			return t.Add(time.Minute - time.Nanosecond), nil
+		}
+		return t, nil
+	}
+	t, err := time.ParseInLocation(searchDateLayout, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %q is not a date like %s or %s", InvalidSearchQueryErr, value, searchDateLayout, searchDateTimeLayout)
+	}
+	if end {
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	return t, nil
+}
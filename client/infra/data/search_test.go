@@ -0,0 +1,76 @@
+package data
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	t.Run(`Given a query with words, phrases, a sender and dates,
+	When it is parsed,
+	Then each part goes to its criteria and a day given to until includes all of it`, func(t *testing.T) {
+		// Given
+		text := `kubectl "apply -f" from:"Jane Doe" since:2023-05-01 until:2023-05-03 https://example.com "rollout  status"`
+
+		// When
+		q, err := ParseSearchQuery(text)
+
+		// Then
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		expected := SearchQuery{
+			Terms:   []string{"kubectl", "https://example.com"},
+			Phrases: []string{"apply -f", "rollout  status"},
+			Sender:  "Jane Doe",
+			Since:   time.Date(2023, 5, 1, 0, 0, 0, 0, time.Local),
+			Until:   time.Date(2023, 5, 4, 0, 0, 0, 0, time.Local).Add(-time.Nanosecond),
+		}
+		if !reflect.DeepEqual(q, expected) {
+			t.Fatalf("expected %+v but received %+v", expected, q)
+		}
+	})
+
+	t.Run(`Given a query with dates and times,
+	When it is parsed,
+	Then the times are kept and until includes the whole minute`, func(t *testing.T) {
+		// Given
+		text := `since:2023-05-01T10:30 until:2023-05-01T11:00`
+
+		// When
+		q, err := ParseSearchQuery(text)
+
+		// Then
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if !q.Since.Equal(time.Date(2023, 5, 1, 10, 30, 0, 0, time.Local)) {
+			t.Fatalf("expected since to be 10:30 but is %s", q.Since)
+		}
+		if !q.Until.Equal(time.Date(2023, 5, 1, 11, 1, 0, 0, time.Local).Add(-time.Nanosecond)) {
+			t.Fatalf("expected until to be the end of 11:00 but is %s", q.Until)
+		}
+	})
+
+	t.Run(`Given invalid queries,
+	When they are parsed,
+	Then errors are returned`, func(t *testing.T) {
+		for text, expected := range map[string]error{
+			``:                EmptySearchQueryErr,
+			`  ""  `:          EmptySearchQueryErr,
+			`"not closed`:     InvalidSearchQueryErr,
+			`since:yesterday`: InvalidSearchQueryErr,
+			`since:2023-05-03 until:2023-05-01 deploy`: InvalidSearchQueryErr,
+		} {
+			// When
+			_, err := ParseSearchQuery(text)
+
+			// Then
+			if !errors.Is(err, expected) {
+				t.Fatalf("expected %s for %q but received %v", expected, text, err)
+			}
+		}
+	})
+}
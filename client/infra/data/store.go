@@ -4,29 +4,99 @@ import (
 	"context"
 	"errors"
 	"github.com/yottta/chat/client/domain"
+	"time"
 )
 
 var (
-	UserNotInChatErr     = errors.New("user not found in chat")
-	ChatNotFoundErr      = errors.New("chat not found")
-	WrongNewChatUsersErr = errors.New("a new chat should not include the current user")
+	UserNotInChatErr      = errors.New("user not found in chat")
+	ChatNotFoundErr       = errors.New("chat not found")
+	MessageNotFoundErr    = errors.New("message not found")
+	WrongNewChatUsersErr  = errors.New("a new chat should not include the current user")
+	NotGroupChatErr       = errors.New("chat is not a group chat")
+	InvalidMembershipErr  = errors.New("invalid group membership")
+	NotFileMessageErr     = errors.New("message is not a file")
+	NotMessageAuthorErr   = errors.New("only the author can change a message")
+	NotEditableMessageErr = errors.New("message cannot be changed")
+	InvalidReactionErr    = errors.New("invalid reaction")
+	InvalidLimitErr       = errors.New("the limit of messages should be positive")
+	InvalidImportErr      = errors.New("invalid import")
+	DuplicateMessageErr   = errors.New("message id already used by another user")
+	NotGroupCreatorErr    = errors.New("only the creator of the group can change its members")
 )
 
 // MessageHandler is the function that is going to receive any domain.Message object that is added to the store
 type MessageHandler func(ctx context.Context, m domain.Message)
 
+// MessageUpdateHandler is the function that is going to receive any domain.Message object that is already in the store and changed
+type MessageUpdateHandler func(ctx context.Context, m domain.Message)
+
 // ChatHandler is the function that is going to receive any domain.Chat object that is added to the store
 type ChatHandler func(ctx context.Context, chatId string)
 
+// ChatEventHandler is the function that is going to receive any domain.ChatEvent published through the store
+type ChatEventHandler func(ctx context.Context, e domain.ChatEvent)
+
+// Unsubscribe stops delivering the events to the handler for which it was returned.
+// The events still queued for the handler are dropped, only the one being handled, if any, is finished.
+type Unsubscribe func()
+
+// QueuePolicy describes how the events are queued for a handler that is slower than the store.
+// Each handler receives the events one at a time, in the order in which they happened, from its own queue.
+type QueuePolicy struct {
+	// Limit is the maximum number of events queued for the handler. Once reached, the oldest queued event is dropped
+	// to make room for the new one, so the handler keeps receiving the latest events.
+	// Zero means no limit, so no event is ever lost.
+	Limit int
+}
+
+// SubscribeOption changes the QueuePolicy of a handler
+type SubscribeOption func(p *QueuePolicy)
+
+// WithQueueLimit bounds the events queued for the handler to the given limit. Useful for the handlers that care only about
+// the latest events, like the ones of the users typing. Check QueuePolicy.Limit.
+func WithQueueLimit(limit int) SubscribeOption {
+	return func(p *QueuePolicy) {
+		p.Limit = limit
+	}
+}
+
 // Store describes the functionality needed for the application to work. This is the central point
 // of the app as the communication between socket connectivity layer and UI layer is done through this.
 type Store interface {
 	RefreshUsers(users []domain.User) error
+	UpsertUser(user domain.User) error
+	SetUserOffline(userId string) error
 	AddChatLine(m domain.Message) error
+	SetMessageStatus(chatId, messageId string, status domain.MessageStatus) error
+	MarkChatRead(chatId string) error
+	SetFileTransfer(chatId, messageId string, transfer domain.FileTransfer) error
+	EditMessage(chatId, messageId, text string) error
+	DeleteMessage(chatId, messageId string) error
+	React(chatId, messageId, emoji string) error
+	PublishChatEvent(e domain.ChatEvent) error
+	CreateGroupChat(name string, members []domain.User) (*domain.Chat, error)
+	AddGroupMembers(chatId string, members []domain.User) error
 	GetChat(chatId string) (*domain.Chat, error)
+	GetMessage(chatId, messageId string) (*domain.Message, error)
+	GetThread(chatId, messageId string) ([]domain.Message, error)
+	LatestMessages(chatId string, limit int) ([]domain.Message, error)
+	MessagesBefore(chatId, messageId string, limit int) ([]domain.Message, error)
+	MessagesAfter(chatId string, at time.Time, limit int) ([]domain.Message, error)
+	Search(query SearchQuery, limit int) ([]domain.Message, error)
+	ImportChats(chats []domain.Chat) (int, error)
+	DirectChat(userId string) (*domain.Chat, error)
 	GetChats() map[string]domain.Chat
 	CurrentUser() domain.User
 
-	RegisterMessageHandler(handler MessageHandler)
-	RegisterChatHandler(handler ChatHandler)
+	RegisterMessageHandler(handler MessageHandler, opts ...SubscribeOption) Unsubscribe
+	RegisterMessageUpdateHandler(handler MessageUpdateHandler, opts ...SubscribeOption) Unsubscribe
+	RegisterChatHandler(handler ChatHandler, opts ...SubscribeOption) Unsubscribe
+	RegisterChatEventHandler(handler ChatEventHandler, opts ...SubscribeOption) Unsubscribe
+}
+
+// PassphraseStore is a Store that keeps the data encrypted with a key unlocked by a passphrase
+type PassphraseStore interface {
+	Store
+	// ChangePassphrase replaces the passphrase unlocking the data, once the current one is confirmed
+	ChangePassphrase(current, next string) error
 }
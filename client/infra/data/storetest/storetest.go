@@ -0,0 +1,1474 @@
+// Package storetest holds the tests that every data.Store implementation has to pass.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/data"
+	"strings"
+	"testing"
+	"time"
+)
+
+const maxMsgLen = 15000
+
+// Factory creates the data.Store under test. The store has to be released once the given context is done.
+type Factory func(t *testing.T, ctx context.Context, currentUser domain.User, maxMsgLen int) data.Store
+
+// Run runs all the tests against the stores created by the given factory.
+func Run(t *testing.T, newStore Factory) {
+	t.Run("RefreshUsers", func(t *testing.T) {
+		testRefreshUsers(t, newStore)
+	})
+	t.Run("UpsertUser", func(t *testing.T) {
+		testUpsertUser(t, newStore)
+	})
+	t.Run("AddChatLine", func(t *testing.T) {
+		testAddChatLine(t, newStore)
+	})
+	t.Run("GroupChat", func(t *testing.T) {
+		testGroupChat(t, newStore)
+	})
+	t.Run("SetMessageStatus", func(t *testing.T) {
+		testSetMessageStatus(t, newStore)
+	})
+	t.Run("SetFileTransfer", func(t *testing.T) {
+		testSetFileTransfer(t, newStore)
+	})
+	t.Run("PublishChatEvent", func(t *testing.T) {
+		testPublishChatEvent(t, newStore)
+	})
+	t.Run("EditMessage", func(t *testing.T) {
+		testEditMessage(t, newStore)
+	})
+	t.Run("React", func(t *testing.T) {
+		testReact(t, newStore)
+	})
+	t.Run("GetThread", func(t *testing.T) {
+		testGetThread(t, newStore)
+	})
+	t.Run("History", func(t *testing.T) {
+		testHistory(t, newStore)
+	})
+	t.Run("Subscriptions", func(t *testing.T) {
+		testSubscriptions(t, newStore)
+	})
+	t.Run("Search", func(t *testing.T) {
+		testSearch(t, newStore)
+	})
+	t.Run("Unread", func(t *testing.T) {
+		testUnread(t, newStore)
+	})
+	t.Run("ImportChats", func(t *testing.T) {
+		testImportChats(t, newStore)
+	})
+}
+
+func testRefreshUsers(t *testing.T, newStore Factory) {
+	currentUser := domain.User{
+		Id:      "current_user_id",
+		Name:    "current_user_name",
+		Address: "192.168.0.1",
+		Port:    1000,
+	}
+	testUser1 := domain.User{
+		Id:      "user1",
+		Name:    "user1",
+		Address: "192.168.0.1",
+		Port:    1001,
+	}
+	testUser2 := domain.User{
+		Id:      "user2",
+		Name:    "user2",
+		Address: "192.168.0.1",
+		Port:    1002,
+	}
+	t.Run(`Given a store, 
+	When RefreshUsers is called with two users but one is the current user, 
+	Then just one chat is added and the chat handler is called`, func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		chatHandlerRequests := make(chan string, 1)
+
+		s.RegisterChatHandler(func(ctx context.Context, chatId string) {
+			chatHandlerRequests <- chatId
+		})
+		err := s.RefreshUsers([]domain.User{
+			testUser1,
+			currentUser,
+		})
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		var checksDone int
+	beforeCheck:
+		for {
+			select {
+			case chatId := <-chatHandlerRequests:
+				checksDone++
+				chat, err := s.GetChat(chatId)
+				if err != nil {
+					t.Fatalf("chat not found in store %s", err)
+				}
+				users := chat.GetOtherUsers()
+				if len(users) != 1 {
+					t.Fatalf("wrong number of users in chat %s. expected %d but received %d", chat.Id, 1, len(chat.Users))
+				}
+
+				if testUser1.Id != users[0].Id {
+					t.Fatalf("expected to find user with id %s in chat", testUser1.Id)
+				}
+				break beforeCheck
+			case <-time.After(1 * time.Second):
+				break beforeCheck
+			}
+		}
+		if checksDone != 1 {
+			t.Fatalf("expected just one chat events. received %d", checksDone)
+		}
+
+	})
+
+	t.Run(`Given a store, 
+	When RefreshUsers is called with two users and afterwards with just one, 
+	Then the user missing from the second request is marked as offline`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+
+		err := s.RefreshUsers([]domain.User{
+			testUser1,
+			testUser2,
+		})
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chats := s.GetChats()
+		if len(chats) != 2 {
+			t.Fatalf("expected to have 2 chats in the store but there are %d", len(chats))
+		}
+		for _, c := range chats {
+			if c.Offline {
+				t.Fatalf("all chats should be online but %s is offline", c.Id)
+			}
+		}
+
+		// When
+		err = s.RefreshUsers([]domain.User{
+			testUser1,
+		})
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chats = s.GetChats()
+		if len(chats) != 2 {
+			t.Fatalf("expected to have 2 chats in the store but there are %d", len(chats))
+		}
+		for _, c := range chats {
+			if c.Offline == (c.Users[0].Id == testUser2.Id) {
+				continue
+			}
+			t.Fatalf("chat %s should have been offline=%t", c.Id, c.Users[0].Id == testUser2.Id)
+		}
+	})
+}
+
+func testUpsertUser(t *testing.T, newStore Factory) {
+	currentUser := domain.User{
+		Id:      "current_user_id",
+		Name:    "current_user_name",
+		Address: "192.168.0.1",
+		Port:    1000,
+	}
+	testUser1 := domain.User{
+		Id:      "user1",
+		Name:    "user1",
+		Address: "192.168.0.1",
+		Port:    1001,
+	}
+	t.Run(`Given a store with an online user, 
+	When SetUserOffline and afterwards UpsertUser are called for it, 
+	Then the chat goes offline and back online with the updated details`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.UpsertUser(testUser1); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// When
+		if err := s.SetUserOffline(testUser1.Id); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chats := s.GetChats()
+		if len(chats) != 1 {
+			t.Fatalf("expected to have 1 chat in the store but there are %d", len(chats))
+		}
+		for _, c := range chats {
+			if !c.Offline {
+				t.Fatalf("chat %s should have been offline", c.Id)
+			}
+		}
+		updatedUser := testUser1
+		updatedUser.Port = 2001
+		if err := s.UpsertUser(updatedUser); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// Then
+		chats = s.GetChats()
+		if len(chats) != 1 {
+			t.Fatalf("expected to have 1 chat in the store but there are %d", len(chats))
+		}
+		for _, c := range chats {
+			if c.Offline {
+				t.Fatalf("chat %s should have been online", c.Id)
+			}
+			if c.Users[0].Port != updatedUser.Port {
+				t.Fatalf("expected the user port to be updated to %d but it is %d", updatedUser.Port, c.Users[0].Port)
+			}
+		}
+	})
+}
+
+func testAddChatLine(t *testing.T, newStore Factory) {
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1 := domain.User{Id: "user1", Name: "user1"}
+
+	t.Run(`Given a chat with a message of a user,
+	When the user sends the message again and the current user writes a message with the same id,
+	Then the message sent again is ignored without an error and the one of the current user is refused`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.UpsertUser(testUser1); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chat, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		m := domain.Message{Id: "m1", ChatId: chat.Id, UserId: testUser1.Id, Text: "hello", At: time.Now()}
+		if err := s.AddChatLine(m); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// When
+		againErr := s.AddChatLine(m)
+		m.UserId, m.Text = currentUser.Id, "hijacked"
+		duplicateErr := s.AddChatLine(m)
+
+		// Then
+		if againErr != nil {
+			t.Fatalf("expected to receive no error but received %s", againErr)
+		}
+		if !errors.Is(duplicateErr, data.DuplicateMessageErr) {
+			t.Fatalf("expected %s but received %v", data.DuplicateMessageErr, duplicateErr)
+		}
+		chat, _ = s.GetChat(chat.Id)
+		if len(chat.Content) != 1 || chat.Content[0].UserId != testUser1.Id || chat.Content[0].Text != "hello" {
+			t.Fatalf("expected only the first message in the chat but found %+v", chat.Content)
+		}
+	})
+}
+
+func testGroupChat(t *testing.T, newStore Factory) {
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1 := domain.User{Id: "user1", Name: "user1"}
+	testUser2 := domain.User{Id: "user2", Name: "user2"}
+	testUser3 := domain.User{Id: "user3", Name: "user3"}
+
+	t.Run(`Given a store with online users, 
+	When a group chat is created and a new member is invited, 
+	Then the chat contains all the members and one membership message for each change`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.RefreshUsers([]domain.User{testUser1, testUser2}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// When
+		chat, err := s.CreateGroupChat("team", []domain.User{testUser1})
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if err := s.AddGroupMembers(chat.Id, []domain.User{testUser2}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// Then
+		chat, err = s.GetChat(chat.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if !chat.Group || chat.Name != "team" {
+			t.Fatalf("expected a group chat named team but got %+v", chat)
+		}
+		if len(chat.Users) != 2 {
+			t.Fatalf("expected the chat to have 2 other members but it has %d", len(chat.Users))
+		}
+		if len(chat.Content) != 2 {
+			t.Fatalf("expected 2 membership messages but there are %d", len(chat.Content))
+		}
+		for _, m := range chat.Content {
+			if m.Kind != domain.MessageKindMembership {
+				t.Fatalf("expected only membership messages but got %s", m.Kind)
+			}
+		}
+	})
+
+	t.Run(`Given a group chat, 
+	When a membership message is received from a user that is not a member, 
+	Then the message is rejected and the members stay the same`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.RefreshUsers([]domain.User{testUser1, testUser3}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chat, err := s.CreateGroupChat("team", []domain.User{testUser1})
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// When
+		err = s.AddChatLine(domain.Message{
+			ChatId: chat.Id,
+			UserId: testUser3.Id,
+			At:     time.Now(),
+			Kind:   domain.MessageKindMembership,
+			Membership: &domain.Membership{
+				ChatName: "mine now",
+				Members:  []domain.User{currentUser, testUser3},
+			},
+		})
+
+		// Then
+		if err == nil {
+			t.Fatalf("expected an error but received nothing")
+		}
+		chat, _ = s.GetChat(chat.Id)
+		if chat.Name != "team" || len(chat.Users) != 1 || chat.Users[0].Id != testUser1.Id {
+			t.Fatalf("expected the group to be unchanged but got %+v", chat)
+		}
+	})
+
+	t.Run(`Given a group chat created by another user, 
+	When the members are changed by a member that is not the creator of the group, 
+	Then the change is rejected and the members stay the same`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.RefreshUsers([]domain.User{testUser1, testUser2, testUser3}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		created := domain.Message{
+			ChatId: "group",
+			UserId: testUser1.Id,
+			At:     time.Now(),
+			Kind:   domain.MessageKindMembership,
+			Membership: &domain.Membership{
+				ChatName: "team",
+				Members:  []domain.User{testUser1, currentUser, testUser2},
+			},
+		}
+		if err := s.AddChatLine(created); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// When
+		err := s.AddChatLine(domain.Message{
+			ChatId: "group",
+			UserId: testUser2.Id,
+			At:     time.Now(),
+			Kind:   domain.MessageKindMembership,
+			Membership: &domain.Membership{
+				ChatName: "mine now",
+				Members:  []domain.User{currentUser, testUser2},
+			},
+		})
+		inviteErr := s.AddGroupMembers("group", []domain.User{testUser3})
+
+		// Then
+		if !errors.Is(err, data.NotGroupCreatorErr) || !errors.Is(inviteErr, data.NotGroupCreatorErr) {
+			t.Fatalf("expected %s for both changes but received %v and %v", data.NotGroupCreatorErr, err, inviteErr)
+		}
+		chat, _ := s.GetChat("group")
+		if chat.Name != "team" || chat.CreatorId != testUser1.Id || len(chat.Users) != 2 {
+			t.Fatalf("expected the group to be unchanged but got %+v", chat)
+		}
+	})
+}
+
+func testSetMessageStatus(t *testing.T, newStore Factory) {
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1 := domain.User{Id: "user1", Name: "user1"}
+
+	t.Run(`Given a chat with two messages of the current user, 
+	When the second one is reported as read and afterwards as sent, 
+	Then both messages are read`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.UpsertUser(testUser1); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chat, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		now := time.Now()
+		for i, id := range []string{"m1", "m2"} {
+			if err := s.AddChatLine(domain.Message{Id: id, ChatId: chat.Id, UserId: currentUser.Id, Text: id, At: now.Add(time.Duration(i) * time.Second)}); err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+
+		// When
+		if err := s.SetMessageStatus(chat.Id, "m2", domain.MessageStatusRead); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if err := s.SetMessageStatus(chat.Id, "m2", domain.MessageStatusSent); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// Then
+		chat, _ = s.GetChat(chat.Id)
+		for _, m := range chat.Content {
+			if m.Status != domain.MessageStatusRead {
+				t.Fatalf("expected message %s to be %s but it is %s", m.Id, domain.MessageStatusRead, m.Status)
+			}
+		}
+	})
+}
+
+func testSetFileTransfer(t *testing.T, newStore Factory) {
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1 := domain.User{Id: "user1", Name: "user1"}
+
+	t.Run(`Given a file offered by another user, 
+	When the transfer of the file is updated, 
+	Then the message holds the new details and the other messages are refused`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.UpsertUser(testUser1); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chat, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		offered := domain.FileTransfer{Name: "notes.txt", Size: 10, Checksum: "abc", State: domain.FileStateOffered}
+		if err := s.AddChatLine(domain.Message{Id: "f1", ChatId: chat.Id, UserId: testUser1.Id, At: time.Now(), Kind: domain.MessageKindFile, File: &offered}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if err := s.AddChatLine(domain.Message{Id: "m1", ChatId: chat.Id, UserId: testUser1.Id, Text: "text", At: time.Now()}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// When
+		accepted := offered
+		accepted.State, accepted.Transferred = domain.FileStateAccepted, 5
+		if err := s.SetFileTransfer(chat.Id, "f1", accepted); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		err = s.SetFileTransfer(chat.Id, "m1", accepted)
+
+		// Then
+		if !errors.Is(err, data.NotFileMessageErr) {
+			t.Fatalf("expected %s but received %v", data.NotFileMessageErr, err)
+		}
+		chat, _ = s.GetChat(chat.Id)
+		for _, m := range chat.Content {
+			if m.Id == "f1" && *m.File != accepted {
+				t.Fatalf("expected the file to be %+v but it is %+v", accepted, *m.File)
+			}
+		}
+		if offered.State != domain.FileStateOffered {
+			t.Fatalf("expected the offered file given to the store to be left unchanged")
+		}
+	})
+}
+
+func testPublishChatEvent(t *testing.T, newStore Factory) {
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1 := domain.User{Id: "user1", Name: "user1"}
+	testUser2 := domain.User{Id: "user2", Name: "user2"}
+
+	t.Run(`Given a direct chat with a user, 
+	When the user starts typing and another user pretends to type in the same chat, 
+	Then only the event of the user of the chat is sent to the handlers`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.RefreshUsers([]domain.User{testUser1, testUser2}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chat, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		events := make(chan domain.ChatEvent, 2)
+		s.RegisterChatEventHandler(func(ctx context.Context, e domain.ChatEvent) {
+			events <- e
+		})
+
+		// When
+		typing := domain.ChatEvent{Type: domain.TypingStarted, ChatId: chat.Id, UserId: testUser1.Id}
+		if err := s.PublishChatEvent(typing); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		err = s.PublishChatEvent(domain.ChatEvent{Type: domain.TypingStarted, ChatId: chat.Id, UserId: testUser2.Id})
+
+		// Then
+		if !errors.Is(err, data.UserNotInChatErr) {
+			t.Fatalf("expected %s but received %v", data.UserNotInChatErr, err)
+		}
+		select {
+		case e := <-events:
+			if e != typing {
+				t.Fatalf("expected to receive %+v but received %+v", typing, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the chat event to be sent to the handler")
+		}
+		select {
+		case e := <-events:
+			t.Fatalf("expected no other chat event but received %+v", e)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func testEditMessage(t *testing.T, newStore Factory) {
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1 := domain.User{Id: "user1", Name: "user1"}
+
+	prepare := func(t *testing.T, ctx context.Context) (data.Store, *domain.Chat, chan domain.Message) {
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		revisions := make(chan domain.Message, 2)
+		s.RegisterMessageHandler(func(ctx context.Context, m domain.Message) {
+			if m.Kind.IsRevision() {
+				revisions <- m
+			}
+		})
+		if err := s.UpsertUser(testUser1); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chat, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		now := time.Now()
+		if err := s.AddChatLine(domain.Message{Id: "m1", ChatId: chat.Id, UserId: currentUser.Id, Text: "my secret", At: now}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if err := s.AddChatLine(domain.Message{Id: "m2", ChatId: chat.Id, UserId: testUser1.Id, Text: "tpyo", At: now.Add(time.Second)}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		return s, chat, revisions
+	}
+	messageById := func(t *testing.T, s data.Store, chatId, id string) domain.Message {
+		chat, err := s.GetChat(chatId)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		for _, m := range chat.Content {
+			if m.Id == id {
+				return m
+			}
+		}
+		t.Fatalf("message %s not found", id)
+		return domain.Message{}
+	}
+
+	t.Run(`Given a chat with a message of each user, 
+	When each user edits its own message and the current user tries to edit the other one, 
+	Then only the edits of the authors are applied and the revisions are sent to the handlers`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s, chat, revisions := prepare(t, ctx)
+
+		// When
+		if err := s.EditMessage(chat.Id, "m1", "my public"); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if err := s.AddChatLine(domain.Message{Id: "m2", ChatId: chat.Id, UserId: testUser1.Id, Text: "typo", Kind: domain.MessageKindEdit}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		err := s.EditMessage(chat.Id, "m2", "hijacked")
+
+		// Then
+		if !errors.Is(err, data.NotMessageAuthorErr) {
+			t.Fatalf("expected %s but received %v", data.NotMessageAuthorErr, err)
+		}
+		for id, text := range map[string]string{"m1": "my public", "m2": "typo"} {
+			m := messageById(t, s, chat.Id, id)
+			if m.Text != text || !m.Edited {
+				t.Fatalf("expected message %s to be edited to %q but it is %+v", id, text, m)
+			}
+		}
+		if len(messageById(t, s, chat.Id, "m1").UserName) == 0 {
+			t.Fatalf("expected the edited message to keep the name of its author")
+		}
+		chat, _ = s.GetChat(chat.Id)
+		if len(chat.Content) != 2 {
+			t.Fatalf("expected the edits to not be added to the chat but it has %d messages", len(chat.Content))
+		}
+		for i := 0; i < 2; i++ {
+			select {
+			case m := <-revisions:
+				if m.Kind != domain.MessageKindEdit {
+					t.Fatalf("expected the handler to receive an edit but received %+v", m)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("expected the edits to be sent to the handler")
+			}
+		}
+	})
+
+	t.Run(`Given a chat with a message of the current user, 
+	When the message is deleted, 
+	Then its text is removed and it cannot be edited anymore`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s, chat, _ := prepare(t, ctx)
+
+		// When
+		if err := s.DeleteMessage(chat.Id, "m1"); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		err := s.EditMessage(chat.Id, "m1", "my secret again")
+
+		// Then
+		if !errors.Is(err, data.NotEditableMessageErr) {
+			t.Fatalf("expected %s but received %v", data.NotEditableMessageErr, err)
+		}
+		m := messageById(t, s, chat.Id, "m1")
+		if !m.Deleted || len(m.Text) > 0 {
+			t.Fatalf("expected the message to be deleted without text but it is %+v", m)
+		}
+	})
+}
+
+func testReact(t *testing.T, newStore Factory) {
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1 := domain.User{Id: "user1", Name: "user1"}
+	testUser2 := domain.User{Id: "user2", Name: "user2"}
+
+	t.Run(`Given a group chat with a message, 
+	When the users react to it, one of them changes its reaction and another one removes it, 
+	Then the reactions are aggregated per user and counted per emoji`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		chat, err := s.CreateGroupChat("friends", []domain.User{testUser1, testUser2})
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if err := s.AddChatLine(domain.Message{Id: "m1", ChatId: chat.Id, UserId: testUser1.Id, Text: "news", At: time.Now()}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		react := func(userId, emoji string) {
+			err := s.AddChatLine(domain.Message{Id: "m1", ChatId: chat.Id, UserId: userId, Text: emoji, Kind: domain.MessageKindReaction})
+			if err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+
+		// When
+		if err := s.React(chat.Id, "m1", "❤️"); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		react(testUser1.Id, "🎉")
+		react(testUser2.Id, "🎉")
+		react(testUser1.Id, "👍")
+		if err := s.React(chat.Id, "m1", "👍"); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		react(testUser2.Id, "")
+		err = s.React(chat.Id, "unknown", "👍")
+
+		// Then
+		if !errors.Is(err, data.MessageNotFoundErr) {
+			t.Fatalf("expected %s but received %v", data.MessageNotFoundErr, err)
+		}
+		chat, _ = s.GetChat(chat.Id)
+		if len(chat.Content) != 2 {
+			t.Fatalf("expected the reactions to not be added to the chat but it has %d messages", len(chat.Content))
+		}
+		var m domain.Message
+		for _, cm := range chat.Content {
+			if cm.Id == "m1" {
+				m = cm
+			}
+		}
+		expected := []domain.Reaction{{UserId: currentUser.Id, Emoji: "👍"}, {UserId: testUser1.Id, Emoji: "👍"}}
+		if len(m.Reactions) != len(expected) || m.Reactions[0] != expected[0] || m.Reactions[1] != expected[1] {
+			t.Fatalf("expected the reactions %+v but found %+v", expected, m.Reactions)
+		}
+		counts := m.ReactionCounts()
+		if len(counts) != 1 || counts[0] != (domain.ReactionCount{Emoji: "👍", Count: 2}) {
+			t.Fatalf("expected 👍2 but counted %+v", counts)
+		}
+	})
+}
+
+func testGetThread(t *testing.T, newStore Factory) {
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1 := domain.User{Id: "user1", Name: "user1"}
+
+	t.Run(`Given a chat with a question, its replies, a reply to a reply and an unrelated message, 
+	When the thread of the question is fetched, 
+	Then the question and all the replies are returned in the order of the chat`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.UpsertUser(testUser1); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chat, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		now := time.Now()
+		for i, m := range []domain.Message{
+			{Id: "q", UserId: currentUser.Id, Text: "what time?"},
+			{Id: "other", UserId: testUser1.Id, Text: "unrelated"},
+			{Id: "a2", UserId: currentUser.Id, Text: "or 6?", ParentId: "a1"},
+			{Id: "a1", UserId: testUser1.Id, Text: "5", ParentId: "q"},
+			{Id: "a3", UserId: testUser1.Id, Text: "5!", ParentId: "q"},
+		} {
+			// a1 is received late, but it was written before a2
+			at := now.Add(time.Duration(i) * time.Second)
+			if m.Id == "a1" {
+				at = now.Add(time.Duration(i-2) * time.Second)
+			}
+			m.ChatId, m.At = chat.Id, at
+			if err := s.AddChatLine(m); err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+
+		// When
+		thread, err := s.GetThread(chat.Id, "q")
+
+		// Then
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		var ids []string
+		for _, m := range thread {
+			ids = append(ids, m.Id)
+		}
+		if strings.Join(ids, ",") != "q,a1,a2,a3" {
+			t.Fatalf("expected the thread q,a1,a2,a3 but received %s", strings.Join(ids, ","))
+		}
+		m, err := s.GetMessage(chat.Id, "a2")
+		if err != nil || m.ParentId != "a1" {
+			t.Fatalf("expected to find a2 replying to a1 but received %+v, %v", m, err)
+		}
+		if _, err := s.GetThread(chat.Id, "unknown"); !errors.Is(err, data.MessageNotFoundErr) {
+			t.Fatalf("expected %s but received %v", data.MessageNotFoundErr, err)
+		}
+	})
+}
+
+func testHistory(t *testing.T, newStore Factory) {
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1 := domain.User{Id: "user1", Name: "user1"}
+
+	ids := func(messages []domain.Message) string {
+		res := make([]string, len(messages))
+		for i, m := range messages {
+			res[i] = m.Id
+		}
+		return strings.Join(res, ",")
+	}
+
+	t.Run(`Given a chat with 10 messages,
+	When its history is paged backwards from the latest messages and forwards from a time,
+	Then each page holds the requested messages in the order of the chat`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.UpsertUser(testUser1); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chat, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		now := time.Now()
+		// added in reverse order, so the pages do not depend on the order in which the messages were received
+		for i := 9; i >= 0; i-- {
+			m := domain.Message{Id: fmt.Sprintf("m%d", i), ChatId: chat.Id, UserId: testUser1.Id, Text: "hi", At: now.Add(time.Duration(i) * time.Second)}
+			if err := s.AddChatLine(m); err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+
+		// When
+		latest, latestErr := s.LatestMessages(chat.Id, 3)
+		before, beforeErr := s.MessagesBefore(chat.Id, "m7", 3)
+		first, firstErr := s.MessagesBefore(chat.Id, "m1", 3)
+		after, afterErr := s.MessagesAfter(chat.Id, now.Add(7*time.Second), 5)
+		all, allErr := s.MessagesAfter(chat.Id, now.Add(-time.Hour), 2)
+
+		// Then
+		for _, err := range []error{latestErr, beforeErr, firstErr, afterErr, allErr} {
+			if err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+		for expected, page := range map[string][]domain.Message{
+			"m7,m8,m9": latest,
+			"m4,m5,m6": before,
+			"m0":       first,
+			"m8,m9":    after,
+			"m0,m1":    all,
+		} {
+			if ids(page) != expected {
+				t.Fatalf("expected the page %s but received %s", expected, ids(page))
+			}
+		}
+		if _, err := s.MessagesBefore(chat.Id, "unknown", 3); !errors.Is(err, data.MessageNotFoundErr) {
+			t.Fatalf("expected %s but received %v", data.MessageNotFoundErr, err)
+		}
+		if _, err := s.LatestMessages("unknown", 3); !errors.Is(err, data.ChatNotFoundErr) {
+			t.Fatalf("expected %s but received %v", data.ChatNotFoundErr, err)
+		}
+		if _, err := s.LatestMessages(chat.Id, 0); !errors.Is(err, data.InvalidLimitErr) {
+			t.Fatalf("expected %s but received %v", data.InvalidLimitErr, err)
+		}
+	})
+
+	t.Run(`Given a chat with messages and a copy of it taken earlier,
+	When newer and older messages arrive,
+	Then the chat holds all of them in order, each one can be found by its id and the earlier copy is not changed`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.UpsertUser(testUser1); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chat, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		now := time.Now()
+		add := func(i int) {
+			m := domain.Message{Id: fmt.Sprintf("m%d", i), ChatId: chat.Id, UserId: testUser1.Id, Text: "hi", At: now.Add(time.Duration(i) * time.Second)}
+			if err := s.AddChatLine(m); err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+		for _, i := range []int{1, 3, 5} {
+			add(i)
+		}
+		earlier, err := s.GetChat(chat.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// When
+		for _, i := range []int{6, 4, 0, 7, 2} {
+			add(i)
+		}
+
+		// Then
+		current, err := s.GetChat(chat.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if ids(current.Content) != "m0,m1,m2,m3,m4,m5,m6,m7" {
+			t.Fatalf("expected the messages in order but received %s", ids(current.Content))
+		}
+		if ids(earlier.Content) != "m1,m3,m5" {
+			t.Fatalf("expected the earlier copy to not change but received %s", ids(earlier.Content))
+		}
+		for i := 0; i < 8; i++ {
+			m, err := s.GetMessage(chat.Id, fmt.Sprintf("m%d", i))
+			if err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+			if !m.At.Equal(now.Add(time.Duration(i) * time.Second)) {
+				t.Fatalf("expected message m%d but received %+v", i, m)
+			}
+		}
+	})
+
+	t.Run(`Given a chat with messages from both users and a copy of it that is read meanwhile,
+	When the messages are delivered, edited and read,
+	Then the copy is not changed, which is checked for races when running with -race`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.UpsertUser(testUser1); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chat, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		now := time.Now()
+		for i, userId := range []string{testUser1.Id, currentUser.Id, testUser1.Id} {
+			m := domain.Message{Id: fmt.Sprintf("m%d", i), ChatId: chat.Id, UserId: userId, Text: "hi", At: now.Add(time.Duration(i) * time.Second)}
+			if err := s.AddChatLine(m); err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+		earlier, err := s.GetChat(chat.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		statuses := func(messages []domain.Message) string {
+			res := make([]string, len(messages))
+			for i, m := range messages {
+				res[i] = fmt.Sprintf("%s:%s", m.Text, m.Status)
+			}
+			return strings.Join(res, ",")
+		}
+		expected := statuses(earlier.Content)
+		done := make(chan struct{})
+		read := make(chan string)
+		go func() {
+			for {
+				last := statuses(earlier.Content)
+				select {
+				case <-done:
+					read <- last
+					return
+				default:
+				}
+			}
+		}()
+
+		// When
+		setErr := s.SetMessageStatus(chat.Id, "m1", domain.MessageStatusDelivered)
+		editErr := s.EditMessage(chat.Id, "m1", "hello")
+		readErr := s.MarkChatRead(chat.Id)
+		close(done)
+
+		// Then
+		for _, err := range []error{setErr, editErr, readErr} {
+			if err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+		if last := <-read; last != expected || statuses(earlier.Content) != expected {
+			t.Fatalf("expected the earlier copy to stay %s but it became %s", expected, last)
+		}
+		current, err := s.GetChat(chat.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if found, changed := statuses(current.Content), "hi:read,hello:delivered,hi:read"; found != changed {
+			t.Fatalf("expected the chat to be %s but it is %s", changed, found)
+		}
+	})
+}
+
+func testSubscriptions(t *testing.T, newStore Factory) {
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1 := domain.User{Id: "user1", Name: "user1"}
+	const (
+		producers   = 4
+		perProducer = 250
+	)
+
+	t.Run(`Given a store with a slow handler and a fast one, 
+	When several goroutines add a burst of messages, 
+	Then both handlers receive every message exactly once, in the order in which each goroutine added them`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.UpsertUser(testUser1); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chat, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		slow := make(chan domain.Message)
+		fast := make(chan domain.Message)
+		s.RegisterMessageHandler(func(ctx context.Context, m domain.Message) {
+			time.Sleep(50 * time.Microsecond)
+			slow <- m
+		})
+		s.RegisterMessageHandler(func(ctx context.Context, m domain.Message) {
+			fast <- m
+		})
+
+		// When
+		now := time.Now()
+		errs := make(chan error, producers)
+		for p := 0; p < producers; p++ {
+			go func(p int) {
+				for i := 0; i < perProducer; i++ {
+					if err := s.AddChatLine(domain.Message{
+						Id:     fmt.Sprintf("m-%d-%03d", p, i),
+						ChatId: chat.Id,
+						UserId: testUser1.Id,
+						Text:   fmt.Sprintf("%d", i),
+						At:     now.Add(time.Duration(i) * time.Millisecond),
+					}); err != nil {
+						errs <- err
+						return
+					}
+				}
+				errs <- nil
+			}(p)
+		}
+		for p := 0; p < producers; p++ {
+			if err := <-errs; err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+
+		// Then
+		for name, received := range map[string]chan domain.Message{"slow": slow, "fast": fast} {
+			next := make([]int, producers)
+			for n := 0; n < producers*perProducer; n++ {
+				select {
+				case m := <-received:
+					var p, i int
+					if _, err := fmt.Sscanf(m.Id, "m-%d-%d", &p, &i); err != nil {
+						t.Fatalf("unexpected message %+v received by the %s handler", m, name)
+					}
+					if i != next[p] {
+						t.Fatalf("expected the %s handler to receive message %d of goroutine %d but received %d", name, next[p], p, i)
+					}
+					next[p]++
+				case <-time.After(5 * time.Second):
+					t.Fatalf("expected the %s handler to receive %d messages but received %d", name, producers*perProducer, n)
+				}
+			}
+			select {
+			case m := <-received:
+				t.Fatalf("expected no other message for the %s handler but received %+v", name, m)
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	})
+
+	t.Run(`Given a store with a handler that unsubscribed, 
+	When a message is added, 
+	Then only the handlers still subscribed receive it`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.UpsertUser(testUser1); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chat, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		gone := make(chan domain.Message, 1)
+		kept := make(chan domain.Message, 1)
+		unsubscribe := s.RegisterMessageHandler(func(ctx context.Context, m domain.Message) {
+			gone <- m
+		})
+		s.RegisterMessageHandler(func(ctx context.Context, m domain.Message) {
+			kept <- m
+		})
+		unsubscribe()
+		// calling it again has no effect
+		unsubscribe()
+
+		// When
+		if err := s.AddChatLine(domain.Message{Id: "m1", ChatId: chat.Id, UserId: testUser1.Id, Text: "hi", At: time.Now()}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// Then
+		select {
+		case m := <-kept:
+			if m.Id != "m1" {
+				t.Fatalf("expected to receive message m1 but received %+v", m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the message to be sent to the subscribed handler")
+		}
+		select {
+		case m := <-gone:
+			t.Fatalf("expected no message for the unsubscribed handler but received %+v", m)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func testSearch(t *testing.T, newStore Factory) {
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	alice := domain.User{Id: "user1", Name: "alice"}
+	bob := domain.User{Id: "user2", Name: "bob"}
+	now := time.Now()
+
+	ids := func(messages []domain.Message) string {
+		res := make([]string, len(messages))
+		for i, m := range messages {
+			res[i] = m.Id
+		}
+		return strings.Join(res, ",")
+	}
+	prepare := func(t *testing.T, ctx context.Context) (data.Store, string) {
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.RefreshUsers([]domain.User{alice, bob}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		aliceChat, err := s.DirectChat(alice.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		bobChat, err := s.DirectChat(bob.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		for _, m := range []domain.Message{
+			{Id: "m1", ChatId: aliceChat.Id, UserId: alice.Id, Text: "run kubectl apply -f deploy.yaml", At: now.Add(-72 * time.Hour)},
+			{Id: "m2", ChatId: aliceChat.Id, UserId: currentUser.Id, Text: "kubectl get pods", At: now.Add(-48 * time.Hour)},
+			{Id: "m3", ChatId: aliceChat.Id, UserId: alice.Id, Text: "Apply the patch, then KUBECTL rollout", At: now.Add(-24 * time.Hour)},
+			{Id: "m4", ChatId: bobChat.Id, UserId: bob.Id, Text: "kubectl apply worked for me", At: now.Add(-time.Hour)},
+			{Id: "m5", ChatId: bobChat.Id, UserId: bob.Id, Text: "lunch?", At: now},
+		} {
+			if err := s.AddChatLine(m); err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+		return s, aliceChat.Id
+	}
+
+	t.Run(`Given two chats with messages,
+	When searching by terms, phrases, sender and dates,
+	Then the matching messages from both chats are returned, the latest first`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s, _ := prepare(t, ctx)
+
+		for _, tc := range []struct {
+			query    data.SearchQuery
+			limit    int
+			expected string
+		}{
+			{query: data.SearchQuery{Terms: []string{"kubectl"}}, limit: 10, expected: "m4,m3,m2,m1"},
+			{query: data.SearchQuery{Terms: []string{"kubectl"}}, limit: 2, expected: "m4,m3"},
+			{query: data.SearchQuery{Phrases: []string{"kubectl apply"}}, limit: 10, expected: "m4,m1"},
+			{query: data.SearchQuery{Terms: []string{"APPLY"}, Sender: "Alice"}, limit: 10, expected: "m3,m1"},
+			{query: data.SearchQuery{Sender: bob.Id}, limit: 10, expected: "m5,m4"},
+			{query: data.SearchQuery{Terms: []string{"kubectl"}, Since: now.Add(-50 * time.Hour), Until: now.Add(-2 * time.Hour)}, limit: 10, expected: "m3,m2"},
+			{query: data.SearchQuery{Until: now.Add(-60 * time.Hour)}, limit: 10, expected: "m1"},
+			{query: data.SearchQuery{Terms: []string{"deploy.yaml"}}, limit: 10, expected: "m1"},
+			{query: data.SearchQuery{Terms: []string{"kubectl", "lunch"}}, limit: 10, expected: ""},
+		} {
+			// When
+			found, err := s.Search(tc.query, tc.limit)
+
+			// Then
+			if err != nil {
+				t.Fatalf("expected to receive no error for %+v but received %s", tc.query, err)
+			}
+			if ids(found) != tc.expected {
+				t.Fatalf("expected to find %q for %+v but found %q", tc.expected, tc.query, ids(found))
+			}
+		}
+		if _, err := s.Search(data.SearchQuery{}, 10); !errors.Is(err, data.EmptySearchQueryErr) {
+			t.Fatalf("expected %s but received %v", data.EmptySearchQueryErr, err)
+		}
+		if _, err := s.Search(data.SearchQuery{Terms: []string{"?!"}}, 10); !errors.Is(err, data.EmptySearchQueryErr) {
+			t.Fatalf("expected %s but received %v", data.EmptySearchQueryErr, err)
+		}
+		if _, err := s.Search(data.SearchQuery{Terms: []string{"kubectl"}}, 0); !errors.Is(err, data.InvalidLimitErr) {
+			t.Fatalf("expected %s but received %v", data.InvalidLimitErr, err)
+		}
+	})
+
+	t.Run(`Given a chat with a message of the current user,
+	When the message is edited and then deleted,
+	Then it's found by its latest text and not found anymore once deleted`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s, chatId := prepare(t, ctx)
+
+		// When
+		editErr := s.EditMessage(chatId, "m2", "helm install")
+		byOldText, oldErr := s.Search(data.SearchQuery{Terms: []string{"pods"}}, 10)
+		byNewText, newErr := s.Search(data.SearchQuery{Terms: []string{"helm"}}, 10)
+		deleteErr := s.DeleteMessage(chatId, "m2")
+		afterDelete, afterDeleteErr := s.Search(data.SearchQuery{Terms: []string{"helm"}}, 10)
+
+		// Then
+		for _, err := range []error{editErr, oldErr, newErr, deleteErr, afterDeleteErr} {
+			if err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+		if ids(byOldText) != "" || ids(byNewText) != "m2" || ids(afterDelete) != "" {
+			t.Fatalf("expected to find the message only by its latest text but found %q by the old one, %q by the new one and %q after deleted",
+				ids(byOldText), ids(byNewText), ids(afterDelete))
+		}
+	})
+}
+
+func testUnread(t *testing.T, newStore Factory) {
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1 := domain.User{Id: "user1", Name: "user1"}
+	now := time.Now()
+
+	getChat := func(t *testing.T, s data.Store, chatId string) *domain.Chat {
+		chat, err := s.GetChat(chatId)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		return chat
+	}
+
+	t.Run(`Given a chat with messages from both users,
+	When the chat is read and afterwards more messages arrive, one of them delayed,
+	Then only the messages of the other user placed after the last read one are unread`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.UpsertUser(testUser1); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		chat, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		for _, m := range []domain.Message{
+			{Id: "m1", ChatId: chat.Id, UserId: testUser1.Id, Text: "hi", At: now},
+			{Id: "m2", ChatId: chat.Id, UserId: currentUser.Id, Text: "hello", At: now.Add(time.Second)},
+			{Id: "m3", ChatId: chat.Id, UserId: testUser1.Id, Text: "how are you?", At: now.Add(2 * time.Second)},
+		} {
+			if err := s.AddChatLine(m); err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+		if c := getChat(t, s, chat.Id); c.Unread != 2 || len(c.LastRead) != 0 {
+			t.Fatalf("expected 2 unread messages and no last read one but found %d and %q", c.Unread, c.LastRead)
+		}
+
+		// When
+		if err := s.MarkChatRead(chat.Id); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		read := getChat(t, s, chat.Id)
+		for _, m := range []domain.Message{
+			{Id: "m4", ChatId: chat.Id, UserId: testUser1.Id, Text: "sent before m3", At: now.Add(time.Second)},
+			{Id: "m5", ChatId: chat.Id, UserId: currentUser.Id, Text: "fine", At: now.Add(3 * time.Second)},
+			{Id: "m6", ChatId: chat.Id, UserId: testUser1.Id, Text: "great", At: now.Add(4 * time.Second)},
+			{Id: "m7", ChatId: chat.Id, UserId: testUser1.Id, Text: "lunch?", At: now.Add(5 * time.Second)},
+		} {
+			if err := s.AddChatLine(m); err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+		// the chat details are refreshed often, which should not change the last read message
+		if err := s.UpsertUser(testUser1); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// Then
+		if read.Unread != 0 || read.LastRead != "m3" {
+			t.Fatalf("expected no unread messages and m3 as the last read one but found %d and %q", read.Unread, read.LastRead)
+		}
+		if c := getChat(t, s, chat.Id); c.Unread != 2 || c.LastRead != "m3" {
+			t.Fatalf("expected 2 unread messages after m3 but found %d after %q", c.Unread, c.LastRead)
+		}
+		if err := s.MarkChatRead(chat.Id); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if c := getChat(t, s, chat.Id); c.Unread != 0 || c.LastRead != "m7" {
+			t.Fatalf("expected no unread messages and m7 as the last read one but found %d and %q", c.Unread, c.LastRead)
+		}
+	})
+}
+
+func testImportChats(t *testing.T, newStore Factory) {
+	currentUser := domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1 := domain.User{Id: "user1", Name: "user1"}
+	testUser2 := domain.User{Id: "user2", Name: "user2"}
+	now := time.Now()
+
+	t.Run(`Given a store with a direct chat that has some of the imported messages,
+	When the direct chat and a missing group chat are imported twice,
+	Then only the missing messages are added, once, without being sent to the message handlers`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.UpsertUser(testUser1); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		direct, err := s.DirectChat(testUser1.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if err := s.AddChatLine(domain.Message{Id: "d1", ChatId: direct.Id, UserId: testUser1.Id, Text: "hi", At: now}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		lines := make(chan domain.Message, 10)
+		s.RegisterMessageHandler(func(ctx context.Context, m domain.Message) {
+			lines <- m
+		})
+		chats := []domain.Chat{
+			{
+				Id:        direct.Id,
+				OwnerUser: currentUser,
+				Users:     []domain.User{testUser1},
+				Content: []domain.Message{
+					{Id: "d1", UserId: testUser1.Id, UserName: testUser1.Name, Text: "hi", At: now},
+					{Id: "d2", UserId: currentUser.Id, UserName: currentUser.Name, Text: "never sent", At: now.Add(time.Second), Status: domain.MessageStatusPending},
+				},
+			},
+			{
+				Id:        "group",
+				Name:      "team",
+				Group:     true,
+				OwnerUser: testUser2,
+				Users:     []domain.User{currentUser, testUser1},
+				Content: []domain.Message{
+					{Id: "g2", UserId: testUser1.Id, UserName: testUser1.Name, Text: "second", At: now.Add(time.Second)},
+					{Id: "g1", UserId: testUser2.Id, UserName: testUser2.Name, Text: "first", At: now},
+				},
+			},
+		}
+
+		// When
+		added, err := s.ImportChats(chats)
+		addedAgain, againErr := s.ImportChats(chats)
+
+		// Then
+		if err != nil || againErr != nil {
+			t.Fatalf("expected to receive no error but received %v and %v", err, againErr)
+		}
+		if added != 3 || addedAgain != 0 {
+			t.Fatalf("expected 3 messages to be added and none afterwards but %d and %d were", added, addedAgain)
+		}
+		direct, err = s.GetChat(direct.Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if len(direct.Content) != 2 || direct.Content[1].Status != domain.MessageStatusNone {
+			t.Fatalf("expected d2 to be added without being tracked as pending but found %+v", direct.Content)
+		}
+		group, err := s.GetChat("group")
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if !group.Group || group.Name != "team" || len(group.Users) != 2 || group.OwnerUser.Id != currentUser.Id {
+			t.Fatalf("expected the group to be created with the other 2 members but found %+v", group)
+		}
+		if len(group.Content) != 2 || group.Content[0].Id != "g1" || group.Content[1].Id != "g2" {
+			t.Fatalf("expected the messages g1 and g2 in order but found %+v", group.Content)
+		}
+		if group.Unread != 0 || group.LastRead != "g2" {
+			t.Fatalf("expected the imported history to be read but found %d unread messages after %q", group.Unread, group.LastRead)
+		}
+		select {
+		case m := <-lines:
+			t.Fatalf("expected the imported messages to not be sent to the message handlers but received %+v", m)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run(`Given a store with a direct chat with an unread message and a direct chat that was read,
+	When older and newer messages of the other users are imported into both,
+	Then the imported messages are not unread and the read chat stays read`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+		if err := s.RefreshUsers([]domain.User{testUser1, testUser2}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		var chats []domain.Chat
+		for _, u := range []domain.User{testUser1, testUser2} {
+			direct, err := s.DirectChat(u.Id)
+			if err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+			if err := s.AddChatLine(domain.Message{Id: u.Id + "-1", ChatId: direct.Id, UserId: u.Id, Text: "hi", At: now}); err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+			direct.Content = []domain.Message{
+				{Id: u.Id + "-0", UserId: u.Id, UserName: u.Name, Text: "before", At: now.Add(-time.Second)},
+				{Id: u.Id + "-2", UserId: u.Id, UserName: u.Name, Text: "after", At: now.Add(time.Second)},
+			}
+			chats = append(chats, *direct)
+		}
+		if err := s.MarkChatRead(chats[1].Id); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// When
+		added, err := s.ImportChats(chats)
+
+		// Then
+		if err != nil || added != 4 {
+			t.Fatalf("expected 4 messages to be added but %d were, with error %v", added, err)
+		}
+		unread, err := s.GetChat(chats[0].Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if len(unread.Content) != 3 || unread.Unread != 1 {
+			t.Fatalf("expected only the message that was unread to stay unread but found %d unread messages in %+v", unread.Unread, unread.Content)
+		}
+		read, err := s.GetChat(chats[1].Id)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if len(read.Content) != 3 || read.Unread != 0 || read.LastRead != testUser2.Id+"-2" {
+			t.Fatalf("expected the chat to stay read but found %d unread messages after %q", read.Unread, read.LastRead)
+		}
+	})
+
+	t.Run(`Given a store,
+	When a chat of which the current user is not a member is imported,
+	Then an error is returned and the chat is not added`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newStore(t, ctx, currentUser, maxMsgLen)
+
+		// When
+		_, err := s.ImportChats([]domain.Chat{{Id: "group", Group: true, OwnerUser: testUser1, Users: []domain.User{testUser2}}})
+
+		// Then
+		if !errors.Is(err, data.UserNotInChatErr) {
+			t.Fatalf("expected %s but received %v", data.UserNotInChatErr, err)
+		}
+		if _, err := s.GetChat("group"); !errors.Is(err, data.ChatNotFoundErr) {
+			t.Fatalf("expected %s but received %v", data.ChatNotFoundErr, err)
+		}
+	})
+}
@@ -1,11 +1,13 @@
 package directory
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/identity"
 	"io"
 	"log"
 	"net/http"
@@ -19,11 +21,17 @@ const (
 
 	clientsHTTPContext = "clients"
 	clientsHTTPMethod  = http.MethodGet
+
+	watchHTTPContext = "clients/watch"
+	watchHTTPMethod  = http.MethodGet
 )
 
 type Client interface {
 	Ping(ctx context.Context, user domain.User) error
 	Users(ctx context.Context) ([]domain.User, error)
+	// Watch opens a stream with the directory server receiving the presence changes of the users.
+	// The returned channel is closed when the context is done or the stream is interrupted.
+	Watch(ctx context.Context) (<-chan domain.UserEvent, error)
 }
 
 func WithClient(httpClient *http.Client) func(c *client) {
@@ -117,5 +125,71 @@ func (c *client) Users(ctx context.Context) ([]domain.User, error) {
 	if err := json.Unmarshal(b, &res); err != nil {
 		return nil, err
 	}
-	return res.Clients, nil
+	users := make([]domain.User, 0, len(res.Clients))
+	for _, u := range res.Clients {
+		if !verified(u) {
+			continue
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func (c *client) Watch(ctx context.Context) (<-chan domain.UserEvent, error) {
+	request, err := http.NewRequestWithContext(ctx, watchHTTPMethod, strings.Join([]string{c.s, watchHTTPContext}, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.h.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("non 2xx http status: %d", resp.StatusCode)
+	}
+
+	events := make(chan domain.UserEvent)
+	go func() {
+		defer func() {
+			close(events)
+			if err := resp.Body.Close(); err != nil {
+				log.Printf("error trying to close the body of the watch request to the directory server: %s", err)
+			}
+		}()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			var e domain.UserEvent
+			if err := json.Unmarshal(line, &e); err != nil {
+				log.Printf("failed to decode event from the directory server: %s", err)
+				return
+			}
+			if e.User != nil && !verified(*e.User) {
+				continue
+			}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil && ctx.Err() == nil {
+			log.Printf("the watch stream with the directory server was interrupted: %s", err)
+		}
+	}()
+	return events, nil
+}
+
+// verified returns true when the id of the user is the fingerprint of its public key.
+// The other users are ignored since their id would not be stable or could be claimed by a different key.
+func verified(u domain.User) bool {
+	if u.Id == identity.Fingerprint(u.PublicKey) {
+		return true
+	}
+	log.Printf("ignoring user %s from the directory server: the id is not the fingerprint of its public key", u.Id)
+	return false
 }
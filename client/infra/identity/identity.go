@@ -0,0 +1,123 @@
+package identity
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/curve25519"
+	"os"
+	"path/filepath"
+)
+
+// keyFile is the name of the file, inside the profile directory, holding the private key of the identity
+const keyFile = "identity.key"
+
+var InvalidPublicKeyErr = errors.New("invalid public key")
+
+// Identity is the long-term X25519 key pair of the current user.
+// The public half is published through the directory so the other users can authenticate the sessions with us.
+type Identity struct {
+	private []byte
+	public  []byte
+}
+
+// New generates a new random identity.
+func New() (*Identity, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return nil, fmt.Errorf("failed to generate the identity key: %w", err)
+	}
+	return FromPrivateKey(private)
+}
+
+// Load reads the identity stored in the given profile directory.
+// When the profile has no identity yet, a new one is generated and saved there so it is reused on the next start.
+func Load(profileDir string) (*Identity, error) {
+	path := filepath.Join(profileDir, keyFile)
+	private, err := os.ReadFile(path)
+	if err == nil {
+		id, err := FromPrivateKey(private)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the identity from %s: %w", path, err)
+		}
+		return id, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read the identity from %s: %w", path, err)
+	}
+
+	id, err := New()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(profileDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create the profile directory %s: %w", profileDir, err)
+	}
+	// O_EXCL to never overwrite an identity created in the meantime by another client using the same profile
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save the identity to %s: %w", path, err)
+	}
+	_, err = f.Write(id.private)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, fmt.Errorf("failed to save the identity to %s: %w", path, err)
+	}
+	return id, nil
+}
+
+// FromPrivateKey builds the identity from an existing X25519 private key.
+func FromPrivateKey(private []byte) (*Identity, error) {
+	if len(private) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("invalid private key size %d", len(private))
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		private: private,
+		public:  public,
+	}, nil
+}
+
+// PublicKey returns the public half of the identity.
+func (i *Identity) PublicKey() []byte {
+	res := make([]byte, len(i.public))
+	copy(res, i.public)
+	return res
+}
+
+// Fingerprint returns the stable id of the identity, derived from its public key.
+func (i *Identity) Fingerprint() string {
+	return Fingerprint(i.public)
+}
+
+// Fingerprint returns the hex encoded SHA-256 of the given public key.
+// This is used as the id of the users so that it stays the same across restarts and address changes.
+func Fingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:])
+}
+
+// SharedSecret computes the X25519 shared secret between this identity and the given public key.
+func (i *Identity) SharedSecret(publicKey []byte) ([]byte, error) {
+	return SharedSecret(i.private, publicKey)
+}
+
+// SharedSecret computes the X25519 shared secret between the given private and public keys.
+func SharedSecret(private, publicKey []byte) ([]byte, error) {
+	if len(publicKey) != curve25519.PointSize {
+		return nil, InvalidPublicKeyErr
+	}
+	s, err := curve25519.X25519(private, publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", InvalidPublicKeyErr, err)
+	}
+	return s, nil
+}
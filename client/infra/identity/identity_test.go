@@ -0,0 +1,93 @@
+package identity
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	t.Run(`Given an empty profile directory,
+	When the identity is loaded twice,
+	Then the same identity is returned and its key is readable only by the owner`, func(t *testing.T) {
+		// Given
+		dir := filepath.Join(t.TempDir(), "profile")
+
+		// When
+		first, err := Load(dir)
+		if err != nil {
+			t.Fatalf("failed to create the identity: %s", err)
+		}
+		second, err := Load(dir)
+		if err != nil {
+			t.Fatalf("failed to load the identity: %s", err)
+		}
+
+		// Then
+		if !bytes.Equal(first.PublicKey(), second.PublicKey()) {
+			t.Fatalf("expected the same public key after reloading")
+		}
+		if first.Fingerprint() != second.Fingerprint() {
+			t.Fatalf("expected the same fingerprint after reloading but got %s and %s", first.Fingerprint(), second.Fingerprint())
+		}
+		info, err := os.Stat(filepath.Join(dir, keyFile))
+		if err != nil {
+			t.Fatalf("failed to stat the key file: %s", err)
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Fatalf("expected the key file to have 0600 permissions but has %o", perm)
+		}
+	})
+
+	t.Run(`Given a profile with a corrupted key,
+	When the identity is loaded,
+	Then an error is returned and the key is not replaced`, func(t *testing.T) {
+		// Given
+		dir := t.TempDir()
+		path := filepath.Join(dir, keyFile)
+		if err := os.WriteFile(path, []byte("short"), 0600); err != nil {
+			t.Fatalf("failed to write the key: %s", err)
+		}
+
+		// When
+		_, err := Load(dir)
+
+		// Then
+		if err == nil {
+			t.Fatalf("expected an error for the corrupted key")
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read the key: %s", err)
+		}
+		if string(content) != "short" {
+			t.Fatalf("expected the corrupted key to be kept untouched")
+		}
+	})
+
+	t.Run(`Given two different identities,
+	When their fingerprints are computed,
+	Then they differ and match the fingerprint of their public keys`, func(t *testing.T) {
+		// Given
+		alice, err := New()
+		if err != nil {
+			t.Fatalf("failed to create the identity: %s", err)
+		}
+		bob, err := New()
+		if err != nil {
+			t.Fatalf("failed to create the identity: %s", err)
+		}
+
+		// When
+		aliceFp, bobFp := alice.Fingerprint(), bob.Fingerprint()
+
+		// Then
+		if aliceFp == bobFp {
+			t.Fatalf("expected different fingerprints")
+		}
+		if aliceFp != Fingerprint(alice.PublicKey()) {
+			t.Fatalf("expected the fingerprint to be derived from the public key")
+		}
+	})
+}
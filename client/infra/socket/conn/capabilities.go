@@ -0,0 +1,97 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+const (
+	// ProtocolVersion is the version of the peer protocol spoken by this client
+	ProtocolVersion = 2
+	// MinProtocolVersion is the oldest version of the peer protocol that this client can still talk to
+	MinProtocolVersion = 2
+)
+
+var (
+	IncompatiblePeerErr  = errors.New("incompatible peer")
+	UnsupportedByPeerErr = errors.New("not supported by the peer")
+)
+
+// Capability is an optional feature of the peer protocol. The features are used on a connection only when
+// both parties advertised them in their Hello.
+type Capability string
+
+const (
+	CapabilityEncryption Capability = "encryption"
+	CapabilityReceipts   Capability = "receipts"
+	CapabilityGroups     Capability = "groups"
+	CapabilityFiles      Capability = "files"
+	CapabilityHeartbeats Capability = "heartbeats"
+	CapabilityTyping     Capability = "typing"
+	CapabilityEdits      Capability = "edits"
+	CapabilityReactions  Capability = "reactions"
+)
+
+var (
+	// supportedCapabilities are the capabilities advertised by this client
+	supportedCapabilities = []Capability{CapabilityEncryption, CapabilityReceipts, CapabilityGroups, CapabilityFiles, CapabilityHeartbeats, CapabilityTyping, CapabilityEdits, CapabilityReactions}
+	// requiredCapabilities are the capabilities without which this client refuses to talk to a peer
+	requiredCapabilities = []Capability{CapabilityEncryption}
+)
+
+// Build is the build of this client as advertised to the peers.
+var Build = func() string {
+	if bi, ok := debug.ReadBuildInfo(); ok && len(bi.Main.Version) > 0 {
+		return bi.Main.Version
+	}
+	return "unknown"
+}()
+
+// negotiate checks the versions and the limits advertised in the Hello of the peer against ours and returns a Session,
+// without keys yet, holding the protocol version, the capabilities and the limits that both parties support.
+func negotiate(peer *Hello, limits Limits) (*Session, error) {
+	if peer.Version < MinProtocolVersion || peer.MinVersion > ProtocolVersion {
+		return nil, fmt.Errorf("%w: the peer speaks the protocol v%d-v%d (build %s) and we speak v%d-v%d",
+			IncompatiblePeerErr, peer.MinVersion, peer.Version, peer.Build, MinProtocolVersion, ProtocolVersion)
+	}
+	version := ProtocolVersion
+	if peer.Version < version {
+		version = peer.Version
+	}
+
+	peerCapabilities := map[Capability]bool{}
+	for _, c := range peer.Capabilities {
+		peerCapabilities[c] = true
+	}
+	for _, c := range requiredCapabilities {
+		if !peerCapabilities[c] {
+			return nil, fmt.Errorf("%w: the peer (build %s) does not support %s", IncompatiblePeerErr, peer.Build, c)
+		}
+	}
+	var common []Capability
+	for _, c := range supportedCapabilities {
+		if peerCapabilities[c] {
+			common = append(common, c)
+		}
+	}
+	if err := peer.Limits.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s", IncompatiblePeerErr, err)
+	}
+	return &Session{
+		Version:      version,
+		Capabilities: common,
+		Limits:       limits.min(peer.Limits),
+		PeerBuild:    peer.Build,
+	}, nil
+}
+
+// Supports returns true when the given capability was negotiated for the session.
+func (s *Session) Supports(c Capability) bool {
+	for _, sc := range s.Capabilities {
+		if sc == c {
+			return true
+		}
+	}
+	return false
+}
@@ -1,210 +1,691 @@
 package conn
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
 	"errors"
 	"fmt"
 	"github.com/yottta/chat/client/domain"
 	"io"
 	"log"
-	"math"
+	"math/rand"
 	"net"
-	"strconv"
 	"sync"
 	"time"
 )
 
+const (
+	dialTimeout  = 4 * time.Second
+	writeTimeout = 5 * time.Second
+
+	reconnectMinBackoff = 500 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+	// duplicateWindow is the time in which a new transport is considered to be dialed at the same time with the current one
+	duplicateWindow = 5 * time.Second
+)
+
+var (
+	DisconnectedErr       = errors.New("disconnected from the user")
+	ClosedErr             = errors.New("connection closed")
+	DuplicateTransportErr = errors.New("duplicate transport")
+)
+
+const (
+	kindReceipt = "receipt"
+	kindPing    = "ping"
+	kindPong    = "pong"
+)
+
 type Conn interface {
 	Start(ctx context.Context)
-	SendMessage(m domain.Message)
+	Adopt(t Transport) error
+	SendMessage(m domain.Message) error
+	SendReceipt(r Receipt) error
+	SendFileEvent(e FileEvent) error
+	SendChatEvent(e domain.ChatEvent) error
+	Supports(c Capability) bool
+	Latency() (time.Duration, bool)
 	Close() error
 }
 
-// connection is holding the actual socket conn to a specific address of a specific user bound to a specific chat.
-// It's handling the communication on both directions.
+// Receipt acknowledges the status of a message on the side of the user that received it.
+// Only domain.MessageStatusDelivered and domain.MessageStatusRead are sent over the network.
+type Receipt struct {
+	ChatId    string
+	MessageId string
+	UserId    string
+	Status    domain.MessageStatus
+}
+
+// FileEventKind tells what a FileEvent is asking for or carrying.
+type FileEventKind string
+
+const (
+	// FileRequested is sent by the receiver of a file to ask for its content starting with Offset
+	FileRequested FileEventKind = "file_request"
+	// FileDeclined is sent by the receiver of a file that does not want it
+	FileDeclined FileEventKind = "file_decline"
+	// FileChunk is sent by the sender of a file and carries the Data of the file starting with Offset
+	FileChunk FileEventKind = "file_chunk"
+	// FileCompleted is sent by the receiver of a file once it has the whole content with the expected checksum
+	FileCompleted FileEventKind = "file_complete"
+)
+
+// FileEvent drives the transfer of the file offered by a domain.MessageKindFile message, identified by ChatId and MessageId.
+// Checksum is the SHA-256 of Data and is set only for the FileChunk events.
+type FileEvent struct {
+	Kind      FileEventKind
+	ChatId    string
+	MessageId string
+	UserId    string
+	Offset    int64
+	Data      []byte
+	Checksum  []byte
+}
+
+// Callbacks groups the functions through which a connection is reporting what happens on it:
+// * OnClose: receives the connection together with its user and the reason whenever the connection with the other party is closed for good. This is really useful for cleaning up the connection from a pool or something similar.
+// * OnReconnecting: receives the connection together with its user and the reason whenever the socket connection was lost and the connection started to reconnect.
+// * OnReconnected: receives the connection together with its user once it has a socket connection with the other party again.
+// * KeepAlive: tells if the connection should still try to reconnect with the given user, usually while the user is listed by the directory.
+// * OnMessage: handles the messages received from the other party. Once it returns no error, the message is acknowledged to the other party as delivered.
+// * OnReceipt: handles the receipts sent by the other party for our messages.
+// * OnFileEvent: handles the events of the file transfers with the other party. It's called in order, from the goroutine reading the connection.
+// * OnChatEvent: handles the chat events sent by the other party, like typing.
+type Callbacks struct {
+	OnClose        func(conn Conn, u domain.User, err error)
+	OnReconnecting func(conn Conn, u domain.User, err error)
+	OnReconnected  func(conn Conn, u domain.User)
+	KeepAlive      func(u domain.User) bool
+	OnMessage      func(m domain.Message) error
+	OnReceipt      func(r Receipt)
+	OnFileEvent    func(e FileEvent)
+	OnChatEvent    func(e domain.ChatEvent)
+}
+
+// Transport is a socket connection with the other party, authenticated by the handshake that produced its Session.
+// Initiated is true when we opened the socket connection.
+type Transport struct {
+	Conn      net.Conn
+	Session   *Session
+	Initiated bool
+}
+
+// Dialer opens a new socket connection with the other party and performs the handshake on it. Use Dial and InitiateSession to implement it.
+type Dialer func(ctx context.Context) (Transport, error)
+
+// connection is holding the actual socket conn to a specific address of a specific user.
+// It's handling the communication on both directions for all the chats that we have with that user.
+// Whenever the socket conn is lost, the connection dials the user again, with a jittered exponential backoff, until it
+// succeeds, the user opens a new socket conn with us or the user is not kept alive anymore.
 type connection struct {
-	u domain.User
-	c domain.Chat
+	self string
+	u    domain.User
+	dial Dialer
+	hb   Heartbeat
 
-	conn      net.Conn
-	cm        *sync.Mutex
-	writeChan chan domain.Message
+	// tm guards the transports and everything around them
+	tm *sync.Mutex
+	// transport is the one used for writing. It's nil while reconnecting and once closed.
+	transport *Transport
+	// transports are all the transports that are read, including the replaced ones that are read until the other party stops writing on them
+	transports map[*Transport]bool
+	// session is the one of the latest transport, used to know what was negotiated also while reconnecting
+	session   *Session
+	adoptedAt time.Time
+	closed    bool
+	adopted   chan struct{}
+	readDone  chan readResult
+	done      chan struct{}
+	// pongAt, ping and latency are the state of the heartbeats on the current transport
+	pongAt  time.Time
+	ping    pendingPing
+	latency time.Duration
+	// wm serializes the writes since the frames of a session need to be written in order
+	wm *sync.Mutex
 
-	closeChan chan struct{}
+	callbacks Callbacks
+}
 
-	closeCallback      func(u domain.User, c domain.Chat)
-	receiveMsgCallback func(m domain.Message)
+// readResult is what a transport reader reports once it cannot read anymore.
+type readResult struct {
+	t   *Transport
+	err error
+}
+
+// Dial opens a new socket connection with the address of the given user.
+func Dial(u domain.User) (net.Conn, error) {
+	return net.DialTimeout("tcp", fmt.Sprintf("%s:%d", u.Address, u.Port), dialTimeout)
 }
 
 // NewConnection creates a new connection object. In order to start using it, #start needs to be called in a new goroutine.
-// The function requires 4 parameters:
+// The function requires 6 parameters:
+// * self: the id of the current user. It's used to pick the same socket conn as the other party when both of us dial at once.
 // * u: a domain.User object describing the user. Important because it's using the IP and the Port from it
-// * c: a domain.Chat object describing the chat object. This is mostly important for the ID inside because it's needed for sending it over to the connected user.
-// * closeCallback: a function that receives the user and the chat given in the constructor whenever the connection with the other party is closed. This is really useful for cleaning up the connection from a pool or something similar.
-// * messageReceiveCallback: a function that is going to handle the received information from the other party.
-func NewConnection(u domain.User, c domain.Chat, conn net.Conn, closeCallback func(user domain.User, chat domain.Chat), messageReceiveCallback func(m domain.Message)) Conn {
+// * t: the already established Transport. Use Dial and InitiateSession or AcceptSession to obtain it.
+// * dial: the Dialer used to reconnect with the user once the socket conn is lost.
+// * hb: how often the user is pinged to detect a dead socket conn. Check Heartbeat for details.
+// * callbacks: the functions that are going to handle what the other party sends. Check Callbacks for details.
+func NewConnection(self string, u domain.User, t Transport, dial Dialer, hb Heartbeat, callbacks Callbacks) Conn {
 	return &connection{
-		u:         u,
-		c:         c,
-		conn:      conn,
-		cm:        &sync.Mutex{},
-		writeChan: make(chan domain.Message, 5),
+		self: self,
+		u:    u,
+		dial: dial,
+		hb:   hb,
 
-		closeChan: make(chan struct{}, 1),
+		tm:         &sync.Mutex{},
+		transport:  &t,
+		transports: map[*Transport]bool{&t: true},
+		session:    t.Session,
+		adoptedAt:  time.Now(),
+		pongAt:     time.Now(),
+		adopted:    make(chan struct{}, 1),
+		readDone:   make(chan readResult),
+		done:       make(chan struct{}),
+		wm:         &sync.Mutex{},
 
-		closeCallback:      closeCallback,
-		receiveMsgCallback: messageReceiveCallback,
+		callbacks: callbacks,
 	}
 }
 
+// Start reads the messages coming from the other party until the connection is closed or the context is done.
+// When the socket conn is lost, it reconnects and continues reading from the new one.
+// A message that fails the authentication is never passed further and closes the connection with an error wrapping AuthenticationFailedErr.
 func (c *connection) Start(ctx context.Context) {
+	var closeErr error
 	defer func() {
-		if c.conn != nil {
-			c.cm.Lock()
-			defer c.cm.Unlock()
-			if err := c.conn.Close(); err != nil {
-				log.Printf("error trying to close a socket connection: %s", err)
-			}
-		}
-		close(c.writeChan)
-		c.closeCallback(c.u, c.c)
+		_ = c.Close()
+		c.callbacks.OnClose(c, c.u, closeErr)
 	}()
-	if c.conn == nil {
-		if err := c.initializeConn(); err != nil {
+	if t := c.current(); t != nil {
+		go c.read(t)
+	}
+	if c.hb.Interval > 0 {
+		go c.heartbeat(ctx)
+	}
+	for {
+		var r readResult
+		select {
+		case <-ctx.Done():
 			return
+		case r = <-c.readDone:
 		}
-	}
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case m, ok := <-c.writeChan:
-				if !ok {
-					return
-				}
-				c.writeToConn(m)
-			case <-c.closeChan:
-				return
-			}
+		if errors.Is(r.err, AuthenticationFailedErr) {
+			log.Printf("dropping connection with user %s: %s", c.u.Id, r.err)
+			closeErr = r.err
+			return
 		}
-	}()
+		if !c.dropTransport(r.t) {
+			// a replaced transport that was read until the end
+			continue
+		}
+		if !errors.Is(r.err, io.EOF) && !errors.Is(r.err, net.ErrClosed) {
+			log.Printf("failed to read network message from connection %s", r.err)
+		}
+		c.callbacks.OnReconnecting(c, c.u, r.err)
+		if err := c.reconnect(ctx); err != nil {
+			log.Printf("giving up reconnecting with user %s: %s", c.u.Id, err)
+			return
+		}
+		c.callbacks.OnReconnected(c, c.u)
+	}
+}
+
+// read passes further the messages read from the transport until reading fails and reports it to Start.
+func (c *connection) read(t *Transport) {
+	err := c.readMessages(t)
+	c.tm.Lock()
+	delete(c.transports, t)
+	c.tm.Unlock()
+	_ = t.Conn.Close()
+	select {
+	case c.readDone <- readResult{t: t, err: err}:
+	case <-c.done:
+	}
+}
+
+func (c *connection) readMessages(t *Transport) error {
 	for {
-		m, err := ReadNetworkMessage(c.conn)
+		m, err := readSealedNetworkMessage(t.Conn, t.Session)
+		if err == nil && !isControlKind(m.Kind) && m.UserId != c.u.Id {
+			err = fmt.Errorf("%w: message claims to be sent by %s", AuthenticationFailedErr, m.UserId)
+		}
 		if err != nil {
-			if !errors.Is(err, io.EOF) {
-				fmt.Printf("failed to read network message from connection %s", err)
+			return err
+		}
+
+		if m.Kind == kindReceipt {
+			c.callbacks.OnReceipt(Receipt{
+				ChatId:    m.ChatId,
+				MessageId: m.Id,
+				UserId:    c.u.Id,
+				Status:    domain.MessageStatus(m.Status),
+			})
+			continue
+		}
+		if m.Kind == kindPing {
+			c.pong(m.Id)
+			continue
+		}
+		if m.Kind == kindPong {
+			c.handlePong(m.Id)
+			continue
+		}
+		if isChatEventKind(m.Kind) {
+			c.callbacks.OnChatEvent(domain.ChatEvent{
+				Type:   domain.ChatEventType(m.Kind),
+				ChatId: m.ChatId,
+				UserId: m.UserId,
+			})
+			continue
+		}
+		if m.Chunk != nil && isControlKind(m.Kind) {
+			c.callbacks.OnFileEvent(FileEvent{
+				Kind:      FileEventKind(m.Kind),
+				ChatId:    m.ChatId,
+				MessageId: m.Id,
+				UserId:    c.u.Id,
+				Offset:    m.Chunk.Offset,
+				Data:      m.Chunk.Data,
+				Checksum:  m.Chunk.Checksum,
+			})
+			continue
+		}
+		if err := c.callbacks.OnMessage(m.toMessage()); err != nil {
+			log.Printf("message %s from user %s not accepted: %s", m.Id, c.u.Id, err)
+			continue
+		}
+		if err := c.SendReceipt(Receipt{ChatId: m.ChatId, MessageId: m.Id, Status: domain.MessageStatusDelivered}); err != nil {
+			log.Printf("failed to acknowledge message %s to user %s: %s", m.Id, c.u.Id, err)
+		}
+	}
+}
+
+// reconnect dials the user until a new transport is established, either by us or by the user, waiting more and more between the attempts.
+func (c *connection) reconnect(ctx context.Context) error {
+	backoff := reconnectMinBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.adopted:
+		case <-time.After(jitter(backoff)):
+		}
+		if c.isClosed() {
+			return ClosedErr
+		}
+		if c.current() != nil {
+			return nil
+		}
+		if !c.callbacks.KeepAlive(c.u) {
+			return fmt.Errorf("%w: the user is not online anymore", DisconnectedErr)
+		}
+		t, err := c.dial(ctx)
+		if err == nil {
+			err = c.Adopt(t)
+			if errors.Is(err, ClosedErr) {
+				_ = t.Conn.Close()
+			}
+			if err == nil || errors.Is(err, DuplicateTransportErr) {
+				return nil
 			}
+		}
+		if errors.Is(err, ClosedErr) || errors.Is(err, IncompatiblePeerErr) || errors.Is(err, AuthenticationFailedErr) {
+			return err
+		}
+		log.Printf("failed to reconnect with user %s: %s", c.u.Id, err)
+		backoff *= 2
+		if backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+}
+
+// Adopt makes the connection write on the given transport instead of the current one, if any.
+// When both parties dial each other at the same time, both of them keep the transport opened by the party with the
+// smaller user id, so the other one is refused with DuplicateTransportErr. A closed connection refuses it with ClosedErr.
+// The transports that are replaced or refused with DuplicateTransportErr are not written anymore but they are still read until
+// the other party stops writing on them too, so nothing that was already written on them is lost. The ones refused with ClosedErr
+// need to be closed by the caller.
+func (c *connection) Adopt(t Transport) error {
+	c.tm.Lock()
+	if c.closed {
+		c.tm.Unlock()
+		return ClosedErr
+	}
+	adopted := &t
+	c.transports[adopted] = true
+	old := c.transport
+	if old != nil && time.Since(c.adoptedAt) < duplicateWindow && !c.preferred(t, *old) {
+		c.tm.Unlock()
+		c.retire(adopted)
+		go c.read(adopted)
+		return DuplicateTransportErr
+	}
+	c.transport, c.session, c.adoptedAt = adopted, t.Session, time.Now()
+	c.pongAt, c.ping, c.latency = time.Now(), pendingPing{}, 0
+	c.tm.Unlock()
+
+	if old != nil {
+		c.retire(old)
+	}
+	go c.read(adopted)
+	select {
+	case c.adopted <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// retire stops writing on the transport, once the write in progress is done, and lets the other party know about it.
+// When heartbeats are used, the transport is read at most for a heartbeat timeout, so a dead one is not kept forever.
+func (c *connection) retire(t *Transport) {
+	if c.hb.Timeout > 0 {
+		_ = t.Conn.SetReadDeadline(time.Now().Add(c.hb.Timeout))
+	}
+	go func() {
+		c.wm.Lock()
+		defer c.wm.Unlock()
+		if cw, ok := t.Conn.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
 			return
 		}
+		_ = t.Conn.Close()
+	}()
+}
+
+// preferred returns true when the transport a should be kept instead of b.
+// The one opened by the party with the smaller user id is preferred and, when opened by the same party, the newest one.
+func (c *connection) preferred(a, b Transport) bool {
+	initiator := func(t Transport) string {
+		if t.Initiated {
+			return c.self
+		}
+		return c.u.Id
+	}
+	return initiator(a) <= initiator(b)
+}
+
+// current returns the transport used for writing. It's nil while reconnecting and once the connection is closed.
+func (c *connection) current() *Transport {
+	c.tm.Lock()
+	defer c.tm.Unlock()
+	return c.transport
+}
 
-		c.receiveMsgCallback(domain.Message{
-			ChatId: m.ChatId,
-			UserId: m.UserId,
-			Text:   m.Message,
-			At:     m.At,
-		})
+// dropTransport closes the given transport and returns true when it was the one used for writing.
+func (c *connection) dropTransport(t *Transport) bool {
+	c.tm.Lock()
+	if c.transport != t {
+		c.tm.Unlock()
+		return false
 	}
+	c.transport = nil
+	c.latency = 0
+	c.tm.Unlock()
+	_ = t.Conn.Close()
+	return true
 }
 
-// SendMessage is scheduling the given message to be sent through the socket to the other party
-func (c *connection) SendMessage(m domain.Message) {
-	c.writeChan <- m
+func (c *connection) isClosed() bool {
+	c.tm.Lock()
+	defer c.tm.Unlock()
+	return c.closed
 }
 
-// Close is closing the connection created if any.
-func (c *connection) Close() error {
-	c.closeChan <- struct{}{}
-	return nil
+// jitter returns a random duration between half of the given one and the given one, so the peers that lost
+// their connections at the same time are not dialing each other at the same time again.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
 }
 
-// initializeConn creates a new connection with the info from the user object.
-func (c *connection) initializeConn() error {
-	c.cm.Lock()
-	defer c.cm.Unlock()
+// SendMessage writes the given message through the socket to the other party.
+// In case the write fails, an error wrapping DisconnectedErr is returned and the connection reconnects.
+// A membership announcement is refused with UnsupportedByPeerErr when the other party did not negotiate CapabilityGroups,
+// an edit or a deletion when it did not negotiate CapabilityEdits, a reaction when it did not negotiate CapabilityReactions
+// and so is a message bigger than the negotiated Limits, without closing the connection.
+func (c *connection) SendMessage(m domain.Message) error {
+	if m.Membership != nil && !c.Supports(CapabilityGroups) {
+		return fmt.Errorf("%w: %s", UnsupportedByPeerErr, CapabilityGroups)
+	}
+	if m.File != nil && !c.Supports(CapabilityFiles) {
+		return fmt.Errorf("%w: %s", UnsupportedByPeerErr, CapabilityFiles)
+	}
+	if m.Kind.IsRevision() && !c.Supports(CapabilityEdits) {
+		return fmt.Errorf("%w: %s", UnsupportedByPeerErr, CapabilityEdits)
+	}
+	if m.Kind == domain.MessageKindReaction && !c.Supports(CapabilityReactions) {
+		return fmt.Errorf("%w: %s", UnsupportedByPeerErr, CapabilityReactions)
+	}
+	return c.writeToConn(newNetworkMsg(m))
+}
+
+// SendReceipt writes the given receipt through the socket to the other party.
+// In case the write fails, an error wrapping DisconnectedErr is returned and the connection reconnects.
+// Nothing is sent when the other party did not negotiate CapabilityReceipts.
+func (c *connection) SendReceipt(r Receipt) error {
+	if !c.Supports(CapabilityReceipts) {
+		return nil
+	}
+	return c.writeToConn(NetworkMsg{
+		Id:     r.MessageId,
+		ChatId: r.ChatId,
+		Kind:   kindReceipt,
+		Status: string(r.Status),
+	})
+}
+
+// SendFileEvent writes the given file transfer event through the socket to the other party.
+// In case the write fails, an error wrapping DisconnectedErr is returned and the connection reconnects.
+func (c *connection) SendFileEvent(e FileEvent) error {
+	if !c.Supports(CapabilityFiles) {
+		return fmt.Errorf("%w: %s", UnsupportedByPeerErr, CapabilityFiles)
+	}
+	return c.writeToConn(NetworkMsg{
+		Id:     e.MessageId,
+		ChatId: e.ChatId,
+		Kind:   string(e.Kind),
+		Chunk: &NetworkFileChunk{
+			Offset:   e.Offset,
+			Data:     e.Data,
+			Checksum: e.Checksum,
+		},
+	})
+}
+
+// SendChatEvent writes the given chat event through the socket to the other party.
+// The event is refused with UnsupportedByPeerErr when the other party did not negotiate CapabilityTyping.
+func (c *connection) SendChatEvent(e domain.ChatEvent) error {
+	if !c.Supports(CapabilityTyping) {
+		return fmt.Errorf("%w: %s", UnsupportedByPeerErr, CapabilityTyping)
+	}
+	return c.writeToConn(NetworkMsg{
+		UserId: e.UserId,
+		ChatId: e.ChatId,
+		Kind:   string(e.Type),
+	})
+}
+
+// Supports returns true when the given capability was negotiated with the other party.
+func (c *connection) Supports(capability Capability) bool {
+	c.tm.Lock()
+	defer c.tm.Unlock()
+	return c.session.Supports(capability)
+}
+
+// Close is closing the socket connections and stops reconnecting. It's safe to call it multiple times.
+func (c *connection) Close() error {
+	c.tm.Lock()
+	if c.closed {
+		c.tm.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.transport = nil
+	transports := c.transports
+	c.transports = map[*Transport]bool{}
+	c.tm.Unlock()
 
-	if c.conn != nil {
-		if err := c.conn.Close(); err != nil {
-			log.Printf("error closing existing connection: %s", err)
+	close(c.done)
+	select {
+	case c.adopted <- struct{}{}:
+	default:
+	}
+	var err error
+	for t := range transports {
+		if closeErr := t.Conn.Close(); closeErr != nil {
+			err = closeErr
 		}
 	}
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", c.u.Address, c.u.Port), 4*time.Second)
+	return err
+}
+
+// writeToConn encrypts the message and writes it to the actual socket, split in as many frames as the negotiated Limits require.
+// When the write fails, the socket is closed so the goroutine reading it starts reconnecting.
+func (c *connection) writeToConn(m NetworkMsg) error {
+	msgEncoded, err := encodeGob(m)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to encode message to send it over network: %w", err)
 	}
-	c.conn = conn
 
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	t := c.current()
+	if t == nil {
+		if c.isClosed() {
+			return ClosedErr
+		}
+		return DisconnectedErr
+	}
+	if uint64(len(msgEncoded)) > uint64(t.Session.Limits.MaxMessageSize) {
+		return fmt.Errorf("%w: the message has %d bytes and the peer accepts at most %d", UnsupportedByPeerErr, len(msgEncoded), t.Session.Limits.MaxMessageSize)
+	}
+	_ = t.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := writeSealedMessage(t.Conn, t.Session, msgEncoded); err != nil {
+		_ = t.Conn.Close()
+		return fmt.Errorf("%w: failed to write the message into the socket: %s", DisconnectedErr, err)
+	}
 	return nil
 }
 
-// writeToConn writes the message to the actual socket.
-func (c *connection) writeToConn(m domain.Message) {
-	if c.conn == nil {
-		if err := c.initializeConn(); err != nil {
-			log.Printf("error initializing connection for connection on userId %s and chatId %s: %s. message discarded", c.u.Id, c.c.Id, err)
-			return
-		}
-	}
-	c.cm.Lock()
-	defer c.cm.Unlock()
-	var b bytes.Buffer
-	if err := gob.NewEncoder(&b).Encode(NetworkMsg{
-		UserId:  m.UserId,
-		ChatId:  m.ChatId,
-		Message: m.Text,
-		At:      m.At,
-	}); err != nil {
-		log.Printf("failed to encode message to send it over network: %s", err)
-		return
+type NetworkMsg struct {
+	Id         string
+	UserId     string
+	ChatId     string
+	Message    string
+	At         time.Time
+	Kind       string
+	Membership *NetworkMembership
+	File       *NetworkFile
+	// ParentId is set only for the replies. The peers not knowing it show the replies as regular messages.
+	ParentId string
+	// Status is set only for the receipts
+	Status string
+	// Chunk is set only for the file events
+	Chunk *NetworkFileChunk
+}
+
+// NetworkFile is the file offered by a message as it's sent over the network. The path of the file is never sent.
+type NetworkFile struct {
+	Name     string
+	Size     int64
+	Checksum string
+}
+
+// NetworkFileChunk carries a FileEvent. Only the FileChunk events have Data and Checksum.
+type NetworkFileChunk struct {
+	Offset   int64
+	Data     []byte
+	Checksum []byte
+}
+
+// isControlKind returns true for the kinds of the network messages that are not sent on behalf of a user and have no UserId.
+func isControlKind(kind string) bool {
+	switch FileEventKind(kind) {
+	case FileRequested, FileDeclined, FileChunk, FileCompleted:
+		return true
 	}
+	return kind == kindReceipt || kind == kindPing || kind == kindPong
+}
 
-	msgEncoded := b.Bytes()
-	if len(msgEncoded) > math.MaxUint16 {
-		log.Printf("error sending message because it's too big")
-		return
+// isChatEventKind returns true for the kinds of the network messages that carry a domain.ChatEvent.
+func isChatEventKind(kind string) bool {
+	switch domain.ChatEventType(kind) {
+	case domain.TypingStarted, domain.TypingStopped:
+		return true
 	}
-	sizeStr := fmt.Sprintf("%05d", len(b.Bytes()))
-	out := append([]byte(sizeStr), msgEncoded...)
+	return false
+}
+
+// NetworkMembership is the membership of a group chat as it's sent over the network.
+// Only the id and the name of each member are sent, the rest of the details are known from the directory.
+type NetworkMembership struct {
+	ChatName string
+	Members  []NetworkMember
+}
+
+type NetworkMember struct {
+	Id   string
+	Name string
+}
 
-	if _, err := c.conn.Write(out); err != nil {
-		log.Printf("failed to write the message into the socket: %s", err)
+func newNetworkMsg(m domain.Message) NetworkMsg {
+	nm := NetworkMsg{
+		Id:       m.Id,
+		UserId:   m.UserId,
+		ChatId:   m.ChatId,
+		Message:  m.Text,
+		At:       m.At,
+		Kind:     string(m.Kind),
+		ParentId: m.ParentId,
 	}
+	if m.Membership != nil {
+		nm.Membership = &NetworkMembership{ChatName: m.Membership.ChatName}
+		for _, u := range m.Membership.Members {
+			nm.Membership.Members = append(nm.Membership.Members, NetworkMember{Id: u.Id, Name: u.Name})
+		}
+	}
+	if m.File != nil {
+		nm.File = &NetworkFile{Name: m.File.Name, Size: m.File.Size, Checksum: m.File.Checksum}
+	}
+	return nm
 }
 
-type NetworkMsg struct {
-	UserId  string
-	ChatId  string
-	Message string
-	At      time.Time
-}
-
-// ReadNetworkMessage reads from the given net.Conn and returns a NetworkMsg.
-// This method expects that on the first 5 bytes of the stream contain the size of the payload expressed as a %05d formatted string.
-// If it does not find the 5 bytes containing the size it returns error.
-// The bytes following the size ones should be encoded using gob.NewEncoder.
-func ReadNetworkMessage(c io.Reader) (*NetworkMsg, error) {
-	sizeRead := make([]byte, 5)
-	n, err := io.ReadFull(c, sizeRead)
-	if err != nil {
-		return nil, err
+func (nm NetworkMsg) toMessage() domain.Message {
+	m := domain.Message{
+		Id:       nm.Id,
+		ChatId:   nm.ChatId,
+		UserId:   nm.UserId,
+		Text:     nm.Message,
+		At:       nm.At,
+		Kind:     domain.MessageKind(nm.Kind),
+		ParentId: nm.ParentId,
 	}
-	if n != 5 {
-		return nil, fmt.Errorf("wrong number of bytes read for determining the size of the payload. read %d", n)
+	if nm.Membership != nil {
+		m.Membership = &domain.Membership{ChatName: nm.Membership.ChatName}
+		for _, u := range nm.Membership.Members {
+			m.Membership.Members = append(m.Membership.Members, domain.User{Id: u.Id, Name: u.Name})
+		}
 	}
-	size, err := strconv.Atoi(string(sizeRead))
-	if err != nil {
-		return nil, fmt.Errorf("invalid content message as the size of the message is unparseable: %s", err)
+	if nm.File != nil {
+		m.File = &domain.FileTransfer{
+			Name:     nm.File.Name,
+			Size:     nm.File.Size,
+			Checksum: nm.File.Checksum,
+			State:    domain.FileStateOffered,
+		}
 	}
-	msg := make([]byte, size)
-	n, err = io.ReadFull(c, msg)
+	return m
+}
+
+// readSealedNetworkMessage reads the frames written by a connection with an established Session and returns the NetworkMsg from them.
+func readSealedNetworkMessage(c io.Reader, s *Session) (*NetworkMsg, error) {
+	msg, err := readSealedMessage(c, s)
 	if err != nil {
 		return nil, err
 	}
-
 	var m NetworkMsg
-	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&m); err != nil {
+	if err := decodeGob(msg, &m); err != nil {
 		return nil, err
 	}
 	return &m, nil
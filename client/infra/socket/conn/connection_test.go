@@ -2,64 +2,81 @@ package conn
 
 import (
 	"bytes"
-	"encoding/gob"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/identity"
 	"io"
+	"net"
 	"strings"
 	"testing"
 	"time"
 )
 
-func TestReadNetworkMessage(t *testing.T) {
+func TestReadSealedNetworkMessage(t *testing.T) {
+	limits := Limits{MaxFrameSize: MinFrameSize, MaxMessageSize: 8 * 1024}
 	errorTests := []struct {
 		given       string
 		expectedErr string
-		readerFunc  func() io.Reader
+		readerFunc  func(sender *Session) io.Reader
 	}{
 		{
 			given:       "an empty reader",
 			expectedErr: "EOF",
-			readerFunc: func() io.Reader {
+			readerFunc: func(*Session) io.Reader {
 				return bytes.NewReader([]byte{})
 			},
 		},
 		{
 			given:       "a reader with a shorter content than expected for the size",
 			expectedErr: "unexpected EOF",
-			readerFunc: func() io.Reader {
+			readerFunc: func(*Session) io.Reader {
 				return bytes.NewReader([]byte{1, 2, 3})
 			},
 		},
 		{
-			given:       "a reader with not a valid string formatted uint16",
-			expectedErr: "invalid content message as the size of the message is unparseable: strconv.Atoi: parsing \"defin\": invalid syntax",
-			readerFunc: func() io.Reader {
+			given:       "a reader with a size bigger than the maximum frame size",
+			expectedErr: "frame too large: 1684366953 bytes while the maximum is 1024",
+			readerFunc: func(*Session) io.Reader {
 				return bytes.NewReader([]byte("definitely not a number"))
 			},
 		},
 		{
 			given:       "a reader containing a size but the size of the actual payload is less than indicated",
 			expectedErr: "unexpected EOF",
-			readerFunc: func() io.Reader {
-				return bytes.NewReader([]byte("00009payload"))
+			readerFunc: func(*Session) io.Reader {
+				return bytes.NewReader(append([]byte{0, 0, 0, 9}, []byte("payload")...))
 			},
 		},
 		{
-			given:       "a reader containing a size but the actual payload is in unparseable",
+			given:       "a reader containing a payload that is not sealed",
+			expectedErr: AuthenticationFailedErr.Error(),
+			readerFunc: func(*Session) io.Reader {
+				return bytes.NewReader(append([]byte{0, 0, 0, 21}, []byte("payloadpayloadpayloaddddddddd")...))
+			},
+		},
+		{
+			given:       "a reader containing a sealed payload that is unparseable",
 			expectedErr: "unexpected EOF",
-			readerFunc: func() io.Reader {
-				return bytes.NewReader([]byte("00021payloadpayloadpayloaddddddddd"))
+			readerFunc: func(sender *Session) io.Reader {
+				var b bytes.Buffer
+				if err := writeSealedMessage(&b, sender, []byte("payloadpayloadpayload")); err != nil {
+					t.Fatalf("failed to write the payload: %s", err)
+				}
+				return &b
 			},
 		},
 	}
 
 	for i := range errorTests {
-		t.Run(fmt.Sprintf(`Given %s, When ReadNetworkMessage called, Then '%s' error expected`,
+		t.Run(fmt.Sprintf(`Given %s, When readSealedNetworkMessage called, Then '%s' error expected`,
 			errorTests[i].given,
 			errorTests[i].expectedErr), func(t *testing.T) {
-			_, err := ReadNetworkMessage(errorTests[i].readerFunc())
+			sender, receiver := newSessions(t, limits)
+			_, err := readSealedNetworkMessage(errorTests[i].readerFunc(sender), receiver)
 			if err == nil {
-				t.Errorf("expected an error but received nothing")
+				t.Fatalf("expected an error but received nothing")
 			}
 			if !strings.Contains(err.Error(), errorTests[i].expectedErr) {
 				t.Errorf("expected '%s' to contain '%s'", err.Error(), errorTests[i].expectedErr)
@@ -67,26 +84,28 @@ func TestReadNetworkMessage(t *testing.T) {
 		})
 	}
 
-	t.Run(`Given an expected reader, When ReadNetworkMessage is called, Then the network message is returned correctly`, func(t *testing.T) {
+	t.Run(`Given an expected reader, When readSealedNetworkMessage is called, Then the network message is returned correctly`, func(t *testing.T) {
 		// Given
+		sender, receiver := newSessions(t, limits)
 		msg := NetworkMsg{
 			UserId:  "user_id",
 			ChatId:  "chat_id",
 			Message: "here is your message",
 			At:      time.Now().UTC(),
 		}
-		var b bytes.Buffer
-		if err := gob.NewEncoder(&b).Encode(msg); err != nil {
+		payload, err := encodeGob(msg)
+		if err != nil {
 			t.Errorf("failed to encode message to send it over network: %s", err)
 			t.FailNow()
 			return
 		}
 
 		// When
-		contentBytes := b.Bytes()
-		size := fmt.Sprintf("%05d", len(contentBytes))
-		fullContent := append([]byte(size), contentBytes...)
-		decodedMsg, err := ReadNetworkMessage(bytes.NewReader(fullContent))
+		var b bytes.Buffer
+		if err := writeSealedMessage(&b, sender, payload); err != nil {
+			t.Fatalf("expected no error writing the message but received %s", err)
+		}
+		decodedMsg, err := readSealedNetworkMessage(&b, receiver)
 		if err != nil {
 			t.Errorf("expected no error but received: %s", err)
 			t.FailNow()
@@ -94,8 +113,228 @@ func TestReadNetworkMessage(t *testing.T) {
 
 		// Then
 		if *decodedMsg != msg {
-			t.Errorf("expected the decoded message to be equal with the one before encoding. expected: %s, actual: %s", msg, *decodedMsg)
+			t.Errorf("expected the decoded message to be equal with the one before encoding. expected: %+v, actual: %+v", msg, *decodedMsg)
 			t.FailNow()
 		}
 	})
 }
+
+// newTestTransports establishes a session between alice and bob over a loopback socket connection and returns the transports of both.
+func newTestTransports(t *testing.T) (Transport, Transport) {
+	aliceId, err := identity.New()
+	if err != nil {
+		t.Fatalf("failed to generate identity: %s", err)
+	}
+	bobId, err := identity.New()
+	if err != nil {
+		t.Fatalf("failed to generate identity: %s", err)
+	}
+	alice := domain.User{Id: "alice", PublicKey: aliceId.PublicKey()}
+	bob := domain.User{Id: "bob", PublicKey: bobId.PublicKey()}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer l.Close()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	c2, err := l.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = c1.Close()
+		_ = c2.Close()
+	})
+	accepted := make(chan *Session, 1)
+	go func() {
+		hello, err := ReadHello(c2)
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		s, _ := AcceptSession(c2, bobId, bob, alice, hello, DefaultLimits)
+		accepted <- s
+	}()
+	aliceSession, err := InitiateSession(c1, aliceId, alice, bob, DefaultLimits)
+	bobSession := <-accepted
+	if err != nil || bobSession == nil {
+		t.Fatalf("failed to establish the session: %v", err)
+	}
+	return Transport{Conn: c1, Session: aliceSession, Initiated: true}, Transport{Conn: c2, Session: bobSession}
+}
+
+func TestConnection_Reconnect(t *testing.T) {
+	t.Run(`Given a connection with bob, 
+	When the socket connection is lost and bob is still online, 
+	Then the connection dials bob again and receives the messages sent on the new socket connection`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		alice1, bob1 := newTestTransports(t)
+		alice2, bob2 := newTestTransports(t)
+		go func() {
+			_, _ = io.Copy(io.Discard, bob2.Conn)
+		}()
+		reconnecting := make(chan struct{}, 1)
+		reconnected := make(chan struct{}, 1)
+		messages := make(chan domain.Message, 1)
+		c := NewConnection("alice", domain.User{Id: "bob"}, alice1,
+			func(ctx context.Context) (Transport, error) {
+				return alice2, nil
+			},
+			Heartbeat{},
+			Callbacks{
+				OnClose:        func(conn Conn, u domain.User, err error) {},
+				OnReconnecting: func(conn Conn, u domain.User, err error) { reconnecting <- struct{}{} },
+				OnReconnected:  func(conn Conn, u domain.User) { reconnected <- struct{}{} },
+				KeepAlive:      func(u domain.User) bool { return true },
+				OnMessage: func(m domain.Message) error {
+					messages <- m
+					return nil
+				},
+			})
+		go c.Start(ctx)
+
+		// When
+		_ = bob1.Conn.Close()
+
+		// Then
+		for _, ch := range []chan struct{}{reconnecting, reconnected} {
+			select {
+			case <-ch:
+			case <-time.After(3 * time.Second):
+				t.Fatalf("expected the connection to reconnect")
+			}
+		}
+		msg, err := encodeGob(NetworkMsg{Id: "m1", UserId: "bob", ChatId: "chat", Message: "hello again"})
+		if err != nil {
+			t.Fatalf("failed to encode the message: %s", err)
+		}
+		if err := writeSealedMessage(bob2.Conn, bob2.Session, msg); err != nil {
+			t.Fatalf("failed to write the message: %s", err)
+		}
+		select {
+		case m := <-messages:
+			if m.Text != "hello again" {
+				t.Fatalf("expected to receive 'hello again' but received %s", m.Text)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected to receive the message sent after reconnecting")
+		}
+	})
+
+	t.Run(`Given alice and bob using the socket connection just opened by alice, 
+	When the socket connection opened by bob at the same time is established too, 
+	Then both refuse it and keep the one opened by alice since her id is the smaller one`, func(t *testing.T) {
+		// Given
+		opened := func(initiated bool) Transport {
+			c1, c2 := net.Pipe()
+			t.Cleanup(func() {
+				_ = c1.Close()
+				_ = c2.Close()
+			})
+			return Transport{Conn: c1, Session: &Session{Limits: DefaultLimits}, Initiated: initiated}
+		}
+		aliceConn := NewConnection("alice", domain.User{Id: "bob"}, opened(true), nil, Heartbeat{}, Callbacks{})
+		bobConn := NewConnection("bob", domain.User{Id: "alice"}, opened(false), nil, Heartbeat{}, Callbacks{})
+		defer aliceConn.Close()
+		defer bobConn.Close()
+
+		// When
+		aliceErr := aliceConn.Adopt(opened(false))
+		bobErr := bobConn.Adopt(opened(true))
+
+		// Then
+		for _, err := range []error{aliceErr, bobErr} {
+			if !errors.Is(err, DuplicateTransportErr) {
+				t.Fatalf("expected %s but received %v", DuplicateTransportErr, err)
+			}
+		}
+	})
+
+	t.Run(`Given alice refusing the socket connection opened by bob at the same time with hers, 
+	When bob already wrote a message on it, 
+	Then alice still receives the message`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		alice1, bob1 := newTestTransports(t)
+		alice2, bob2 := newTestTransports(t)
+		alice2.Initiated = false
+		go func() {
+			_, _ = io.Copy(io.Discard, bob1.Conn)
+		}()
+		messages := make(chan domain.Message, 1)
+		c := NewConnection("alice", domain.User{Id: "bob"}, alice1, nil, Heartbeat{}, Callbacks{
+			OnClose: func(conn Conn, u domain.User, err error) {},
+			OnMessage: func(m domain.Message) error {
+				messages <- m
+				return nil
+			},
+		})
+		go c.Start(ctx)
+		defer c.Close()
+		if err := c.Adopt(alice2); !errors.Is(err, DuplicateTransportErr) {
+			t.Fatalf("expected %s but received %v", DuplicateTransportErr, err)
+		}
+
+		// When
+		msg, err := encodeGob(NetworkMsg{Id: "m1", UserId: "bob", ChatId: "chat", Message: "sent too early"})
+		if err != nil {
+			t.Fatalf("failed to encode the message: %s", err)
+		}
+		if err := writeSealedMessage(bob2.Conn, bob2.Session, msg); err != nil {
+			t.Fatalf("failed to write the message: %s", err)
+		}
+
+		// Then
+		select {
+		case m := <-messages:
+			if m.Text != "sent too early" {
+				t.Fatalf("expected to receive 'sent too early' but received %s", m.Text)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected to receive the message written on the refused socket connection")
+		}
+	})
+}
+
+func TestConnection_SendChatEvent(t *testing.T) {
+	t.Run(`Given a connection between alice and bob, 
+	When bob starts typing in their chat, 
+	Then alice receives the chat event`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		aliceT, bobT := newTestTransports(t)
+		events := make(chan domain.ChatEvent, 1)
+		alice := NewConnection("alice", domain.User{Id: "bob"}, aliceT, nil, Heartbeat{}, Callbacks{
+			OnClose:     func(conn Conn, u domain.User, err error) {},
+			OnChatEvent: func(e domain.ChatEvent) { events <- e },
+		})
+		bob := NewConnection("bob", domain.User{Id: "alice"}, bobT, nil, Heartbeat{}, Callbacks{
+			OnClose: func(conn Conn, u domain.User, err error) {},
+		})
+		go alice.Start(ctx)
+		go bob.Start(ctx)
+
+		// When
+		typing := domain.ChatEvent{Type: domain.TypingStarted, ChatId: "chat", UserId: "bob"}
+		if err := bob.SendChatEvent(typing); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// Then
+		select {
+		case e := <-events:
+			if e != typing {
+				t.Fatalf("expected to receive %+v but received %+v", typing, e)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected to receive the chat event")
+		}
+	})
+}
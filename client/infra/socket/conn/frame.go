@@ -0,0 +1,164 @@
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// frameHeaderSize is the size of the big endian uint32 that prefixes every frame with the size of its payload
+	frameHeaderSize = 4
+	// maxHelloSize bounds the plain text frames read before the limits of the connection are negotiated
+	maxHelloSize = 4 * 1024
+	// chunkFlagSize is the size of the flag that prefixes every chunk of a message and tells if more chunks are following
+	chunkFlagSize = 1
+	// messageEnvelopeSize is the room kept in a message for everything else besides its text
+	messageEnvelopeSize = 4 * 1024
+
+	// MinFrameSize is the smallest maximum frame size accepted from a peer
+	MinFrameSize = 1024
+)
+
+const (
+	chunkFinal byte = iota
+	chunkMore
+)
+
+var FrameTooLargeErr = errors.New("frame too large")
+
+// Limits bounds the size of what is exchanged on a connection. Both parties advertise their limits in the Hello and
+// the connection is using the smallest ones.
+// * MaxFrameSize: the largest frame payload read from or written to the socket. The size of a frame is checked before reading its payload.
+// * MaxMessageSize: the largest message. A message bigger than MaxFrameSize is split into chunks, each one sent in its own frame.
+type Limits struct {
+	MaxFrameSize   uint32
+	MaxMessageSize uint32
+}
+
+// DefaultLimits are the limits used when no others are configured.
+var DefaultLimits = Limits{
+	MaxFrameSize:   16 * 1024,
+	MaxMessageSize: 64 * 1024,
+}
+
+// MaxTextLen returns the length of the longest message text that fits in the limits.
+func (l Limits) MaxTextLen() int {
+	return int(l.MaxMessageSize) - messageEnvelopeSize
+}
+
+// validate returns an error when the limits are too small to carry the handshake and a message.
+func (l Limits) validate() error {
+	if l.MaxFrameSize < MinFrameSize {
+		return fmt.Errorf("the maximum frame size %d is less than %d", l.MaxFrameSize, MinFrameSize)
+	}
+	if l.MaxMessageSize <= messageEnvelopeSize {
+		return fmt.Errorf("the maximum message size %d is not more than %d", l.MaxMessageSize, messageEnvelopeSize)
+	}
+	return nil
+}
+
+// min returns the smallest of each limit.
+func (l Limits) min(other Limits) Limits {
+	if other.MaxFrameSize < l.MaxFrameSize {
+		l.MaxFrameSize = other.MaxFrameSize
+	}
+	if other.MaxMessageSize < l.MaxMessageSize {
+		l.MaxMessageSize = other.MaxMessageSize
+	}
+	return l
+}
+
+// writeFrame writes the payload prefixed by its size expressed as a big endian uint32.
+func writeFrame(w io.Writer, payload []byte, maxSize uint32) error {
+	if uint64(len(payload)) > uint64(maxSize) {
+		return fmt.Errorf("%w: %d bytes while the maximum is %d", FrameTooLargeErr, len(payload), maxSize)
+	}
+	out := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(out, uint32(len(payload)))
+	out = append(out, payload...)
+	_, err := w.Write(out)
+	return err
+}
+
+// readFrame reads one payload written by writeFrame. The frames announcing a payload bigger than maxSize are
+// rejected before allocating anything for it.
+func readFrame(c io.Reader, maxSize uint32) ([]byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes while the maximum is %d", FrameTooLargeErr, size, maxSize)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(c, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeSealedMessage splits the payload in chunks that fit, once sealed, in the negotiated frame size and writes them in order.
+// The caller needs to make sure that no other frame is written on w until this returns.
+func writeSealedMessage(w io.Writer, s *Session, payload []byte) error {
+	if uint64(len(payload)) > uint64(s.Limits.MaxMessageSize) {
+		return fmt.Errorf("%w: message of %d bytes while the maximum is %d", FrameTooLargeErr, len(payload), s.Limits.MaxMessageSize)
+	}
+	chunkSize := int(s.Limits.MaxFrameSize) - s.overhead() - chunkFlagSize
+	for {
+		n, flag := len(payload), chunkFinal
+		if n > chunkSize {
+			n, flag = chunkSize, chunkMore
+		}
+		chunk := append([]byte{flag}, payload[:n]...)
+		if err := writeFrame(w, s.seal(chunk), s.Limits.MaxFrameSize); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		if flag == chunkFinal {
+			return nil
+		}
+	}
+}
+
+// readSealedMessage reads the chunks written by writeSealedMessage and returns the payload assembled from them.
+func readSealedMessage(r io.Reader, s *Session) ([]byte, error) {
+	var payload []byte
+	for {
+		sealed, err := readFrame(r, s.Limits.MaxFrameSize)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := s.open(sealed)
+		if err != nil {
+			return nil, err
+		}
+		// every chunk but the last one needs to carry a part of the message, so a peer cannot keep us reading forever
+		if len(chunk) < chunkFlagSize || (chunk[0] != chunkFinal && len(chunk) == chunkFlagSize) {
+			return nil, fmt.Errorf("%w: empty chunk", AuthenticationFailedErr)
+		}
+		if uint64(len(payload)+len(chunk)-chunkFlagSize) > uint64(s.Limits.MaxMessageSize) {
+			return nil, fmt.Errorf("%w: message bigger than %d bytes", FrameTooLargeErr, s.Limits.MaxMessageSize)
+		}
+		payload = append(payload, chunk[chunkFlagSize:]...)
+		if chunk[0] == chunkFinal {
+			return payload, nil
+		}
+	}
+}
+
+func encodeGob(v any) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decodeGob(b []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
@@ -0,0 +1,108 @@
+package conn
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"testing"
+)
+
+// newSessions returns the sessions of a sender and of a receiver sharing the same key.
+func newSessions(t *testing.T, limits Limits) (*Session, *Session) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		t.Fatalf("failed to create the cipher: %s", err)
+	}
+	return &Session{Limits: limits, send: aead, recv: aead}, &Session{Limits: limits, send: aead, recv: aead}
+}
+
+func TestSealedMessage(t *testing.T) {
+	limits := Limits{MaxFrameSize: MinFrameSize, MaxMessageSize: 8 * 1024}
+
+	t.Run(`Given a message bigger than the maximum frame size, 
+	When it is written, 
+	Then it is split in frames no bigger than the maximum and read back whole`, func(t *testing.T) {
+		// Given
+		sender, receiver := newSessions(t, limits)
+		payload := bytes.Repeat([]byte("0123456789"), 500)
+
+		// When
+		var b bytes.Buffer
+		if err := writeSealedMessage(&b, sender, payload); err != nil {
+			t.Fatalf("expected no error writing the message but received %s", err)
+		}
+
+		// Then
+		if sender.sendCount < 5 {
+			t.Fatalf("expected the message to be split in at least 5 frames but was written in %d", sender.sendCount)
+		}
+		read, err := readSealedMessage(&b, receiver)
+		if err != nil {
+			t.Fatalf("expected no error reading the message but received %s", err)
+		}
+		if !bytes.Equal(read, payload) {
+			t.Fatalf("expected to read the message that was written")
+		}
+	})
+
+	t.Run(`Given a message bigger than the maximum message size, 
+	When it is written, 
+	Then a frame too large error is returned`, func(t *testing.T) {
+		// Given
+		sender, _ := newSessions(t, limits)
+		payload := make([]byte, limits.MaxMessageSize+1)
+
+		// When
+		err := writeSealedMessage(&bytes.Buffer{}, sender, payload)
+
+		// Then
+		if !errors.Is(err, FrameTooLargeErr) {
+			t.Fatalf("expected %s but received %v", FrameTooLargeErr, err)
+		}
+	})
+
+	t.Run(`Given chunks that add up to more than the maximum message size, 
+	When the message is read, 
+	Then a frame too large error is returned`, func(t *testing.T) {
+		// Given
+		sender, receiver := newSessions(t, Limits{MaxFrameSize: MinFrameSize, MaxMessageSize: 16 * 1024})
+		receiver.Limits = limits
+		var b bytes.Buffer
+		if err := writeSealedMessage(&b, sender, make([]byte, 12*1024)); err != nil {
+			t.Fatalf("expected no error writing the message but received %s", err)
+		}
+
+		// When
+		_, err := readSealedMessage(&b, receiver)
+
+		// Then
+		if !errors.Is(err, FrameTooLargeErr) {
+			t.Fatalf("expected %s but received %v", FrameTooLargeErr, err)
+		}
+	})
+
+	t.Run(`Given chunks that are not the last one and carry nothing, 
+	When the message is read, 
+	Then an authentication error is returned without waiting for the last chunk`, func(t *testing.T) {
+		// Given
+		sender, receiver := newSessions(t, limits)
+		var b bytes.Buffer
+		for i := 0; i < 3; i++ {
+			if err := writeFrame(&b, sender.seal([]byte{chunkMore}), limits.MaxFrameSize); err != nil {
+				t.Fatalf("expected no error writing the chunk but received %s", err)
+			}
+		}
+
+		// When
+		_, err := readSealedMessage(&b, receiver)
+
+		// Then
+		if !errors.Is(err, AuthenticationFailedErr) {
+			t.Fatalf("expected %s but received %v", AuthenticationFailedErr, err)
+		}
+		if b.Len() == 0 {
+			t.Fatalf("expected the reading to stop at the first empty chunk")
+		}
+	})
+}
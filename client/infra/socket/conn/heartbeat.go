@@ -0,0 +1,96 @@
+package conn
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Heartbeat configures the pings sent to the other party in order to detect a dead socket connection, like the one left
+// half-open by a peer that lost its power:
+// * Interval: how often the other party is pinged. Zero disables the heartbeats.
+// * Timeout: for how long the pongs can be missing before the socket connection is considered dead and the connection reconnects.
+// The heartbeats are used only with the peers that advertised CapabilityHeartbeats.
+type Heartbeat struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// DefaultHeartbeat is used when nothing else is configured.
+var DefaultHeartbeat = Heartbeat{
+	Interval: 5 * time.Second,
+	Timeout:  15 * time.Second,
+}
+
+// pendingPing is the last ping sent on the current transport, used to measure the latency once its pong arrives.
+type pendingPing struct {
+	id string
+	at time.Time
+}
+
+// heartbeat pings the other party on every interval until the connection is closed or the context is done.
+func (c *connection) heartbeat(ctx context.Context) {
+	tick := time.NewTicker(c.hb.Interval)
+	defer tick.Stop()
+	var seq uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.done:
+			return
+		case <-tick.C:
+		}
+		seq++
+		c.beat(strconv.FormatUint(seq, 10))
+	}
+}
+
+// beat closes the current socket connection when no pong arrived for too long, otherwise it sends a new ping.
+func (c *connection) beat(id string) {
+	c.tm.Lock()
+	t := c.transport
+	if t == nil || !t.Session.Supports(CapabilityHeartbeats) {
+		c.tm.Unlock()
+		return
+	}
+	if silence := time.Since(c.pongAt); silence > c.hb.Timeout {
+		c.tm.Unlock()
+		log.Printf("no pong from user %s for %s, dropping the socket connection", c.u.Id, silence.Round(time.Millisecond))
+		_ = t.Conn.Close()
+		return
+	}
+	c.ping = pendingPing{id: id, at: time.Now()}
+	c.tm.Unlock()
+
+	if err := c.writeToConn(NetworkMsg{Id: id, Kind: kindPing}); err != nil {
+		log.Printf("failed to ping user %s: %s", c.u.Id, err)
+	}
+}
+
+// pong answers the ping with the given id.
+func (c *connection) pong(id string) {
+	if err := c.writeToConn(NetworkMsg{Id: id, Kind: kindPong}); err != nil {
+		log.Printf("failed to answer the ping of user %s: %s", c.u.Id, err)
+	}
+}
+
+// handlePong marks the other party as alive and, when the pong answers the last ping, measures the round-trip latency.
+func (c *connection) handlePong(id string) {
+	c.tm.Lock()
+	defer c.tm.Unlock()
+	c.pongAt = time.Now()
+	if len(c.ping.id) > 0 && c.ping.id == id {
+		c.latency = time.Since(c.ping.at)
+		c.ping = pendingPing{}
+	}
+}
+
+// Latency returns the round-trip time measured by the last heartbeat. It returns false while nothing was measured on the
+// current socket connection, like while reconnecting or with the peers that do not support CapabilityHeartbeats.
+func (c *connection) Latency() (time.Duration, bool) {
+	c.tm.Lock()
+	defer c.tm.Unlock()
+	return c.latency, c.transport != nil && c.latency > 0
+}
@@ -0,0 +1,87 @@
+package conn
+
+import (
+	"context"
+	"github.com/yottta/chat/client/domain"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestConnection_Heartbeat(t *testing.T) {
+	hb := Heartbeat{Interval: 20 * time.Millisecond, Timeout: 200 * time.Millisecond}
+	callbacks := func(reconnecting chan struct{}) Callbacks {
+		return Callbacks{
+			OnClose: func(conn Conn, u domain.User, err error) {},
+			OnReconnecting: func(conn Conn, u domain.User, err error) {
+				reconnecting <- struct{}{}
+			},
+			OnReconnected: func(conn Conn, u domain.User) {},
+			KeepAlive:     func(u domain.User) bool { return false },
+		}
+	}
+
+	t.Run(`Given a connection between alice and bob, 
+	When both of them answer the pings, 
+	Then the latency is measured and the connection is kept`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		aliceT, bobT := newTestTransports(t)
+		reconnecting := make(chan struct{}, 2)
+		alice := NewConnection("alice", domain.User{Id: "bob"}, aliceT, nil, hb, callbacks(reconnecting))
+		bob := NewConnection("bob", domain.User{Id: "alice"}, bobT, nil, hb, callbacks(reconnecting))
+
+		// When
+		go alice.Start(ctx)
+		go bob.Start(ctx)
+
+		// Then
+		deadline := time.After(3 * time.Second)
+		for {
+			if latency, ok := alice.Latency(); ok {
+				if latency <= 0 || latency > time.Second {
+					t.Fatalf("expected a positive latency under a second but measured %s", latency)
+				}
+				break
+			}
+			select {
+			case <-deadline:
+				t.Fatalf("expected the latency to be measured")
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		select {
+		case <-reconnecting:
+			t.Fatalf("expected the connection to be kept while the pongs arrive")
+		case <-time.After(2 * hb.Timeout):
+		}
+	})
+
+	t.Run(`Given a connection with bob, 
+	When bob stops answering the pings, 
+	Then the socket connection is dropped once the heartbeat timeout passes`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		aliceT, bobT := newTestTransports(t)
+		go func() {
+			_, _ = io.Copy(io.Discard, bobT.Conn)
+		}()
+		reconnecting := make(chan struct{}, 1)
+		alice := NewConnection("alice", domain.User{Id: "bob"}, aliceT, nil, hb, callbacks(reconnecting))
+
+		// When
+		go alice.Start(ctx)
+
+		// Then
+		select {
+		case <-reconnecting:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected the socket connection to be dropped")
+		}
+		if _, ok := alice.Latency(); ok {
+			t.Fatalf("expected no latency without pongs")
+		}
+	})
+}
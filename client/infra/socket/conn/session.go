@@ -0,0 +1,289 @@
+package conn
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/identity"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	handshakeTimeout = 5 * time.Second
+	sessionInfo      = "go-chat session v1"
+	challengeSize    = 32
+)
+
+var AuthenticationFailedErr = errors.New("message failed authentication")
+
+// Hello is the first frame exchanged on a new connection, in plain text, by both parties.
+// The initiator of the connection is the first one sending it. The answer of the responder contains
+// also a random challenge that the initiator needs to send back encrypted with the session key.
+// Both parties advertise the protocol versions and the capabilities that they support and the session is using the common subset.
+// When the responder finds the initiator incompatible, it answers only with its versions so the initiator can report it.
+type Hello struct {
+	UserId       string
+	Version      int
+	MinVersion   int
+	Build        string
+	Capabilities []Capability
+	Limits       Limits
+	EphemeralKey []byte
+	Challenge    []byte
+
+	// raw is the frame as it was read or written. Both hello frames are bound into the session keys so
+	// none of them can be altered on the way without failing the handshake.
+	raw []byte
+}
+
+// Session holds the keys used to encrypt and authenticate the frames exchanged on a connection.
+// Each direction is using its own key and a frame counter as nonce, so frames that are dropped, replayed
+// or reordered fail the authentication.
+// Besides the keys, it holds what was negotiated with the other party.
+type Session struct {
+	Version      int
+	Capabilities []Capability
+	Limits       Limits
+	PeerBuild    string
+
+	send      cipher.AEAD
+	recv      cipher.AEAD
+	sendCount uint64
+	recvCount uint64
+}
+
+func newHello(userId string, limits Limits, ephemeralKey []byte) Hello {
+	return Hello{
+		UserId:       userId,
+		Version:      ProtocolVersion,
+		MinVersion:   MinProtocolVersion,
+		Build:        Build,
+		Capabilities: supportedCapabilities,
+		Limits:       limits,
+		EphemeralKey: ephemeralKey,
+	}
+}
+
+// InitiateSession performs the handshake on a connection that we opened with the given peer.
+// The session key is derived from the ephemeral keys of both parties and from the identity keys, so only the holder of the
+// identity registered for the peer can read the frames or produce frames that we accept.
+// The limits are the ones that we advertise. The session is using the smallest ones between ours and the ones of the peer.
+// An error wrapping IncompatiblePeerErr is returned when the peer does not speak a protocol version that we support.
+func InitiateSession(nc net.Conn, id *identity.Identity, self domain.User, peer domain.User, limits Limits) (*Session, error) {
+	_ = nc.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer func() {
+		_ = nc.SetDeadline(time.Time{})
+	}()
+	ephemeral, ephemeralPublic, err := newEphemeralKey()
+	if err != nil {
+		return nil, err
+	}
+	hello := newHello(self.Id, limits, ephemeralPublic)
+	if err := writeHello(nc, &hello); err != nil {
+		return nil, err
+	}
+	reply, err := ReadHello(nc)
+	if err != nil {
+		return nil, err
+	}
+	if reply.UserId != peer.Id {
+		return nil, fmt.Errorf("%w: expected to talk with %s but %s answered", AuthenticationFailedErr, peer.Id, reply.UserId)
+	}
+	session, err := negotiate(reply, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	// ee, es, se in this order on both sides
+	secrets, err := sharedSecrets(
+		func() ([]byte, error) { return identity.SharedSecret(ephemeral, reply.EphemeralKey) },
+		func() ([]byte, error) { return identity.SharedSecret(ephemeral, peer.PublicKey) },
+		func() ([]byte, error) { return id.SharedSecret(reply.EphemeralKey) },
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.deriveKeys(secrets, &hello, reply, true); err != nil {
+		return nil, err
+	}
+	// prove that we hold the identity key registered for us by answering to the challenge
+	if err := writeFrame(nc, session.seal(reply.Challenge), session.Limits.MaxFrameSize); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// AcceptSession answers to the Hello received from the peer that opened the connection and performs our side of the handshake.
+// The session is returned only after the peer proved that it holds the identity key of the given user by answering to our challenge.
+// The limits are the ones that we advertise. The session is using the smallest ones between ours and the ones of the peer.
+// An error wrapping IncompatiblePeerErr is returned when the peer does not speak a protocol version that we support.
+func AcceptSession(nc net.Conn, id *identity.Identity, self domain.User, peer domain.User, hello *Hello, limits Limits) (*Session, error) {
+	_ = nc.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer func() {
+		_ = nc.SetDeadline(time.Time{})
+	}()
+	session, err := negotiate(hello, limits)
+	if err != nil {
+		// let the peer know what we support so it can report it
+		reply := newHello(self.Id, limits, nil)
+		_ = writeHello(nc, &reply)
+		return nil, err
+	}
+	if len(peer.PublicKey) == 0 {
+		return nil, fmt.Errorf("%w: no identity key registered for user %s", AuthenticationFailedErr, peer.Id)
+	}
+	ephemeral, ephemeralPublic, err := newEphemeralKey()
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := sharedSecrets(
+		func() ([]byte, error) { return identity.SharedSecret(ephemeral, hello.EphemeralKey) },
+		func() ([]byte, error) { return id.SharedSecret(hello.EphemeralKey) },
+		func() ([]byte, error) { return identity.SharedSecret(ephemeral, peer.PublicKey) },
+	)
+	if err != nil {
+		return nil, err
+	}
+	challenge := make([]byte, challengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	reply := newHello(self.Id, limits, ephemeralPublic)
+	reply.Challenge = challenge
+	if err := writeHello(nc, &reply); err != nil {
+		return nil, err
+	}
+	if err := session.deriveKeys(secrets, hello, &reply, false); err != nil {
+		return nil, err
+	}
+
+	sealed, err := readFrame(nc, session.Limits.MaxFrameSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the challenge answer: %w", err)
+	}
+	answer, err := session.open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(answer, challenge) != 1 {
+		return nil, fmt.Errorf("%w: wrong challenge answer", AuthenticationFailedErr)
+	}
+	return session, nil
+}
+
+// ReadHello reads the plain text Hello frame that starts every connection.
+func ReadHello(r io.Reader) (*Hello, error) {
+	b, err := readFrame(r, maxHelloSize)
+	if err != nil {
+		return nil, err
+	}
+	var h Hello
+	if err := decodeGob(b, &h); err != nil {
+		return nil, err
+	}
+	h.raw = b
+	return &h, nil
+}
+
+func writeHello(w io.Writer, h *Hello) error {
+	b, err := encodeGob(h)
+	if err != nil {
+		return err
+	}
+	h.raw = b
+	return writeFrame(w, b, maxHelloSize)
+}
+
+// seal encrypts the payload of the next frame that we send.
+func (s *Session) seal(payload []byte) []byte {
+	nonce := counterNonce(s.sendCount)
+	s.sendCount++
+	return s.send.Seal(nil, nonce, payload, nil)
+}
+
+// overhead returns the number of bytes that sealing adds to a payload.
+func (s *Session) overhead() int {
+	return s.send.Overhead()
+}
+
+// open decrypts and authenticates the payload of the next frame that we received.
+func (s *Session) open(sealed []byte) ([]byte, error) {
+	nonce := counterNonce(s.recvCount)
+	s.recvCount++
+	payload, err := s.recv.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, AuthenticationFailedErr
+	}
+	return payload, nil
+}
+
+func newEphemeralKey() ([]byte, []byte, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return nil, nil, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return private, public, nil
+}
+
+func sharedSecrets(fns ...func() ([]byte, error)) ([]byte, error) {
+	var res []byte
+	for _, f := range fns {
+		s, err := f()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", AuthenticationFailedErr, err)
+		}
+		res = append(res, s...)
+	}
+	return res, nil
+}
+
+// deriveKeys derives one key per direction from the shared secrets and the hello frames of the initiator and of the responder.
+func (s *Session) deriveKeys(secrets []byte, initiatorHello, responderHello *Hello, initiator bool) error {
+	transcript := sha256.New()
+	transcript.Write(initiatorHello.raw)
+	transcript.Write(responderHello.raw)
+	info := append([]byte(sessionInfo), transcript.Sum(nil)...)
+	kdf := hkdf.New(sha256.New, secrets, nil, info)
+	initiatorKey := make([]byte, chacha20poly1305.KeySize)
+	responderKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(kdf, initiatorKey); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(kdf, responderKey); err != nil {
+		return err
+	}
+	initiatorAEAD, err := chacha20poly1305.New(initiatorKey)
+	if err != nil {
+		return err
+	}
+	responderAEAD, err := chacha20poly1305.New(responderKey)
+	if err != nil {
+		return err
+	}
+	if initiator {
+		s.send, s.recv = initiatorAEAD, responderAEAD
+	} else {
+		s.send, s.recv = responderAEAD, initiatorAEAD
+	}
+	return nil
+}
+
+func counterNonce(c uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], c)
+	return nonce
+}
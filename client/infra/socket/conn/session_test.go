@@ -0,0 +1,123 @@
+package conn
+
+import (
+	"errors"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/identity"
+	"net"
+	"testing"
+)
+
+func TestSession(t *testing.T) {
+	newUser := func(t *testing.T, userId string) (*identity.Identity, domain.User) {
+		id, err := identity.New()
+		if err != nil {
+			t.Fatalf("failed to generate identity: %s", err)
+		}
+		return id, domain.User{Id: userId, PublicKey: id.PublicKey()}
+	}
+	handshake := func(initiatorId *identity.Identity, initiator domain.User, responderId *identity.Identity, responder domain.User, initiatorAsSeenByResponder domain.User) (*Session, *Session, error, error) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		type result struct {
+			s   *Session
+			err error
+		}
+		accepted := make(chan result, 1)
+		go func() {
+			hello, err := ReadHello(c2)
+			if err != nil {
+				accepted <- result{err: err}
+				return
+			}
+			s, err := AcceptSession(c2, responderId, responder, initiatorAsSeenByResponder, hello, DefaultLimits)
+			accepted <- result{s: s, err: err}
+		}()
+		s1, err1 := InitiateSession(c1, initiatorId, initiator, responder, DefaultLimits)
+		r := <-accepted
+		return s1, r.s, err1, r.err
+	}
+
+	t.Run(`Given two users with known identities, 
+	When a session is established, 
+	Then the frames sealed by one party are opened by the other one`, func(t *testing.T) {
+		// Given
+		aliceId, alice := newUser(t, "alice")
+		bobId, bob := newUser(t, "bob")
+
+		// When
+		aliceSession, bobSession, err1, err2 := handshake(aliceId, alice, bobId, bob, alice)
+		if err1 != nil || err2 != nil {
+			t.Fatalf("expected no handshake errors but received %v and %v", err1, err2)
+		}
+
+		// Then
+		for _, payload := range []string{"first", "second"} {
+			opened, err := bobSession.open(aliceSession.seal([]byte(payload)))
+			if err != nil {
+				t.Fatalf("expected no error opening the frame but received %s", err)
+			}
+			if string(opened) != payload {
+				t.Fatalf("expected to open %s but got %s", payload, opened)
+			}
+		}
+		opened, err := aliceSession.open(bobSession.seal([]byte("reply")))
+		if err != nil || string(opened) != "reply" {
+			t.Fatalf("expected to open the reply but got %s and error %v", opened, err)
+		}
+		for _, s := range []*Session{aliceSession, bobSession} {
+			if s.Version != ProtocolVersion || !s.Supports(CapabilityReceipts) || !s.Supports(CapabilityGroups) {
+				t.Fatalf("expected protocol v%d with all the capabilities negotiated but got v%d with %v", ProtocolVersion, s.Version, s.Capabilities)
+			}
+		}
+	})
+
+	t.Run(`Given a peer that speaks only a newer protocol version, 
+	When a session is initiated with it, 
+	Then an incompatible peer error is returned`, func(t *testing.T) {
+		// Given
+		aliceId, alice := newUser(t, "alice")
+		_, bob := newUser(t, "bob")
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		go func() {
+			if _, err := ReadHello(c2); err != nil {
+				return
+			}
+			_ = writeHello(c2, &Hello{UserId: bob.Id, Version: ProtocolVersion + 2, MinVersion: ProtocolVersion + 1, Build: "v9.9.9"})
+		}()
+
+		// When
+		session, err := InitiateSession(c1, aliceId, alice, bob, DefaultLimits)
+
+		// Then
+		if !errors.Is(err, IncompatiblePeerErr) {
+			t.Fatalf("expected %s but received %v", IncompatiblePeerErr, err)
+		}
+		if session != nil {
+			t.Fatalf("expected no session to be established")
+		}
+	})
+
+	t.Run(`Given a peer that does not hold the identity registered for the user it claims to be, 
+	When a session is established, 
+	Then the challenge answer fails the authentication and no session is accepted`, func(t *testing.T) {
+		// Given
+		_, alice := newUser(t, "alice")
+		malloryId, _ := newUser(t, "mallory")
+		bobId, bob := newUser(t, "bob")
+
+		// When
+		_, bobSession, _, err := handshake(malloryId, alice, bobId, bob, alice)
+
+		// Then
+		if !errors.Is(err, AuthenticationFailedErr) {
+			t.Fatalf("expected %s but received %v", AuthenticationFailedErr, err)
+		}
+		if bobSession != nil {
+			t.Fatalf("expected no session to be accepted")
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/socket/conn"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	outboxMinBackoff  = time.Second
+	outboxMaxBackoff  = time.Minute
+	outboxMaxAttempts = 6
+)
+
+var peerOfflineErr = errors.New("peer is offline")
+
+// outbox keeps the messages that were not delivered yet to a specific peer and retries sending them
+// with an exponential backoff. Whenever the peer is reported online again, the queue is flushed right away.
+type outbox struct {
+	userId string
+	// minBackoff is the first wait between the retries, doubled after every failed attempt
+	minBackoff time.Duration
+
+	m     *sync.Mutex
+	queue []domain.Message
+	wake  chan struct{}
+
+	send      func(ctx context.Context, userId string, m domain.Message) error
+	setStatus func(m domain.Message, status domain.MessageStatus)
+}
+
+func newOutbox(userId string, send func(ctx context.Context, userId string, m domain.Message) error, setStatus func(m domain.Message, status domain.MessageStatus)) *outbox {
+	return &outbox{
+		userId:     userId,
+		minBackoff: outboxMinBackoff,
+
+		m:    &sync.Mutex{},
+		wake: make(chan struct{}, 1),
+
+		send:      send,
+		setStatus: setStatus,
+	}
+}
+
+// enqueue adds the message at the end of the queue and wakes up the delivery loop.
+func (o *outbox) enqueue(m domain.Message) {
+	o.m.Lock()
+	o.queue = append(o.queue, m)
+	o.m.Unlock()
+	o.flush()
+}
+
+// flush wakes up the delivery loop so the queued messages are retried without waiting for the backoff.
+func (o *outbox) flush() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the queued messages in order until the context is done.
+func (o *outbox) run(ctx context.Context) {
+	backoff := o.minBackoff
+	var attempts int
+	for {
+		m, ok := o.peek()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-o.wake:
+				continue
+			}
+		}
+
+		err := o.send(ctx, o.userId, m)
+		if err == nil {
+			o.pop()
+			o.setStatus(m, domain.MessageStatusSent)
+			backoff = o.minBackoff
+			attempts = 0
+			continue
+		}
+
+		if errors.Is(err, conn.IncompatiblePeerErr) || errors.Is(err, conn.UnsupportedByPeerErr) {
+			// retrying does not help as long as the peer is running the same client
+			log.Printf("giving up delivering message %s to user %s: %s", m.Id, o.userId, err)
+			o.pop()
+			o.setStatus(m, domain.MessageStatusFailed)
+			continue
+		}
+
+		var wait <-chan time.Time
+		if !errors.Is(err, peerOfflineErr) && !errors.Is(err, conn.DisconnectedErr) {
+			attempts++
+			log.Printf("failed to deliver message %s to user %s (attempt %d): %s", m.Id, o.userId, attempts, err)
+			if attempts == outboxMaxAttempts {
+				// it's moved aside so the messages queued after it are not blocked, it's queued again on the next start
+				log.Printf("giving up delivering message %s to user %s after %d attempts", m.Id, o.userId, attempts)
+				o.pop()
+				o.setStatus(m, domain.MessageStatusFailed)
+				backoff = o.minBackoff
+				attempts = 0
+				continue
+			}
+			wait = time.After(backoff)
+			backoff *= 2
+			if backoff > outboxMaxBackoff {
+				backoff = outboxMaxBackoff
+			}
+		}
+		// when the peer is offline or the connection is reconnecting there is no point in retrying until it is reported back
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+			backoff = o.minBackoff
+			attempts = 0
+		case <-wait:
+		}
+	}
+}
+
+func (o *outbox) peek() (domain.Message, bool) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	if len(o.queue) == 0 {
+		return domain.Message{}, false
+	}
+	return o.queue[0], true
+}
+
+func (o *outbox) pop() {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.queue = o.queue[1:]
+}
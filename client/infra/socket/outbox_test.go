@@ -0,0 +1,106 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"github.com/yottta/chat/client/domain"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOutbox(t *testing.T) {
+	t.Run(`Given an outbox for an offline peer, 
+	When the peer comes back online and the outbox is flushed, 
+	Then the queued messages are sent in order and marked as sent`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var online atomic.Bool
+		sent := make(chan string, 2)
+		statuses := make(chan domain.MessageStatus, 2)
+		o := newOutbox("user1",
+			func(ctx context.Context, userId string, m domain.Message) error {
+				if !online.Load() {
+					return peerOfflineErr
+				}
+				sent <- m.Id
+				return nil
+			},
+			func(m domain.Message, status domain.MessageStatus) {
+				statuses <- status
+			},
+		)
+		go o.run(ctx)
+		o.enqueue(domain.Message{Id: "1"})
+		o.enqueue(domain.Message{Id: "2"})
+
+		select {
+		case id := <-sent:
+			t.Fatalf("expected no message to be sent while the peer is offline but %s was sent", id)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		// When
+		online.Store(true)
+		o.flush()
+
+		// Then
+		for _, expected := range []string{"1", "2"} {
+			select {
+			case id := <-sent:
+				if id != expected {
+					t.Fatalf("expected message %s to be sent but got %s", expected, id)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("expected message %s to be sent", expected)
+			}
+			if status := <-statuses; status != domain.MessageStatusSent {
+				t.Fatalf("expected the message status to be %s but got %s", domain.MessageStatusSent, status)
+			}
+		}
+	})
+
+	t.Run(`Given an outbox for an online peer that fails to receive the first message, 
+	When the message fails for the maximum number of attempts, 
+	Then it's marked as failed and the messages queued after it are sent`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sent := make(chan string, 1)
+		statuses := make(chan string, 2)
+		o := newOutbox("user1",
+			func(ctx context.Context, userId string, m domain.Message) error {
+				if m.Id == "1" {
+					return errors.New("write failed")
+				}
+				sent <- m.Id
+				return nil
+			},
+			func(m domain.Message, status domain.MessageStatus) {
+				statuses <- m.Id + ":" + string(status)
+			},
+		)
+		o.minBackoff = time.Millisecond
+		go o.run(ctx)
+
+		// When
+		o.enqueue(domain.Message{Id: "1"})
+		o.enqueue(domain.Message{Id: "2"})
+
+		// Then
+		select {
+		case id := <-sent:
+			if id != "2" {
+				t.Fatalf("expected message 2 to be sent but got %s", id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected message 2 to be sent")
+		}
+		for _, expected := range []string{"1:" + string(domain.MessageStatusFailed), "2:" + string(domain.MessageStatusSent)} {
+			if status := <-statuses; status != expected {
+				t.Fatalf("expected the status %s but got %s", expected, status)
+			}
+		}
+	})
+}
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"github.com/yottta/chat/client/domain"
 	"github.com/yottta/chat/client/infra/data"
+	"github.com/yottta/chat/client/infra/identity"
 	"github.com/yottta/chat/client/infra/socket/conn"
 	"log"
 	"net"
+	"os"
 	"strconv"
 	"sync"
 	"syscall"
@@ -22,42 +24,120 @@ type Socket interface {
 	Listen(ctx context.Context) error
 	AllocatedPort() int
 	LocalIP() string
-	RegisterStore(store data.Store)
+	RegisterStore(ctx context.Context, store data.Store)
+	MaxMessageLen() int
+	Latency(userId string) (time.Duration, bool)
+}
+
+// Config groups the settings of the socket:
+// * Limits: advertised to the other users, they bound the size of the frames and of the messages exchanged with them.
+// * DownloadDir: the directory where the files received from the other users are saved.
+// * Heartbeat: how often the other users are pinged to detect the dead connections and to measure the latency.
+type Config struct {
+	Limits      conn.Limits
+	DownloadDir string
+	Heartbeat   conn.Heartbeat
 }
 
 type socket struct {
-	port  int
-	ip    string
-	store data.Store
+	port      int
+	ip        string
+	id        *identity.Identity
+	limits    conn.Limits
+	heartbeat conn.Heartbeat
+	store     data.Store
 
 	cm          *sync.Mutex
 	connections map[string]conn.Conn
+
+	om       *sync.Mutex
+	outboxes map[string]*outbox
+
+	// incompatible holds the users already reported as incompatible, so the chat is not flooded on every retry
+	im           *sync.Mutex
+	incompatible map[string]bool
+
+	transfers *transfers
 }
 
-func NewSocket() (Socket, error) {
+// NewSocket creates the socket service. The given identity is used to authenticate and encrypt the connections with the other users.
+// Check Config for the rest of the settings.
+func NewSocket(id *identity.Identity, cfg Config) (Socket, error) {
 	ip, err := findIp()
 	if err != nil {
 		return nil, err
 	}
+	if err := os.MkdirAll(cfg.DownloadDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create the download directory: %w", err)
+	}
 	return &socket{
-		ip: ip,
+		ip:        ip,
+		id:        id,
+		limits:    cfg.Limits,
+		heartbeat: cfg.Heartbeat,
 
 		cm:          &sync.Mutex{},
 		connections: map[string]conn.Conn{},
+
+		om:       &sync.Mutex{},
+		outboxes: map[string]*outbox{},
+
+		im:           &sync.Mutex{},
+		incompatible: map[string]bool{},
+
+		transfers: newTransfers(cfg.DownloadDir),
 	}, nil
 }
 
-func (s *socket) RegisterStore(store data.Store) {
+// RegisterStore binds the socket to the store. Every message of the current user added to the store is queued to be sent
+// to the other users of the chat. The messages of the current user that are still pending in the store are queued again.
+func (s *socket) RegisterStore(ctx context.Context, store data.Store) {
 	s.store = store
+	s.restorePendingMessages(ctx)
 	s.store.RegisterMessageHandler(func(ctx context.Context, m domain.Message) {
-		if m.UserId != s.store.CurrentUser().Id {
+		if m.UserId != s.store.CurrentUser().Id || m.ErrorMessage {
 			return
 		}
 		s.handleOutgoingMessages(ctx, m)
 	})
+	s.store.RegisterMessageUpdateHandler(func(ctx context.Context, m domain.Message) {
+		if m.UserId == s.store.CurrentUser().Id || m.ErrorMessage {
+			return
+		}
+		if m.Kind == domain.MessageKindFile {
+			s.handleFileUpdate(ctx, m)
+		}
+		if m.Status == domain.MessageStatusRead {
+			s.sendReadReceipt(ctx, m)
+		}
+	})
+	// the chat events are relevant only while they are fresh, so the ones piling up behind a slow connection are dropped
+	s.store.RegisterChatEventHandler(func(ctx context.Context, e domain.ChatEvent) {
+		if e.UserId != s.store.CurrentUser().Id {
+			return
+		}
+		s.sendChatEvent(ctx, e)
+	}, data.WithQueueLimit(chatEventsQueueLimit))
+	s.store.RegisterChatHandler(func(ctx context.Context, chatId string) {
+		chat, err := s.store.GetChat(chatId)
+		if err != nil || chat.Offline || chat.Group || len(chat.Users) != 1 {
+			return
+		}
+		// the user of a direct chat is online so the messages and the files waiting for it can be sent right away
+		s.resumeDownloads(ctx, chat.Users[0].Id)
+		s.om.Lock()
+		defer s.om.Unlock()
+		if o, ok := s.outboxes[chat.Users[0].Id]; ok {
+			o.flush()
+		}
+	})
 }
 
-const portSeed = 1000
+const (
+	portSeed = 1000
+	// chatEventsQueueLimit bounds the chat events of the current user waiting to be sent to the other users
+	chatEventsQueueLimit = 16
+)
 
 func (s *socket) listenOnAvailablePort() (net.Listener, int, error) {
 	for i := portSeed; i < 65535; i++ {
@@ -114,89 +194,227 @@ func (s *socket) AllocatedPort() int {
 	return s.port
 }
 
+// handleNewConn authenticates the peer that opened the connection before accepting it.
+// The peer needs to prove that it holds the identity key registered in the directory for the user it claims to be.
+// The connections failing this are dropped without touching the store.
+// When we already have a connection with the peer, the new socket connection is handed to it instead of opening a new one.
 func (s *socket) handleNewConn(ctx context.Context, establishedConn net.Conn) {
+	remoteAddr := establishedConn.RemoteAddr().String()
+	reject := func(format string, args ...any) {
+		_ = establishedConn.Close()
+		log.Printf("rejected connection from %s: %s", remoteAddr, fmt.Sprintf(format, args...))
+	}
 	_ = establishedConn.SetReadDeadline(time.Now().Add(5 * time.Second))
 
-	m, err := conn.ReadNetworkMessage(establishedConn)
+	hello, err := conn.ReadHello(establishedConn)
 	if err != nil {
-		fmt.Printf("error reading network message: %s", err)
+		reject("error reading the hello message: %s", err)
 		return
 	}
 	_ = establishedConn.SetReadDeadline(time.Time{})
 
-	chat, err := s.store.GetChat(m.ChatId)
+	chat, err := s.store.DirectChat(hello.UserId)
 	if err != nil {
-		_ = establishedConn.Close()
-		log.Printf("failed to ack the connection as the chat id received is not found in the store. received %s", m.ChatId)
+		reject("the user id received is not known. received %s", hello.UserId)
 		return
 	}
-	user, err := chat.GetUser(m.UserId)
+	user := &chat.Users[0]
+	session, err := conn.AcceptSession(establishedConn, s.id, s.store.CurrentUser(), *user, hello, s.limits)
 	if err != nil {
-		_ = establishedConn.Close()
-		log.Printf("failed to ack the connection as the chat id (%s) does not contain the received user id %s", m.ChatId, m.UserId)
+		reject("failed to authenticate as user %s: %s", user.Id, err)
 		return
 	}
-	c := conn.NewConnection(
-		*user,
-		*chat,
-		establishedConn,
-		s.removeConn,
-		addReceivedMessageToStore(s.store),
-	)
+	t := conn.Transport{Conn: establishedConn, Session: session}
+
+	s.cm.Lock()
+	defer s.cm.Unlock()
+	if c, ok := s.connections[user.Id]; ok {
+		err := c.Adopt(t)
+		if !errors.Is(err, conn.ClosedErr) {
+			if err != nil {
+				log.Printf("connection from %s not used for writing: %s", remoteAddr, err)
+			}
+			return
+		}
+	}
+	c := conn.NewConnection(s.store.CurrentUser().Id, *user, t, s.dialer(user.Id), s.heartbeat, s.connCallbacks(ctx))
+	s.storeConnNoLock(user.Id, c)
 	go c.Start(ctx)
-	s.storeConn(user.Id, c)
-	if err := s.store.AddChatLine(domain.Message{
-		ChatId: m.ChatId,
-		UserId: m.UserId,
-		Text:   m.Message,
-		At:     m.At,
-	}); err != nil {
-		log.Printf("failed to add the chat line to the store for user %s", user.Id)
+}
+
+// restorePendingMessages queues again the messages of the current user that were not delivered yet.
+func (s *socket) restorePendingMessages(ctx context.Context) {
+	cu := s.store.CurrentUser()
+	for _, chat := range s.store.GetChats() {
+		for _, m := range chat.Content {
+			if m.UserId != cu.Id || m.ErrorMessage {
+				continue
+			}
+			if m.Status != domain.MessageStatusPending && m.Status != domain.MessageStatusFailed {
+				continue
+			}
+			for _, u := range chat.GetOtherUsers() {
+				s.getOutbox(ctx, u.Id).enqueue(m)
+			}
+		}
 	}
 }
 
+// handleOutgoingMessages queues the message in the outbox of every other user of the chat.
 func (s *socket) handleOutgoingMessages(ctx context.Context, msg domain.Message) {
-	conns, err := s.getConns(ctx, msg.ChatId)
+	chat, err := s.store.GetChat(msg.ChatId)
 	if err != nil {
 		log.Printf("failed to send message '%s': %s", msg.Text, err)
 		return
 	}
-	for _, c := range conns {
-		c.SendMessage(msg)
+	for _, u := range chat.GetOtherUsers() {
+		s.getOutbox(ctx, u.Id).enqueue(msg)
 	}
 }
 
-func (s *socket) getConns(ctx context.Context, chatId string) ([]conn.Conn, error) {
-	chat, err := s.store.GetChat(chatId)
+// getOutbox returns the outbox of the given user, creating and starting it if needed.
+func (s *socket) getOutbox(ctx context.Context, userId string) *outbox {
+	s.om.Lock()
+	defer s.om.Unlock()
+	o, ok := s.outboxes[userId]
+	if !ok {
+		o = newOutbox(userId, s.sendToUser, s.setMessageStatus)
+		s.outboxes[userId] = o
+		go o.run(ctx)
+	}
+	return o
+}
+
+// sendToUser writes the message on the connection with the given user, opening it if there is none.
+// The user is considered offline when its direct chat is offline or when the directory did not list it yet.
+// The messages of a group chat are refused with conn.UnsupportedByPeerErr when the user did not negotiate conn.CapabilityGroups.
+// A text message is sent as it is in the store, since it could have been edited or deleted while waiting in the outbox.
+// A deleted one is not sent at all.
+func (s *socket) sendToUser(ctx context.Context, userId string, m domain.Message) error {
+	chat, err := s.store.DirectChat(userId)
+	if err != nil || chat.Offline {
+		return peerOfflineErr
+	}
+	if m.Kind == domain.MessageKindText {
+		m = s.latestVersion(m)
+		if m.Deleted {
+			return nil
+		}
+	}
+	c, err := s.getConn(ctx, chat.Users[0])
+	if err != nil {
+		return err
+	}
+	if m.ChatId != chat.Id && !c.Supports(conn.CapabilityGroups) {
+		return fmt.Errorf("%w: %s", conn.UnsupportedByPeerErr, conn.CapabilityGroups)
+	}
+	return c.SendMessage(m)
+}
+
+// latestVersion returns the message as it is in the store or the given one when it's not found.
+func (s *socket) latestVersion(m domain.Message) domain.Message {
+	latest, err := s.store.GetMessage(m.ChatId, m.Id)
+	if err != nil {
+		return m
+	}
+	return *latest
+}
+
+// getConn returns the connection with the given user, opening it if there is none.
+// The connection is returned also while it's reconnecting, in which case writing on it fails with conn.DisconnectedErr.
+// The dial is done without holding the connections, so the other users are not waiting for it. In case a connection
+// with the user was stored meanwhile, that one is kept and the new socket connection is closed.
+func (s *socket) getConn(ctx context.Context, user domain.User) (conn.Conn, error) {
+	s.cm.Lock()
+	c, ok := s.connections[user.Id]
+	s.cm.Unlock()
+	if ok {
+		return c, nil
+	}
+	t, err := s.dial(user)
 	if err != nil {
 		return nil, err
 	}
-	var res []conn.Conn
-	users := chat.GetOtherUsers()
 	s.cm.Lock()
-	for _, u := range users {
-		c, ok := s.connections[u.Id]
-		if !ok {
-			c = conn.NewConnection(u, *chat, nil, s.removeConn, addReceivedMessageToStore(s.store))
-			s.storeConnNoLock(u.Id, c)
-			go c.Start(ctx)
+	defer s.cm.Unlock()
+	if c, ok := s.connections[user.Id]; ok {
+		_ = t.Conn.Close()
+		return c, nil
+	}
+	c = conn.NewConnection(s.store.CurrentUser().Id, user, t, s.dialer(user.Id), s.heartbeat, s.connCallbacks(ctx))
+	s.storeConnNoLock(user.Id, c)
+	go c.Start(ctx)
+	return c, nil
+}
+
+// dial opens a new socket connection with the user and establishes a session on it.
+func (s *socket) dial(user domain.User) (conn.Transport, error) {
+	nc, err := conn.Dial(user)
+	if err != nil {
+		return conn.Transport{}, err
+	}
+	session, err := conn.InitiateSession(nc, s.id, s.store.CurrentUser(), user, s.limits)
+	if err != nil {
+		_ = nc.Close()
+		if errors.Is(err, conn.IncompatiblePeerErr) {
+			s.reportIncompatible(user, err)
 		}
-		res = append(res, c)
+		return conn.Transport{}, fmt.Errorf("failed to establish a secure session with user %s: %w", user.Id, err)
 	}
-	s.cm.Unlock()
-	return res, nil
+	s.im.Lock()
+	delete(s.incompatible, user.Id)
+	s.im.Unlock()
+	return conn.Transport{Conn: nc, Session: session, Initiated: true}, nil
 }
 
-func (s *socket) storeConn(userId string, conn conn.Conn) {
-	s.cm.Lock()
-	defer s.cm.Unlock()
-	chatConn, ok := s.connections[userId]
-	if ok {
-		if err := chatConn.Close(); err != nil {
-			log.Printf("failed to close the already existing connection: %s", err)
+// dialer returns the conn.Dialer used by the connection with the given user to reconnect.
+// The details of the user are taken from the store every time since the user could have changed its address meanwhile.
+func (s *socket) dialer(userId string) conn.Dialer {
+	return func(ctx context.Context) (conn.Transport, error) {
+		chat, err := s.store.DirectChat(userId)
+		if err != nil || chat.Offline {
+			return conn.Transport{}, peerOfflineErr
 		}
+		return s.dial(chat.Users[0])
+	}
+}
+
+// isOnline returns true while the user is listed by the directory.
+func (s *socket) isOnline(u domain.User) bool {
+	chat, err := s.store.DirectChat(u.Id)
+	return err == nil && !chat.Offline
+}
+
+// reportIncompatible adds a line in the direct chat with the user explaining why we cannot talk with it.
+// The user is reported only once until a session is established with it again.
+func (s *socket) reportIncompatible(u domain.User, err error) {
+	s.im.Lock()
+	reported := s.incompatible[u.Id]
+	s.incompatible[u.Id] = true
+	s.im.Unlock()
+	if reported {
+		return
+	}
+	chat, chatErr := s.store.DirectChat(u.Id)
+	if chatErr != nil {
+		return
+	}
+	if err := s.store.AddChatLine(domain.Message{
+		ChatId:       chat.Id,
+		UserId:       u.Id,
+		UserName:     u.Name,
+		Text:         fmt.Sprintf("Incompatible peer, please upgrade one of the clients (%s)", err),
+		At:           time.Now(),
+		ErrorMessage: true,
+	}); err != nil {
+		log.Printf("failed to add the incompatible peer chat line to the store for user %s and chat %s", u.Id, chat.Id)
+	}
+}
+
+func (s *socket) setMessageStatus(m domain.Message, status domain.MessageStatus) {
+	if err := s.store.SetMessageStatus(m.ChatId, m.Id, status); err != nil {
+		log.Printf("failed to set the status of message %s to %s: %s", m.Id, status, err)
 	}
-	s.connections[userId] = conn
 }
 
 func (s *socket) storeConnNoLock(userId string, conn conn.Conn) {
@@ -209,26 +427,76 @@ func (s *socket) storeConnNoLock(userId string, conn conn.Conn) {
 	s.connections[userId] = conn
 }
 
-func (s *socket) removeConn(u domain.User, c domain.Chat) {
+func (s *socket) removeConn(closed conn.Conn, u domain.User, closeErr error) {
 	s.cm.Lock()
 	defer s.cm.Unlock()
-	chatConn, ok := s.connections[u.Id]
-	if ok {
-		if err := chatConn.Close(); err != nil {
-			log.Printf("failed to close the already existing connection: %s", err)
-		}
+	// the connection could have been already replaced by a newer one so nothing to clean in that case
+	if userConn, ok := s.connections[u.Id]; !ok || userConn != closed {
+		return
 	}
 	delete(s.connections, u.Id)
+
+	chat, err := s.store.DirectChat(u.Id)
+	if err != nil {
+		return
+	}
+	text := "Disconnected"
+	if errors.Is(closeErr, conn.AuthenticationFailedErr) {
+		text = "A message failed the authentication and was dropped"
+	}
+	s.addConnectionLine(chat.Id, u, text)
+}
+
+// handleReconnecting lets the user know that the connection was lost but it's trying to connect again.
+func (s *socket) handleReconnecting(c conn.Conn, u domain.User, err error) {
+	chat, chatErr := s.store.DirectChat(u.Id)
+	if chatErr != nil {
+		return
+	}
+	s.addConnectionLine(chat.Id, u, "Reconnecting…")
+}
+
+// handleReconnected sends right away what was waiting for the user while reconnecting.
+func (s *socket) handleReconnected(ctx context.Context, u domain.User) {
+	if chat, err := s.store.DirectChat(u.Id); err == nil {
+		s.addConnectionLine(chat.Id, u, "Reconnected")
+	}
+	s.resumeDownloads(ctx, u.Id)
+	s.om.Lock()
+	defer s.om.Unlock()
+	if o, ok := s.outboxes[u.Id]; ok {
+		o.flush()
+	}
+}
+
+func (s *socket) addConnectionLine(chatId string, u domain.User, text string) {
 	if err := s.store.AddChatLine(domain.Message{
-		ChatId:       c.Id,
+		ChatId:       chatId,
 		UserId:       u.Id,
 		UserName:     u.Name,
-		Text:         "Disconnected",
+		Text:         text,
 		At:           time.Now(),
 		ErrorMessage: true,
 	}); err != nil {
-		log.Printf("failed to add the disconnected chat line to the store for user %s and chat %s", u.Id, c.Id)
+		log.Printf("failed to add the %q chat line to the store for user %s and chat %s", text, u.Id, chatId)
+	}
+}
+
+// MaxMessageLen returns the length of the longest message text that fits in the limits of the socket.
+func (s *socket) MaxMessageLen() int {
+	return s.limits.MaxTextLen()
+}
+
+// Latency returns the round-trip time to the given user, as measured by the heartbeats of the connection with it.
+// It returns false when there is no connection with the user or nothing was measured yet.
+func (s *socket) Latency(userId string) (time.Duration, bool) {
+	s.cm.Lock()
+	c, ok := s.connections[userId]
+	s.cm.Unlock()
+	if !ok {
+		return 0, false
 	}
+	return c.Latency()
 }
 
 func (s *socket) LocalIP() string {
@@ -251,10 +519,113 @@ func findIp() (string, error) {
 	return "", fmt.Errorf("could not figure out the IP of your machine")
 }
 
-func addReceivedMessageToStore(store data.Store) func(m domain.Message) {
-	return func(m domain.Message) {
-		if err := store.AddChatLine(m); err != nil {
-			log.Printf("error adding chat line to store: %s", err)
+func (s *socket) connCallbacks(ctx context.Context) conn.Callbacks {
+	return conn.Callbacks{
+		OnClose:        s.removeConn,
+		OnReconnecting: s.handleReconnecting,
+		OnReconnected: func(c conn.Conn, u domain.User) {
+			s.handleReconnected(ctx, u)
+		},
+		KeepAlive: s.isOnline,
+		OnMessage: s.store.AddChatLine,
+		OnReceipt: s.handleReceipt,
+		OnFileEvent: func(e conn.FileEvent) {
+			s.handleFileEvent(ctx, e)
+		},
+		OnChatEvent: s.handleChatEvent,
+	}
+}
+
+// handleReceipt applies on our message the status reported by a member of the chat.
+// Only the receipts of the other members of the chat about the messages of the current user are applied, so a member
+// cannot change the status of the messages of anybody else.
+// The receipts of the group chats are best effort: the status is not tracked for each member, so a group message becomes
+// domain.MessageStatusDelivered once any member received it and it's never marked as read.
+func (s *socket) handleReceipt(r conn.Receipt) {
+	if r.Status != domain.MessageStatusDelivered && r.Status != domain.MessageStatusRead {
+		log.Printf("ignoring receipt with unexpected status %s from user %s", r.Status, r.UserId)
+		return
+	}
+	chat, err := s.store.GetChat(r.ChatId)
+	if err != nil {
+		log.Printf("ignoring receipt for unknown chat %s from user %s", r.ChatId, r.UserId)
+		return
+	}
+	if !isRecipient(*chat, r.UserId) {
+		log.Printf("ignoring receipt for chat %s from user %s that is not a member", r.ChatId, r.UserId)
+		return
+	}
+	m, err := s.store.GetMessage(r.ChatId, r.MessageId)
+	if err != nil {
+		log.Printf("ignoring receipt for unknown message %s from user %s", r.MessageId, r.UserId)
+		return
+	}
+	if m.UserId != s.store.CurrentUser().Id || m.ErrorMessage {
+		log.Printf("ignoring receipt for message %s from user %s since it's not a message that we sent", r.MessageId, r.UserId)
+		return
+	}
+	if chat.Group {
+		r.Status = domain.MessageStatusDelivered
+	}
+	if err := s.store.SetMessageStatus(r.ChatId, r.MessageId, r.Status); err != nil {
+		log.Printf("failed to apply the receipt of message %s: %s", r.MessageId, err)
+	}
+}
+
+// isRecipient returns true when the user is one of the other members of the chat, the ones receiving our messages.
+func isRecipient(chat domain.Chat, userId string) bool {
+	for _, u := range chat.GetOtherUsers() {
+		if u.Id == userId {
+			return true
 		}
 	}
+	return false
+}
+
+// sendReadReceipt lets the author of the message know that we read it. This is best effort, so in case the author
+// is not reachable, the receipt is discarded. The messages of the group chats are never marked as read, check handleReceipt,
+// so no receipt is sent for them.
+func (s *socket) sendReadReceipt(ctx context.Context, m domain.Message) {
+	chat, err := s.store.DirectChat(m.UserId)
+	if err != nil || chat.Offline || chat.Id != m.ChatId {
+		return
+	}
+	c, err := s.getConn(ctx, chat.Users[0])
+	if err != nil {
+		log.Printf("failed to send the read receipt of message %s: %s", m.Id, err)
+		return
+	}
+	if err := c.SendReceipt(conn.Receipt{ChatId: m.ChatId, MessageId: m.Id, Status: domain.MessageStatusRead}); err != nil {
+		log.Printf("failed to send the read receipt of message %s: %s", m.Id, err)
+	}
+}
+
+// sendChatEvent writes the chat event of the current user to the online users of the chat.
+// The chat events are not queued like the messages, so the ones that cannot be written right away are dropped.
+func (s *socket) sendChatEvent(ctx context.Context, e domain.ChatEvent) {
+	chat, err := s.store.GetChat(e.ChatId)
+	if err != nil {
+		return
+	}
+	for _, u := range chat.GetOtherUsers() {
+		direct, err := s.store.DirectChat(u.Id)
+		if err != nil || direct.Offline {
+			continue
+		}
+		c, err := s.getConn(ctx, direct.Users[0])
+		if err != nil {
+			continue
+		}
+		err = c.SendChatEvent(e)
+		if err != nil && !errors.Is(err, conn.UnsupportedByPeerErr) && !errors.Is(err, conn.DisconnectedErr) {
+			log.Printf("failed to send the %s event to user %s: %s", e.Type, u.Id, err)
+		}
+	}
+}
+
+// handleChatEvent passes the chat event sent by another user to the store.
+func (s *socket) handleChatEvent(e domain.ChatEvent) {
+	if err := s.store.PublishChatEvent(e); err != nil {
+		log.Printf("ignoring the %s event from user %s: %s", e.Type, e.UserId, err)
+	}
 }
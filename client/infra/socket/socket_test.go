@@ -0,0 +1,154 @@
+package socket
+
+import (
+	"context"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/data"
+	"github.com/yottta/chat/client/infra/data/inmemory"
+	"github.com/yottta/chat/client/infra/identity"
+	"github.com/yottta/chat/client/infra/socket/conn"
+	"testing"
+	"time"
+)
+
+var testUser2 = domain.User{Id: "user2", Name: "user2"}
+
+func TestHandleReceipt(t *testing.T) {
+	t.Run(`Given a message of the current user in a direct chat and one in a group chat,
+	When a member reports each of them as read,
+	Then the direct message is read and the group message is only delivered`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s, st, direct, _ := newTestSocket(t, ctx, t.TempDir())
+		if err := st.UpsertUser(testUser2); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		group, err := st.CreateGroupChat("team", []domain.User{testUser1, testUser2})
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		for _, m := range []domain.Message{
+			{Id: "d1", ChatId: direct.Id, UserId: currentUser.Id, Text: "hi", At: time.Now()},
+			{Id: "g1", ChatId: group.Id, UserId: currentUser.Id, Text: "hi all", At: time.Now()},
+		} {
+			if err := st.AddChatLine(m); err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+
+		// When
+		s.handleReceipt(conn.Receipt{ChatId: direct.Id, MessageId: "d1", UserId: testUser1.Id, Status: domain.MessageStatusRead})
+		s.handleReceipt(conn.Receipt{ChatId: group.Id, MessageId: "g1", UserId: testUser1.Id, Status: domain.MessageStatusRead})
+
+		// Then
+		for chatId, expected := range map[string]struct {
+			messageId string
+			status    domain.MessageStatus
+		}{
+			direct.Id: {messageId: "d1", status: domain.MessageStatusRead},
+			group.Id:  {messageId: "g1", status: domain.MessageStatusDelivered},
+		} {
+			m, err := st.GetMessage(chatId, expected.messageId)
+			if err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+			if m.Status != expected.status {
+				t.Fatalf("expected message %s to be %s but it is %s", m.Id, expected.status, m.Status)
+			}
+		}
+	})
+}
+
+func TestHandleReceipt_Spoofed(t *testing.T) {
+	t.Run(`Given a direct chat with a message of the other user,
+	When the other user reports its own message as read,
+	Then the status of the message does not change`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s, st, direct, _ := newTestSocket(t, ctx, t.TempDir())
+		if err := st.AddChatLine(domain.Message{Id: "d1", ChatId: direct.Id, UserId: testUser1.Id, Text: "hi", At: time.Now()}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// When
+		s.handleReceipt(conn.Receipt{ChatId: direct.Id, MessageId: "d1", UserId: testUser1.Id, Status: domain.MessageStatusRead})
+
+		// Then
+		m, err := st.GetMessage(direct.Id, "d1")
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if m.Status != domain.MessageStatusDelivered {
+			t.Fatalf("expected message %s to stay %s but it is %s", m.Id, domain.MessageStatusDelivered, m.Status)
+		}
+	})
+}
+
+// newListeningSocket returns a socket listening for connections, measuring the latency with a short heartbeat, together
+// with the user it stands for.
+func newListeningSocket(t *testing.T, ctx context.Context, name string) (*socket, domain.User) {
+	id, err := identity.New()
+	if err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	heartbeat := conn.Heartbeat{Interval: 20 * time.Millisecond, Timeout: time.Second}
+	so, err := NewSocket(id, Config{Limits: conn.DefaultLimits, DownloadDir: t.TempDir(), Heartbeat: heartbeat})
+	if err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	if err := so.Listen(ctx); err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	u := domain.User{Id: id.Fingerprint(), Name: name, Address: "127.0.0.1", Port: so.AllocatedPort(), PublicKey: id.PublicKey()}
+	return so.(*socket), u
+}
+
+// registerStore binds the socket to a store of the given user, knowing the other one as online.
+func registerStore(t *testing.T, ctx context.Context, s *socket, current, other domain.User) data.Store {
+	st := inmemory.NewStore(ctx, current, 1000)
+	if err := st.RefreshUsers([]domain.User{other}); err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	s.RegisterStore(ctx, st)
+	return st
+}
+
+func TestLatency(t *testing.T) {
+	t.Run(`Given two sockets that know each other,
+	When one of them connects to the other and the heartbeats are exchanged,
+	Then the latency with the other user is reported`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		alice, aliceUser := newListeningSocket(t, ctx, "alice")
+		bob, bobUser := newListeningSocket(t, ctx, "bob")
+		registerStore(t, ctx, alice, aliceUser, bobUser)
+		registerStore(t, ctx, bob, bobUser, aliceUser)
+		if _, ok := alice.Latency(bobUser.Id); ok {
+			t.Fatalf("expected no latency before connecting")
+		}
+
+		// When
+		if _, err := alice.getConn(ctx, bobUser); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// Then
+		deadline := time.After(3 * time.Second)
+		for {
+			if latency, ok := alice.Latency(bobUser.Id); ok {
+				if latency <= 0 || latency > time.Second {
+					t.Fatalf("expected a positive latency under a second but measured %s", latency)
+				}
+				return
+			}
+			select {
+			case <-deadline:
+				t.Fatalf("expected the latency to be measured")
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	})
+}
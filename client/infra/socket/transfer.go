@@ -0,0 +1,467 @@
+package socket
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/socket/conn"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileChunkSize = 16 * 1024
+	// fileProgressInterval is the minimum time between two saves of the progress of a transfer into the store
+	fileProgressInterval = 250 * time.Millisecond
+)
+
+var fileChecksumErr = errors.New("checksum mismatch")
+
+// transfers holds the files that are moving between us and the other users.
+// Only the receiver of a file keeps state between connections: it asks for the content starting with what it already has,
+// so a transfer interrupted by a dropped connection is resumed by asking again once the sender is reachable.
+type transfers struct {
+	downloadDir string
+
+	m        *sync.Mutex
+	incoming map[string]*incomingFile
+	outgoing map[string]*outgoingFile
+}
+
+// incomingFile is a file that we accepted and that is written in a partial file until it's received whole.
+type incomingFile struct {
+	chatId    string
+	messageId string
+	userId    string
+	file      domain.FileTransfer
+	part      *os.File
+	progress  *progress
+}
+
+// outgoingFile is a file that we offered and that is streamed to the receiver.
+type outgoingFile struct {
+	cancel context.CancelFunc
+}
+
+// progress tells when the progress of a transfer should be saved into the store, so the store is not flooded with updates.
+type progress struct {
+	savedAt time.Time
+}
+
+// due returns true when the progress was not saved for a while.
+func (p *progress) due() bool {
+	if time.Since(p.savedAt) < fileProgressInterval {
+		return false
+	}
+	p.savedAt = time.Now()
+	return true
+}
+
+func newTransfers(downloadDir string) *transfers {
+	return &transfers{
+		downloadDir: downloadDir,
+
+		m:        &sync.Mutex{},
+		incoming: map[string]*incomingFile{},
+		outgoing: map[string]*outgoingFile{},
+	}
+}
+
+// partPath returns the path of the partial file of the file offered by the given message.
+// The ids are chosen by the other user, so the name is their hash to keep the partial file inside the download directory.
+func (t *transfers) partPath(chatId, messageId string) string {
+	sum := sha256.Sum256([]byte(chatId + "\x00" + messageId))
+	return filepath.Join(t.downloadDir, "."+hex.EncodeToString(sum[:])+".part")
+}
+
+// handleFileUpdate reacts on the decision of the current user about a file offered by another user.
+func (s *socket) handleFileUpdate(ctx context.Context, m domain.Message) {
+	switch m.File.State {
+	case domain.FileStateAccepted:
+		s.startDownload(ctx, m)
+	case domain.FileStateDeclined:
+		if err := s.sendFileEvent(ctx, m.UserId, conn.FileEvent{Kind: conn.FileDeclined, ChatId: m.ChatId, MessageId: m.Id}); err != nil {
+			log.Printf("failed to decline the file of message %s: %s", m.Id, err)
+		}
+	}
+}
+
+// handleFileEvent handles the events sent by the other users about the files that we offered or accepted.
+func (s *socket) handleFileEvent(ctx context.Context, e conn.FileEvent) {
+	switch e.Kind {
+	case conn.FileChunk:
+		s.receiveChunk(ctx, e)
+	case conn.FileRequested:
+		s.startUpload(ctx, e)
+	case conn.FileDeclined, conn.FileCompleted:
+		m, err := s.offeredFile(e)
+		if err != nil {
+			log.Printf("ignoring %s event from user %s: %s", e.Kind, e.UserId, err)
+			return
+		}
+		f := *m.File
+		f.State = domain.FileStateDeclined
+		if e.Kind == conn.FileCompleted {
+			f.State, f.Transferred = domain.FileStateCompleted, f.Size
+		}
+		s.setFileTransfer(*m, f)
+	default:
+		log.Printf("ignoring unknown file event %s from user %s", e.Kind, e.UserId)
+	}
+}
+
+// startDownload opens the partial file of an accepted file and asks the sender for the content that is missing from it.
+// Nothing is done if the file is already downloading or if it's not accepted anymore.
+func (s *socket) startDownload(ctx context.Context, m domain.Message) {
+	t := s.transfers
+	t.m.Lock()
+	if _, ok := t.incoming[m.Id]; ok {
+		t.m.Unlock()
+		return
+	}
+	// the updates of the store are delivered asynchronously so this could be an old one
+	if current, err := s.storedMessage(m.ChatId, m.Id); err != nil || current.File.State != domain.FileStateAccepted {
+		t.m.Unlock()
+		return
+	}
+	part, err := os.OpenFile(t.partPath(m.ChatId, m.Id), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		t.m.Unlock()
+		log.Printf("failed to open the partial file of message %s: %s", m.Id, err)
+		s.failFileTransfer(m.ChatId, m.Id, *m.File)
+		return
+	}
+	in := &incomingFile{
+		chatId:    m.ChatId,
+		messageId: m.Id,
+		userId:    m.UserId,
+		file:      *m.File,
+		part:      part,
+		progress:  &progress{},
+	}
+	if info, err := part.Stat(); err == nil && info.Size() <= in.file.Size {
+		in.file.Transferred = info.Size()
+	} else {
+		_ = part.Truncate(0)
+		in.file.Transferred = 0
+	}
+	t.incoming[m.Id] = in
+	complete := in.file.Transferred == in.file.Size
+	t.m.Unlock()
+
+	if complete {
+		s.finishDownload(ctx, in)
+		return
+	}
+	s.requestFile(ctx, in)
+}
+
+// resumeDownloads asks the given user again for the files that were not received whole.
+func (s *socket) resumeDownloads(ctx context.Context, userId string) {
+	t := s.transfers
+	t.m.Lock()
+	var pending []*incomingFile
+	for _, in := range t.incoming {
+		if in.userId == userId {
+			pending = append(pending, in)
+		}
+	}
+	t.m.Unlock()
+	for _, in := range pending {
+		s.requestFile(ctx, in)
+	}
+}
+
+// requestFile asks the sender for the content of the file starting with what we already have.
+func (s *socket) requestFile(ctx context.Context, in *incomingFile) {
+	s.transfers.m.Lock()
+	offset := in.file.Transferred
+	s.transfers.m.Unlock()
+	if err := s.sendFileEvent(ctx, in.userId, conn.FileEvent{
+		Kind:      conn.FileRequested,
+		ChatId:    in.chatId,
+		MessageId: in.messageId,
+		Offset:    offset,
+	}); err != nil {
+		log.Printf("failed to request the file of message %s from offset %d: %s", in.messageId, offset, err)
+	}
+}
+
+// receiveChunk writes a chunk of a file that we accepted into its partial file.
+// The chunks that are not following what we already have are ignored and the ones with a wrong checksum are asked for again.
+func (s *socket) receiveChunk(ctx context.Context, e conn.FileEvent) {
+	t := s.transfers
+	t.m.Lock()
+	in, ok := t.incoming[e.MessageId]
+	if !ok || in.userId != e.UserId || in.chatId != e.ChatId {
+		t.m.Unlock()
+		log.Printf("ignoring chunk of unknown file %s from user %s", e.MessageId, e.UserId)
+		return
+	}
+	if e.Offset != in.file.Transferred {
+		t.m.Unlock()
+		return
+	}
+	if sum := sha256.Sum256(e.Data); !bytes.Equal(sum[:], e.Checksum) || in.file.Transferred+int64(len(e.Data)) > in.file.Size {
+		t.m.Unlock()
+		log.Printf("chunk at offset %d of file %s is corrupted, asking for it again", e.Offset, e.MessageId)
+		s.requestFile(ctx, in)
+		return
+	}
+	if _, err := in.part.WriteAt(e.Data, e.Offset); err != nil {
+		t.m.Unlock()
+		log.Printf("failed to write the partial file of message %s: %s", in.messageId, err)
+		s.abortDownload(in)
+		return
+	}
+	in.file.Transferred += int64(len(e.Data))
+	f := in.file
+	due := in.progress.due()
+	t.m.Unlock()
+
+	if f.Transferred == f.Size {
+		s.finishDownload(ctx, in)
+		return
+	}
+	if due {
+		if err := s.store.SetFileTransfer(in.chatId, in.messageId, f); err != nil {
+			log.Printf("failed to save the progress of the file of message %s: %s", in.messageId, err)
+		}
+	}
+}
+
+// abortDownload marks the file as failed and forgets about it. The partial file is removed so accepting the file
+// again starts the download from scratch.
+func (s *socket) abortDownload(in *incomingFile) {
+	_ = in.part.Close()
+	_ = os.Remove(in.part.Name())
+	s.failFileTransfer(in.chatId, in.messageId, in.file)
+	s.forgetDownload(in)
+}
+
+// forgetDownload is called only after the final state of the file is in the store, so a late update of the store
+// does not start the download again.
+func (s *socket) forgetDownload(in *incomingFile) {
+	s.transfers.m.Lock()
+	defer s.transfers.m.Unlock()
+	delete(s.transfers.incoming, in.messageId)
+}
+
+// finishDownload checks the partial file against the checksum of the offer and moves it into the download directory.
+func (s *socket) finishDownload(ctx context.Context, in *incomingFile) {
+	t := s.transfers
+	if err := verifyChecksum(in.part, in.file.Checksum); err != nil {
+		log.Printf("the file of message %s is not the one offered: %s", in.messageId, err)
+		s.abortDownload(in)
+		return
+	}
+	_ = in.part.Close()
+	path, err := availablePath(t.downloadDir, in.file.Name)
+	if err == nil {
+		err = os.Rename(in.part.Name(), path)
+	}
+	if err != nil {
+		log.Printf("failed to move the file of message %s into the download directory: %s", in.messageId, err)
+		s.abortDownload(in)
+		return
+	}
+	f := in.file
+	f.State, f.Path = domain.FileStateCompleted, path
+	if err := s.store.SetFileTransfer(in.chatId, in.messageId, f); err != nil {
+		log.Printf("failed to save the completion of the file of message %s: %s", in.messageId, err)
+	}
+	s.forgetDownload(in)
+	if err := s.sendFileEvent(ctx, in.userId, conn.FileEvent{Kind: conn.FileCompleted, ChatId: in.chatId, MessageId: in.messageId}); err != nil {
+		log.Printf("failed to acknowledge the file of message %s: %s", in.messageId, err)
+	}
+}
+
+// startUpload streams the content of a file that we offered, starting with the requested offset.
+// A previous upload of the same file is stopped since the receiver asks again only when it's not receiving it anymore.
+func (s *socket) startUpload(ctx context.Context, e conn.FileEvent) {
+	m, err := s.offeredFile(e)
+	if err != nil {
+		log.Printf("ignoring file request from user %s: %s", e.UserId, err)
+		return
+	}
+	if m.File.State == domain.FileStateDeclined || m.File.State == domain.FileStateCompleted || e.Offset < 0 || e.Offset > m.File.Size {
+		log.Printf("ignoring request for file %s at offset %d from user %s", m.Id, e.Offset, e.UserId)
+		return
+	}
+	uploadCtx, cancel := context.WithCancel(ctx)
+	out := &outgoingFile{cancel: cancel}
+	t := s.transfers
+	t.m.Lock()
+	if previous, ok := t.outgoing[m.Id]; ok {
+		previous.cancel()
+	}
+	t.outgoing[m.Id] = out
+	t.m.Unlock()
+
+	go func() {
+		defer func() {
+			cancel()
+			t.m.Lock()
+			defer t.m.Unlock()
+			// a newer upload of the same file could have already replaced this one
+			if t.outgoing[m.Id] == out {
+				delete(t.outgoing, m.Id)
+			}
+		}()
+		if err := s.upload(uploadCtx, *m, e.UserId, e.Offset); err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("failed to upload the file of message %s: %s", m.Id, err)
+		}
+	}()
+}
+
+// upload writes the chunks of the file of the given message to the receiver, starting with the offset.
+func (s *socket) upload(ctx context.Context, m domain.Message, receiverId string, offset int64) error {
+	f := *m.File
+	f.State, f.Transferred = domain.FileStateAccepted, offset
+	s.setFileTransfer(m, f)
+
+	file, err := os.Open(f.Path)
+	if err != nil {
+		s.failFileTransfer(m.ChatId, m.Id, f)
+		return err
+	}
+	defer file.Close()
+	buf := make([]byte, fileChunkSize)
+	p := &progress{savedAt: time.Now()}
+	for f.Transferred < f.Size {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := file.ReadAt(buf, f.Transferred)
+		if n == 0 && err != nil {
+			s.failFileTransfer(m.ChatId, m.Id, f)
+			return err
+		}
+		offset := f.Transferred
+		f.Transferred += int64(n)
+		// the progress is saved before writing the chunk so it cannot override the completion reported by the receiver
+		if p.due() {
+			s.setFileTransfer(m, f)
+		}
+		sum := sha256.Sum256(buf[:n])
+		if err := s.sendFileEvent(ctx, receiverId, conn.FileEvent{
+			Kind:      conn.FileChunk,
+			ChatId:    m.ChatId,
+			MessageId: m.Id,
+			Offset:    offset,
+			Data:      buf[:n],
+			Checksum:  sum[:],
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// offeredFile returns the file message that we offered and that the event is about.
+// Only the user of the direct chat in which the file was offered can send events about it.
+func (s *socket) offeredFile(e conn.FileEvent) (*domain.Message, error) {
+	chat, err := s.store.GetChat(e.ChatId)
+	if err != nil {
+		return nil, err
+	}
+	if !chat.IsDirectWith(e.UserId) {
+		return nil, fmt.Errorf("chat %s is not the direct chat with user %s", e.ChatId, e.UserId)
+	}
+	m, err := s.storedMessage(e.ChatId, e.MessageId)
+	if err != nil {
+		return nil, err
+	}
+	if m.UserId != s.store.CurrentUser().Id {
+		return nil, fmt.Errorf("message %s is not a file that we offered", m.Id)
+	}
+	return m, nil
+}
+
+// storedMessage returns the file message with the given id, as it is in the store.
+func (s *socket) storedMessage(chatId, messageId string) (*domain.Message, error) {
+	chat, err := s.store.GetChat(chatId)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(chat.Content) - 1; i >= 0; i-- {
+		m := chat.Content[i]
+		if m.Id != messageId {
+			continue
+		}
+		if m.Kind != domain.MessageKindFile || m.File == nil {
+			return nil, fmt.Errorf("message %s is not a file", m.Id)
+		}
+		return &m, nil
+	}
+	return nil, fmt.Errorf("message %s not found in chat %s", messageId, chatId)
+}
+
+// sendFileEvent writes the event on the connection with the given user, opening it if there is none.
+func (s *socket) sendFileEvent(ctx context.Context, userId string, e conn.FileEvent) error {
+	chat, err := s.store.DirectChat(userId)
+	if err != nil || chat.Offline {
+		return peerOfflineErr
+	}
+	c, err := s.getConn(ctx, chat.Users[0])
+	if err != nil {
+		return err
+	}
+	return c.SendFileEvent(e)
+}
+
+func (s *socket) setFileTransfer(m domain.Message, f domain.FileTransfer) {
+	if err := s.store.SetFileTransfer(m.ChatId, m.Id, f); err != nil {
+		log.Printf("failed to update the file of message %s: %s", m.Id, err)
+	}
+}
+
+func (s *socket) failFileTransfer(chatId, messageId string, f domain.FileTransfer) {
+	f.State = domain.FileStateFailed
+	if err := s.store.SetFileTransfer(chatId, messageId, f); err != nil {
+		log.Printf("failed to mark the file of message %s as failed: %s", messageId, err)
+	}
+}
+
+// verifyChecksum compares the SHA-256 of the whole content of the file with the expected one, hex encoded.
+func verifyChecksum(f *os.File, expected string) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, 1<<62)); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != strings.ToLower(expected) {
+		return fmt.Errorf("%w: expected %s but got %s", fileChecksumErr, expected, actual)
+	}
+	return nil
+}
+
+// availablePath returns a path in the directory for a file with the given name that does not exist yet.
+// The name offered by the other user is reduced to its base so the file cannot end up outside the directory.
+func availablePath(dir, name string) (string, error) {
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" || name == "." {
+		name = "file"
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; i < 1000; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		path := filepath.Join(dir, candidate)
+		if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("too many files named %s in %s", name, dir)
+}
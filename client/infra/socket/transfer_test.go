@@ -0,0 +1,269 @@
+package socket
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/data"
+	"github.com/yottta/chat/client/infra/data/inmemory"
+	"github.com/yottta/chat/client/infra/socket/conn"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	currentUser = domain.User{Id: "current_user_id", Name: "current_user_name"}
+	testUser1   = domain.User{Id: "user1", Name: "user1"}
+)
+
+// fileEventsConn is a connection that only records the file events written on it.
+type fileEventsConn struct {
+	conn.Conn
+	events chan conn.FileEvent
+}
+
+func (c *fileEventsConn) SendFileEvent(e conn.FileEvent) error {
+	c.events <- e
+	return nil
+}
+
+func (c *fileEventsConn) Close() error {
+	return nil
+}
+
+// next returns the next file event written on the connection.
+func (c *fileEventsConn) next(t *testing.T) conn.FileEvent {
+	select {
+	case e := <-c.events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatalf("expected a file event to be sent")
+		return conn.FileEvent{}
+	}
+}
+
+// newTestSocket returns a socket bound to a store that has the direct chat with testUser1 online, and the connection
+// with testUser1 through which the file events are sent.
+func newTestSocket(t *testing.T, ctx context.Context, downloadDir string) (*socket, data.Store, *domain.Chat, *fileEventsConn) {
+	st := inmemory.NewStore(ctx, currentUser, 1000)
+	if err := st.RefreshUsers([]domain.User{testUser1}); err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	chat, err := st.DirectChat(testUser1.Id)
+	if err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	c := &fileEventsConn{events: make(chan conn.FileEvent, 10)}
+	return &socket{
+		store:       st,
+		cm:          &sync.Mutex{},
+		connections: map[string]conn.Conn{testUser1.Id: c},
+		transfers:   newTransfers(downloadDir),
+	}, st, chat, c
+}
+
+// acceptFile adds the offer of the content by testUser1 under the given message id and accepts it.
+func acceptFile(t *testing.T, st data.Store, chatId, messageId string, content []byte) domain.Message {
+	sum := sha256.Sum256(content)
+	f := domain.FileTransfer{Name: "notes.txt", Size: int64(len(content)), Checksum: hex.EncodeToString(sum[:])}
+	if err := st.AddChatLine(domain.Message{Id: messageId, ChatId: chatId, UserId: testUser1.Id, Kind: domain.MessageKindFile, File: &f, At: time.Now()}); err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	f.State = domain.FileStateAccepted
+	if err := st.SetFileTransfer(chatId, messageId, f); err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	m, err := st.GetMessage(chatId, messageId)
+	if err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	return *m
+}
+
+// chunk returns the event carrying the content from the given offset.
+func chunk(chatId, messageId string, offset int64, content []byte) conn.FileEvent {
+	sum := sha256.Sum256(content)
+	return conn.FileEvent{Kind: conn.FileChunk, ChatId: chatId, MessageId: messageId, UserId: testUser1.Id, Offset: offset, Data: content, Checksum: sum[:]}
+}
+
+// expectCompleted checks that the file of the message was saved in the download directory with the given content.
+func expectCompleted(t *testing.T, st data.Store, chatId, messageId string, content []byte) {
+	m, err := st.GetMessage(chatId, messageId)
+	if err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	if m.File.State != domain.FileStateCompleted {
+		t.Fatalf("expected the file to be %s but it is %s", domain.FileStateCompleted, m.File.State)
+	}
+	saved, err := os.ReadFile(m.File.Path)
+	if err != nil {
+		t.Fatalf("expected to receive no error but received %s", err)
+	}
+	if !bytes.Equal(saved, content) {
+		t.Fatalf("expected the file to contain %q but it contains %q", content, saved)
+	}
+}
+
+func TestAvailablePath(t *testing.T) {
+	t.Run(`Given a download directory that already contains a file with the offered name, 
+	When a path is chosen for a name that tries to escape the directory, 
+	Then a new path inside the directory is returned`, func(t *testing.T) {
+		// Given
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "passwd"), nil, 0o600); err != nil {
+			t.Fatalf("failed to prepare the download directory: %s", err)
+		}
+
+		// When
+		path, err := availablePath(dir, "../../etc/passwd")
+
+		// Then
+		if err != nil {
+			t.Fatalf("expected no error but received %s", err)
+		}
+		if expected := filepath.Join(dir, "passwd (1)"); path != expected {
+			t.Fatalf("expected %s but got %s", expected, path)
+		}
+	})
+}
+
+func TestDownload(t *testing.T) {
+	t.Run(`Given an accepted file offered with a message id that tries to escape the download directory,
+	When the download starts,
+	Then the partial file is created inside the download directory and the file is requested from the start`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		root := t.TempDir()
+		downloadDir := filepath.Join(root, "downloads", "user")
+		if err := os.MkdirAll(downloadDir, 0o700); err != nil {
+			t.Fatalf("failed to prepare the download directory: %s", err)
+		}
+		s, st, chat, c := newTestSocket(t, ctx, downloadDir)
+		m := acceptFile(t, st, chat.Id, "/../../escape", []byte("content"))
+
+		// When
+		s.startDownload(ctx, m)
+
+		// Then
+		if e := c.next(t); e.Kind != conn.FileRequested || e.Offset != 0 {
+			t.Fatalf("expected the file to be requested from offset 0 but received %+v", e)
+		}
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if len(entries) != 1 || entries[0].Name() != "downloads" {
+			t.Fatalf("expected only the download directory in %s but found %v", root, entries)
+		}
+		if _, err := os.Stat(s.transfers.partPath(chat.Id, m.Id)); err != nil {
+			t.Fatalf("expected the partial file inside the download directory but received %s", err)
+		}
+	})
+
+	t.Run(`Given a download that started,
+	When a chunk with a wrong checksum is received,
+	Then the chunk is asked for again and the file is completed once the right one is received`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s, st, chat, c := newTestSocket(t, ctx, t.TempDir())
+		content := []byte("the content of the file")
+		m := acceptFile(t, st, chat.Id, "m1", content)
+		s.startDownload(ctx, m)
+		c.next(t)
+		corrupted := chunk(chat.Id, m.Id, 0, content)
+		corrupted.Checksum = make([]byte, sha256.Size)
+
+		// When
+		s.receiveChunk(ctx, corrupted)
+
+		// Then
+		if e := c.next(t); e.Kind != conn.FileRequested || e.Offset != 0 {
+			t.Fatalf("expected the file to be requested again from offset 0 but received %+v", e)
+		}
+		s.receiveChunk(ctx, chunk(chat.Id, m.Id, 0, content))
+		if e := c.next(t); e.Kind != conn.FileCompleted {
+			t.Fatalf("expected the file to be acknowledged but received %+v", e)
+		}
+		expectCompleted(t, st, chat.Id, m.Id, content)
+	})
+
+	t.Run(`Given a partial file holding the start of an accepted file,
+	When the download starts,
+	Then the file is requested from the end of the partial file and completed with the rest of it`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s, st, chat, c := newTestSocket(t, ctx, t.TempDir())
+		content := []byte("the content of the file")
+		m := acceptFile(t, st, chat.Id, "m1", content)
+		if err := os.WriteFile(s.transfers.partPath(chat.Id, m.Id), content[:8], 0o600); err != nil {
+			t.Fatalf("failed to prepare the partial file: %s", err)
+		}
+
+		// When
+		s.startDownload(ctx, m)
+
+		// Then
+		if e := c.next(t); e.Kind != conn.FileRequested || e.Offset != 8 {
+			t.Fatalf("expected the file to be requested from offset 8 but received %+v", e)
+		}
+		s.receiveChunk(ctx, chunk(chat.Id, m.Id, 8, content[8:]))
+		if e := c.next(t); e.Kind != conn.FileCompleted {
+			t.Fatalf("expected the file to be acknowledged but received %+v", e)
+		}
+		expectCompleted(t, st, chat.Id, m.Id, content)
+	})
+}
+
+func TestDecline(t *testing.T) {
+	t.Run(`Given a file offered by the other user,
+	When the current user declines it,
+	Then the decline is sent to the other user`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s, st, chat, c := newTestSocket(t, ctx, t.TempDir())
+		m := acceptFile(t, st, chat.Id, "m1", []byte("content"))
+		m.File.State = domain.FileStateDeclined
+
+		// When
+		s.handleFileUpdate(ctx, m)
+
+		// Then
+		if e := c.next(t); e.Kind != conn.FileDeclined || e.ChatId != chat.Id || e.MessageId != m.Id {
+			t.Fatalf("expected the file to be declined but received %+v", e)
+		}
+	})
+
+	t.Run(`Given a file offered by the current user,
+	When the other user declines it,
+	Then the file is declined in the store`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s, st, chat, _ := newTestSocket(t, ctx, t.TempDir())
+		f := domain.FileTransfer{Name: "notes.txt", Size: 7, State: domain.FileStateOffered}
+		if err := st.AddChatLine(domain.Message{Id: "m1", ChatId: chat.Id, UserId: currentUser.Id, Kind: domain.MessageKindFile, File: &f, At: time.Now()}); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// When
+		s.handleFileEvent(ctx, conn.FileEvent{Kind: conn.FileDeclined, ChatId: chat.Id, MessageId: "m1", UserId: testUser1.Id})
+
+		// Then
+		m, err := st.GetMessage(chat.Id, "m1")
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if m.File.State != domain.FileStateDeclined {
+			t.Fatalf("expected the file to be %s but it is %s", domain.FileStateDeclined, m.File.State)
+		}
+	})
+}
@@ -0,0 +1,265 @@
+package tui
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/yottta/chat/client/domain"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	UnknownCommandErr  = errors.New("unknown command")
+	NoChatSelectedErr  = errors.New("select a chat first")
+	UserNotFoundErr    = errors.New("no online user with this name")
+	AmbiguousUserErr   = errors.New("more than one online user with this name")
+	WrongCommandUseErr = errors.New("wrong command usage")
+	NoFileOfferedErr   = errors.New("no file offered in this chat")
+	NoOwnMessageErr    = errors.New("no message of yours in this chat")
+)
+
+// isCommand returns true when the text typed in the message field is a command instead of a message.
+func isCommand(txt string) bool {
+	return strings.HasPrefix(txt, "/")
+}
+
+// runCommand executes the command typed in the message field. The supported commands are:
+// * /group <name> <user> [<user>...] - creates a new group chat with the given online users
+// * /invite <user> [<user>...] - adds the given online users to the currently selected group chat, if it was created by the current user
+// * /send <path> - offers the file to the user of the currently selected direct chat
+// * /accept - accepts the latest file offered in the currently selected chat
+// * /decline - declines the latest file offered in the currently selected chat
+// * /edit <text> - replaces the text of your message selected in the chat or, if none is selected, of your latest message
+// * /delete - retracts your message selected in the chat or, if none is selected, your latest message
+// * /react [<emoji>|<shortcode>] - reacts to the message selected in the chat or, if none is selected, to the latest message. Without an emoji, your reaction is removed
+// * /passphrase - changes the passphrase that unlocks the chats saved on disk
+// * /search <query> - lists the messages from all the chats matching the query, check data.ParseSearchQuery for its syntax
+// * /export [all] <path> - writes the currently selected chat, or all the chats, to a .jsonl, .md or .html file
+// * /import <path> - adds the chats from a .jsonl export, skipping the messages that are already known
+func (h *handler) runCommand(txt string) error {
+	fields := strings.Fields(strings.TrimPrefix(txt, "/"))
+	if len(fields) == 0 {
+		return UnknownCommandErr
+	}
+	name, args := fields[0], fields[1:]
+	switch name {
+	case "group":
+		if len(args) < 2 {
+			return fmt.Errorf("%w: /group <name> <user> [<user>...]", WrongCommandUseErr)
+		}
+		users, err := h.findOnlineUsers(args[1:])
+		if err != nil {
+			return err
+		}
+		_, err = h.s.CreateGroupChat(args[0], users)
+		return err
+	case "invite":
+		if len(args) < 1 {
+			return fmt.Errorf("%w: /invite <user> [<user>...]", WrongCommandUseErr)
+		}
+		if h.currentChat == nil {
+			return NoChatSelectedErr
+		}
+		users, err := h.findOnlineUsers(args)
+		if err != nil {
+			return err
+		}
+		return h.s.AddGroupMembers(h.currentChat.Id, users)
+	case "send":
+		if len(args) < 1 {
+			return fmt.Errorf("%w: /send <path>", WrongCommandUseErr)
+		}
+		if h.currentChat == nil {
+			return NoChatSelectedErr
+		}
+		return h.offerFile(strings.Join(args, " "))
+	case "accept", "decline":
+		if h.currentChat == nil {
+			return NoChatSelectedErr
+		}
+		state := domain.FileStateAccepted
+		if name == "decline" {
+			state = domain.FileStateDeclined
+		}
+		return h.answerFileOffer(state)
+	case "edit":
+		if len(args) < 1 {
+			return fmt.Errorf("%w: /edit <text>", WrongCommandUseErr)
+		}
+		if h.currentChat == nil {
+			return NoChatSelectedErr
+		}
+		m, err := h.ownMessage()
+		if err != nil {
+			return err
+		}
+		// the text is taken as typed, not from the fields, so its spacing is kept
+		text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(txt), "/edit"))
+		return h.s.EditMessage(m.ChatId, m.Id, text)
+	case "delete":
+		if h.currentChat == nil {
+			return NoChatSelectedErr
+		}
+		m, err := h.ownMessage()
+		if err != nil {
+			return err
+		}
+		return h.s.DeleteMessage(m.ChatId, m.Id)
+	case "react":
+		if len(args) > 1 {
+			return fmt.Errorf("%w: /react [<emoji>|<shortcode>]", WrongCommandUseErr)
+		}
+		if h.currentChat == nil {
+			return NoChatSelectedErr
+		}
+		m, err := h.reactionTarget()
+		if err != nil {
+			return err
+		}
+		var emoji string
+		if len(args) == 1 {
+			emoji = parseReaction(args[0])
+		}
+		return h.s.React(m.ChatId, m.Id, emoji)
+	case "passphrase":
+		// the passphrases are typed into masked fields, never into the message field
+		if len(args) > 0 {
+			return fmt.Errorf("%w: /passphrase", WrongCommandUseErr)
+		}
+		return h.showPassphraseChange()
+	case "search":
+		if len(args) < 1 {
+			return fmt.Errorf("%w: /search <words> [\"<phrase>\"] [from:<user>] [since:<date>] [until:<date>]", WrongCommandUseErr)
+		}
+		// the query is taken as typed, not from the fields, so its quotes are kept
+		return h.showSearch(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(txt), "/search")))
+	case "export":
+		all := len(args) > 1 && args[0] == "all"
+		if all {
+			args = args[1:]
+		}
+		if len(args) < 1 {
+			return fmt.Errorf("%w: /export [all] <path>", WrongCommandUseErr)
+		}
+		return h.exportChats(strings.Join(args, " "), all)
+	case "import":
+		if len(args) < 1 {
+			return fmt.Errorf("%w: /import <path>", WrongCommandUseErr)
+		}
+		return h.importChats(strings.Join(args, " "))
+	default:
+		return fmt.Errorf("%w: %s", UnknownCommandErr, name)
+	}
+}
+
+// offerFile adds to the current chat a message offering the file from the given path.
+func (h *handler) offerFile(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%w: %s is not a regular file", WrongCommandUseErr, path)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	return h.s.AddChatLine(domain.Message{
+		ChatId: h.currentChat.Id,
+		UserId: h.s.CurrentUser().Id,
+		At:     time.Now(),
+		Kind:   domain.MessageKindFile,
+		File: &domain.FileTransfer{
+			Name:     info.Name(),
+			Size:     info.Size(),
+			Checksum: hex.EncodeToString(hash.Sum(nil)),
+			Path:     path,
+			State:    domain.FileStateOffered,
+		},
+	})
+}
+
+// answerFileOffer accepts or declines the latest file offered by the other user of the current chat.
+// A file that failed can be accepted again in order to retry it.
+func (h *handler) answerFileOffer(state domain.FileState) error {
+	chat, err := h.s.GetChat(h.currentChat.Id)
+	if err != nil {
+		return err
+	}
+	for i := len(chat.Content) - 1; i >= 0; i-- {
+		m := chat.Content[i]
+		if m.Kind != domain.MessageKindFile || m.File == nil || m.UserId == h.s.CurrentUser().Id {
+			continue
+		}
+		if m.File.State != domain.FileStateOffered && m.File.State != domain.FileStateFailed {
+			continue
+		}
+		f := *m.File
+		f.State = state
+		return h.s.SetFileTransfer(m.ChatId, m.Id, f)
+	}
+	return NoFileOfferedErr
+}
+
+// ownMessage returns the message of the current user that is selected in the chat or, when the selected line is not
+// such a message, the latest one. Only the text messages that were not deleted are considered.
+func (h *handler) ownMessage() (*domain.Message, error) {
+	chat, err := h.s.GetChat(h.currentChat.Id)
+	if err != nil {
+		return nil, err
+	}
+	own := func(m domain.Message) bool {
+		return m.UserId == h.s.CurrentUser().Id && m.Kind == domain.MessageKindText && !m.ErrorMessage && !m.Deleted
+	}
+	if selected := h.selectedMessageId(); len(selected) > 0 {
+		for _, m := range chat.Content {
+			if m.Id == selected && own(m) {
+				return &m, nil
+			}
+		}
+	}
+	for i := len(chat.Content) - 1; i >= 0; i-- {
+		if own(chat.Content[i]) {
+			return &chat.Content[i], nil
+		}
+	}
+	return nil, NoOwnMessageErr
+}
+
+// findOnlineUsers looks for the online users with the given names.
+func (h *handler) findOnlineUsers(names []string) ([]domain.User, error) {
+	byName := map[string][]domain.User{}
+	for _, c := range h.s.GetChats() {
+		if c.Group || c.Offline || len(c.Users) != 1 {
+			continue
+		}
+		byName[c.Users[0].Name] = append(byName[c.Users[0].Name], c.Users[0])
+	}
+	res := make([]domain.User, 0, len(names))
+	for _, n := range names {
+		switch users := byName[n]; len(users) {
+		case 0:
+			return nil, fmt.Errorf("%w: %s", UserNotFoundErr, n)
+		case 1:
+			res = append(res, users[0])
+		default:
+			return nil, fmt.Errorf("%w: %s", AmbiguousUserErr, n)
+		}
+	}
+	return res, nil
+}
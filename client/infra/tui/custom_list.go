@@ -35,7 +35,7 @@ func (c *CList[T]) AddItem(id string, item T) {
 		listItem.obj = item
 		c.items[id] = listItem
 		mainText, secText := c.itemTextGenerator(item)
-		c.List.SetItemText(listItem.idx, listItem.getMainText(mainText), secText)
+		c.List.SetItemText(listItem.idx, mainText, secText)
 		return
 	}
 	c.items[id] = clistItem[T]{
@@ -47,17 +47,16 @@ func (c *CList[T]) AddItem(id string, item T) {
 	c.List.AddItem(mainText, secText, 0, nil)
 }
 
-func (c *CList[T]) SetUnreadChat(id string, status bool) {
+// Select makes the item with the given id the current one. NoItemForIdErr is returned when there is no such item.
+func (c *CList[T]) Select(id string) error {
 	c.m.Lock()
 	defer c.m.Unlock()
-	c2, ok := c.items[id]
+	listItem, ok := c.items[id]
 	if !ok {
-		return
+		return NoItemForIdErr
 	}
-	c2.unread = status
-	c.items[id] = c2
-	mainText, secText := c.itemTextGenerator(c2.obj)
-	c.List.SetItemText(c2.idx, c2.getMainText(mainText), secText)
+	c.List.SetCurrentItem(listItem.idx)
+	return nil
 }
 
 func (c *CList[T]) RemoveItem(id string) {
@@ -73,14 +72,6 @@ func (c *CList[T]) RemoveItem(id string) {
 }
 
 type clistItem[T any] struct {
-	idx    int
-	obj    T
-	unread bool
-}
-
-func (ci *clistItem[T]) getMainText(mainText string) string {
-	if !ci.unread {
-		return mainText
-	}
-	return "# " + mainText
+	idx int
+	obj T
 }
@@ -0,0 +1,58 @@
+package tui
+
+import (
+	"fmt"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/data/export"
+	"os"
+)
+
+// exportChats writes the current chat, or all the chats when all is true, to the file from the given path.
+// The format is chosen by the extension of the path, check export.FormatOf.
+func (h *handler) exportChats(path string, all bool) error {
+	format, err := export.FormatOf(path)
+	if err != nil {
+		return err
+	}
+	var chatIds []string
+	if !all {
+		if h.currentChat == nil {
+			return NoChatSelectedErr
+		}
+		chatIds = append(chatIds, h.currentChat.Id)
+	}
+	// the exports hold the messages, so they are readable only by the owner, like the chats saved on disk
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := export.Write(f, h.s, format, chatIds...); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	exported := "the chat was"
+	if all {
+		exported = "all the chats were"
+	}
+	h.addChatMessage(domain.Message{Text: fmt.Sprintf("%s exported to %s", exported, path), ErrorMessage: true})
+	return nil
+}
+
+// importChats adds to the store the chats exported to the JSON Lines file from the given path.
+// The messages that are already in the store are skipped.
+func (h *handler) importChats(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	added, err := export.Import(f, h.s)
+	if err != nil {
+		return err
+	}
+	h.addChatMessage(domain.Message{Text: fmt.Sprintf("%d messages were imported from %s", added, path), ErrorMessage: true})
+	return nil
+}
@@ -0,0 +1,117 @@
+package tui
+
+import (
+	"github.com/yottta/chat/client/domain"
+	"log"
+)
+
+const (
+	// historyPage is how many messages are loaded at once into the chat
+	historyPage = 50
+	// historyMargin is how close to the oldest line displayed the selection gets before the older lines are loaded
+	historyMargin = 5
+	// newLinesText is the line that separates the messages read before the chat was opened from the new ones
+	newLinesText = "──────── new messages ────────"
+)
+
+// loadLatestLines displays the latest page of messages of the chat. The older ones are loaded by #loadOlderLines.
+func (h *handler) loadLatestLines(chatId string) error {
+	messages, err := h.s.LatestMessages(chatId, historyPage)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		h.addChatMessage(m)
+	}
+	h.lm.Lock()
+	defer h.lm.Unlock()
+	if len(messages) > 0 {
+		h.oldestLine = messages[0].Id
+	}
+	h.olderLines = len(messages) == historyPage
+	h.placeNewLinesNoLock()
+	return nil
+}
+
+// loadOlderLines adds at the top of the chat the page of messages right before the oldest one displayed, if there is any.
+// The selected line stays the same.
+func (h *handler) loadOlderLines() {
+	h.lm.Lock()
+	defer h.lm.Unlock()
+	// the selection could have moved away since this was requested
+	if !h.olderLines || h.currentChat == nil || h.chat.GetCurrentItem() >= historyMargin {
+		return
+	}
+	h.loadOlderPageNoLock()
+}
+
+// showLine selects the line of the given message from the current chat, loading the older lines until it's displayed.
+// False is returned when the message is not in the chat.
+func (h *handler) showLine(messageId string) bool {
+	h.lm.Lock()
+	defer h.lm.Unlock()
+	for {
+		if idx, ok := h.chatLines[messageId]; ok {
+			h.chat.SetCurrentItem(idx)
+			return true
+		}
+		if !h.olderLines || h.currentChat == nil {
+			return false
+		}
+		h.loadOlderPageNoLock()
+	}
+}
+
+// loadOlderPageNoLock adds at the top of the chat the page of messages right before the oldest one displayed.
+func (h *handler) loadOlderPageNoLock() {
+	messages, err := h.s.MessagesBefore(h.currentChat.Id, h.oldestLine, historyPage)
+	if err != nil {
+		log.Printf("failed to load the messages of chat %s before %s: %s", h.currentChat.Id, h.oldestLine, err)
+		h.olderLines = false
+		return
+	}
+	for id, idx := range h.chatLines {
+		h.chatLines[id] = idx + len(messages)
+	}
+	for i, m := range messages {
+		h.chatLines[m.Id] = i
+		h.chat.InsertItem(i, h.formatChatMessage(m), "", 0, nil)
+	}
+	if len(messages) > 0 {
+		h.oldestLine = messages[0].Id
+	}
+	h.olderLines = len(messages) == historyPage
+	h.placeNewLinesNoLock()
+}
+
+// expectNewLines prepares the new messages line for the chat being opened, when it has unread messages.
+func (h *handler) expectNewLines(chat *domain.Chat) {
+	h.lm.Lock()
+	defer h.lm.Unlock()
+	h.newLinesAfter, h.newLines = chat.LastRead, chat.Unread > 0
+}
+
+// placeNewLinesNoLock displays the new messages line, if it's expected and the line of the last read message is loaded.
+func (h *handler) placeNewLinesNoLock() {
+	if !h.newLines {
+		return
+	}
+	var idx int
+	if len(h.newLinesAfter) > 0 {
+		lastRead, ok := h.chatLines[h.newLinesAfter]
+		if !ok {
+			return
+		}
+		idx = lastRead + 1
+	} else if h.olderLines {
+		// nothing was read, so the line goes above the oldest message, which is not loaded yet
+		return
+	}
+	for id, i := range h.chatLines {
+		if i >= idx {
+			h.chatLines[id] = i + 1
+		}
+	}
+	h.chat.InsertItem(idx, newLinesText, "", 0, nil)
+	h.newLines = false
+}
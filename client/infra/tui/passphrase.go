@@ -0,0 +1,129 @@
+package tui
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rivo/tview"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/data"
+)
+
+var (
+	NoPassphraseErr       = errors.New("no passphrase given")
+	PassphraseMismatchErr = errors.New("the passphrases do not match")
+	NotEncryptedStoreErr  = errors.New("the chats are not encrypted")
+)
+
+const (
+	passphrasePage = "passphrase"
+	// passphraseWidth is the width of the passphrase forms, enough for the labels, the fields and the errors
+	passphraseWidth = 70
+)
+
+// AskPassphrase shows a form asking for the passphrase that unlocks the chats saved on disk and returns it once submitted.
+// This runs on its own, before the chat interface is started, since the store cannot be created without the passphrase.
+// When confirm is true, the passphrase is asked twice since it is going to protect a new history.
+// The message is displayed as the title of the form, useful to tell why the passphrase is asked again.
+// NoPassphraseErr is returned when the form is closed without giving a passphrase.
+func AskPassphrase(ctx context.Context, message string, confirm bool) (string, error) {
+	app := tview.NewApplication()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			app.Stop()
+		case <-done:
+		}
+	}()
+
+	labels := []string{"Passphrase"}
+	if confirm {
+		labels = append(labels, "Confirm passphrase")
+	}
+	var passphrase string
+	form := passphraseForm(message, labels, func(values []string) error {
+		if err := confirmed(values); err != nil {
+			return err
+		}
+		passphrase = values[0]
+		app.Stop()
+		return nil
+	}, app.Stop)
+	if err := app.SetRoot(centered(form, passphraseWidth, passphraseFormHeight(labels)), true).Run(); err != nil {
+		return "", err
+	}
+	if len(passphrase) == 0 {
+		return "", NoPassphraseErr
+	}
+	return passphrase, nil
+}
+
+// showPassphraseChange lets the user replace the passphrase that unlocks the chats saved on disk.
+func (h *handler) showPassphraseChange() error {
+	ps, ok := h.s.(data.PassphraseStore)
+	if !ok {
+		return NotEncryptedStoreErr
+	}
+	closeForm := func() {
+		h.pages.RemovePage(passphrasePage)
+		h.app.SetFocus(h.messageField)
+	}
+	labels := []string{"Current passphrase", "New passphrase", "Confirm new passphrase"}
+	form := passphraseForm("Change the passphrase", labels, func(values []string) error {
+		if err := confirmed(values[1:]); err != nil {
+			return err
+		}
+		if err := ps.ChangePassphrase(values[0], values[1]); err != nil {
+			return err
+		}
+		closeForm()
+		h.addChatMessage(domain.Message{Text: "the passphrase was changed", ErrorMessage: true})
+		return nil
+	}, closeForm)
+	h.pages.AddPage(passphrasePage, centered(form, passphraseWidth, passphraseFormHeight(labels)), true, true)
+	h.app.SetFocus(form)
+	return nil
+}
+
+// passphraseForm builds a form with a masked field for each of the labels. The submit function receives the values of the fields
+// in the same order. When it returns an error, the error is displayed in the title and the form stays open to try again.
+func passphraseForm(title string, labels []string, submit func(values []string) error, cancel func()) *tview.Form {
+	form := tview.NewForm()
+	for _, l := range labels {
+		form.AddPasswordField(l, "", 0, '*', nil)
+	}
+	form.AddButton("OK", func() {
+		values := make([]string, len(labels))
+		for i := range labels {
+			values[i] = form.GetFormItem(i).(*tview.InputField).GetText()
+		}
+		if err := submit(values); err != nil {
+			form.SetTitle(fmt.Sprintf("%s (%s)", title, err))
+		}
+	})
+	form.AddButton("Cancel", cancel)
+	form.SetCancelFunc(cancel)
+	form.SetBorder(true).SetTitle(title)
+	return form
+}
+
+// passphraseFormHeight returns the height of the form with the given fields: one line for each field and button,
+// separated by empty lines, and the borders.
+func passphraseFormHeight(labels []string) int {
+	return 2*len(labels) + 5
+}
+
+// confirmed checks that the passphrase is not empty and that all the given values are the same.
+func confirmed(values []string) error {
+	if len(values[0]) == 0 {
+		return NoPassphraseErr
+	}
+	for _, v := range values[1:] {
+		if v != values[0] {
+			return PassphraseMismatchErr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package tui
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/yottta/chat/client/domain"
+	"strings"
+)
+
+const (
+	// reactionKey opens the reaction picker for the line selected in the chat
+	reactionKey   = 'r'
+	reactionsPage = "reactions"
+)
+
+var NoMessageErr = errors.New("no message to react to in this chat")
+
+// reactionShortcodes are the reactions offered by the picker, also accepted by their shortcodes by the /react command
+var reactionShortcodes = []struct {
+	shortcode string
+	emoji     string
+}{
+	{":+1:", "👍"},
+	{":-1:", "👎"},
+	{":heart:", "❤️"},
+	{":joy:", "😂"},
+	{":open_mouth:", "😮"},
+	{":cry:", "😢"},
+	{":tada:", "🎉"},
+	{":eyes:", "👀"},
+}
+
+// parseReaction returns the emoji for the given shortcode. Anything else is considered to be the emoji itself.
+func parseReaction(txt string) string {
+	for _, r := range reactionShortcodes {
+		if r.shortcode == txt {
+			return r.emoji
+		}
+	}
+	return txt
+}
+
+// formatReactions renders the reactions to a message aggregated by emoji, like 👍2.
+func formatReactions(m domain.Message) string {
+	counts := m.ReactionCounts()
+	if len(counts) == 0 {
+		return ""
+	}
+	res := make([]string, len(counts))
+	for i, c := range counts {
+		res[i] = fmt.Sprintf("%s%d", c.Emoji, c.Count)
+	}
+	return " " + strings.Join(res, " ")
+}
+
+// reactionTarget returns the message selected in the chat or, when the selected line is not a message that can receive
+// reactions, the latest one that can.
+func (h *handler) reactionTarget() (*domain.Message, error) {
+	chat, err := h.s.GetChat(h.currentChat.Id)
+	if err != nil {
+		return nil, err
+	}
+	reactable := func(m domain.Message) bool {
+		return !m.ErrorMessage && !m.Deleted && m.Kind.IsAddedToChat()
+	}
+	if selected := h.selectedMessageId(); len(selected) > 0 {
+		for _, m := range chat.Content {
+			if m.Id == selected && reactable(m) {
+				return &m, nil
+			}
+		}
+	}
+	for i := len(chat.Content) - 1; i >= 0; i-- {
+		if reactable(chat.Content[i]) {
+			return &chat.Content[i], nil
+		}
+	}
+	return nil, NoMessageErr
+}
+
+// showReactionPicker lets the user choose the reaction to the message selected in the chat.
+func (h *handler) showReactionPicker() {
+	if h.currentChat == nil {
+		return
+	}
+	m, err := h.reactionTarget()
+	if err != nil {
+		h.addChatMessage(domain.Message{Text: err.Error(), ErrorMessage: true})
+		return
+	}
+	closePicker := func() {
+		h.pages.RemovePage(reactionsPage)
+		h.app.SetFocus(h.chat)
+	}
+	react := func(emoji string) func() {
+		return func() {
+			closePicker()
+			if err := h.s.React(m.ChatId, m.Id, emoji); err != nil {
+				h.addChatMessage(domain.Message{Text: err.Error(), ErrorMessage: true})
+			}
+		}
+	}
+
+	picker := tview.NewList().ShowSecondaryText(false)
+	picker.SetBorder(true).SetTitle("React")
+	for _, r := range reactionShortcodes {
+		picker.AddItem(fmt.Sprintf("%s %s", r.emoji, r.shortcode), "", 0, react(r.emoji))
+	}
+	picker.AddItem("remove your reaction", "", 0, react(""))
+	picker.SetDoneFunc(closePicker)
+	picker.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyEscape {
+			closePicker()
+			return nil
+		}
+		return event
+	})
+
+	h.pages.AddPage(reactionsPage, centered(picker, 30, len(reactionShortcodes)+3), true, true)
+	h.app.SetFocus(picker)
+}
+
+// centered places the primitive in the middle of the screen with the given size.
+func centered(p tview.Primitive, width, height int) tview.Primitive {
+	return tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(p, height, 1, true).
+			AddItem(nil, 0, 1, false),
+			width, 1, true).
+		AddItem(nil, 0, 1, false)
+}
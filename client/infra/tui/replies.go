@@ -0,0 +1,132 @@
+package tui
+
+import (
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/yottta/chat/client/domain"
+	"strings"
+)
+
+const (
+	// threadKey opens the thread of the line selected in the chat
+	threadKey  = 't'
+	threadPage = "thread"
+	// snippetLen is the number of characters quoted from the message replied to
+	snippetLen = 30
+)
+
+// snippet shortens the text to at most n characters, marking it when it was cut.
+func snippet(text string, n int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n]) + "…"
+}
+
+// formatQuote renders the snippet of the message replied to, when the message is a reply.
+func (h *handler) formatQuote(msg domain.Message) string {
+	if len(msg.ParentId) == 0 {
+		return ""
+	}
+	parent, err := h.s.GetMessage(msg.ChatId, msg.ParentId)
+	if err != nil {
+		return "↪ [unknown message] "
+	}
+	if parent.Deleted {
+		return fmt.Sprintf("↪ %s: [message deleted] ", parent.UserName)
+	}
+	return fmt.Sprintf("↪ %s: %q ", parent.UserName, snippet(parent.Text, snippetLen))
+}
+
+// selectedMessage returns the message on the line selected in the chat, when it's a message that can be replied to.
+func (h *handler) selectedMessage() (*domain.Message, bool) {
+	if h.currentChat == nil {
+		return nil, false
+	}
+	id := h.selectedMessageId()
+	if len(id) == 0 {
+		return nil, false
+	}
+	m, err := h.s.GetMessage(h.currentChat.Id, id)
+	if err != nil || m.ErrorMessage || m.Deleted || !m.Kind.IsAddedToChat() {
+		return nil, false
+	}
+	return m, true
+}
+
+// startReply makes the next message typed a reply to the message selected in the chat.
+func (h *handler) startReply() {
+	m, ok := h.selectedMessage()
+	if !ok {
+		return
+	}
+	h.replyTo = m
+	h.messageField.SetTitle(fmt.Sprintf("Reply to %s: %s (Esc to cancel)", m.UserName, snippet(m.Text, snippetLen)))
+	h.app.SetFocus(h.messageField)
+}
+
+// cancelReply makes the next message typed a regular one again.
+func (h *handler) cancelReply() {
+	h.replyTo = nil
+	h.messageField.SetTitle("Message")
+}
+
+// showThread opens the thread that the message selected in the chat is part of, starting with the message that
+// started the thread.
+func (h *handler) showThread() {
+	m, ok := h.selectedMessage()
+	if !ok {
+		return
+	}
+	// the chain of parents is walked with a limit, so a corrupted one cannot loop forever
+	root := m
+	for i := 0; i < 1000 && len(root.ParentId) > 0; i++ {
+		parent, err := h.s.GetMessage(root.ChatId, root.ParentId)
+		if err != nil {
+			break
+		}
+		root = parent
+	}
+	thread, err := h.s.GetThread(root.ChatId, root.Id)
+	if err != nil {
+		h.addChatMessage(domain.Message{Text: err.Error(), ErrorMessage: true})
+		return
+	}
+
+	list := tview.NewList().ShowSecondaryText(false)
+	list.SetBorder(true).SetTitle(fmt.Sprintf("Thread of %s (Esc to close)", root.UserName))
+	for _, tm := range thread {
+		list.AddItem(h.formatChatMessage(tm), "", 0, nil)
+	}
+	closeThread := func() {
+		h.pages.RemovePage(threadPage)
+		h.app.SetFocus(h.chat)
+	}
+	list.SetDoneFunc(closeThread)
+	list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyEscape {
+			closeThread()
+			return nil
+		}
+		return event
+	})
+	_, _, width, height := h.pages.GetRect()
+	h.pages.AddPage(threadPage, centered(list, width*4/5, height*4/5), true, true)
+	h.app.SetFocus(list)
+}
+
+// updateReplies re-renders the replies to the given message, since they quote it.
+func (h *handler) updateReplies(parent domain.Message) {
+	thread, err := h.s.GetThread(parent.ChatId, parent.Id)
+	if err != nil {
+		return
+	}
+	for _, m := range thread {
+		if m.ParentId == parent.Id {
+			h.updateChatMessage(m)
+		}
+	}
+}
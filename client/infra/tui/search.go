@@ -0,0 +1,84 @@
+package tui
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/yottta/chat/client/domain"
+	"github.com/yottta/chat/client/infra/data"
+)
+
+var NoSearchResultsErr = errors.New("no message found")
+
+const (
+	searchPage = "search"
+	// searchLimit is the maximum number of messages listed by a search, the latest ones
+	searchLimit = 100
+	// searchSnippetLen is the number of characters displayed from each message found
+	searchSnippetLen = 80
+)
+
+// showSearch looks for the messages matching the query, check data.ParseSearchQuery for its syntax, and lists them,
+// the latest first. Selecting a message opens its chat with the message selected.
+func (h *handler) showSearch(text string) error {
+	query, err := data.ParseSearchQuery(text)
+	if err != nil {
+		return err
+	}
+	found, err := h.s.Search(query, searchLimit)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("%w: %s", NoSearchResultsErr, text)
+	}
+
+	chats := h.s.GetChats()
+	list := tview.NewList().ShowSecondaryText(false)
+	list.SetBorder(true).SetTitle(fmt.Sprintf("Search: %s (%d found, Enter to open, Esc to close)", text, len(found)))
+	closeSearch := func() {
+		h.pages.RemovePage(searchPage)
+		h.app.SetFocus(h.messageField)
+	}
+	for _, m := range found {
+		m := m
+		var chatName string
+		if chat, ok := chats[m.ChatId]; ok {
+			chatName = formatChatTitle(&chat)
+		}
+		line := fmt.Sprintf("[%s] %s", chatName, formatChatText(snippet(m.Text, searchSnippetLen), m.UserName, m.At))
+		list.AddItem(tview.Escape(line), "", 0, func() {
+			h.pages.RemovePage(searchPage)
+			h.jumpToMessage(m)
+		})
+	}
+	list.SetDoneFunc(closeSearch)
+	list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyEscape {
+			closeSearch()
+			return nil
+		}
+		return event
+	})
+	_, _, width, height := h.pages.GetRect()
+	h.pages.AddPage(searchPage, centered(list, width*4/5, height*4/5), true, true)
+	h.app.SetFocus(list)
+	return nil
+}
+
+// jumpToMessage opens the chat of the message, if it's not the current one, and selects the message in it.
+func (h *handler) jumpToMessage(m domain.Message) {
+	if h.currentChat == nil || h.currentChat.Id != m.ChatId {
+		if err := h.users.Select(m.ChatId); err != nil {
+			h.addChatMessage(domain.Message{Text: fmt.Sprintf("the chat of the message is not listed: %s", err), ErrorMessage: true})
+			return
+		}
+		h.openChat(m.ChatId)
+	}
+	if !h.showLine(m.Id) {
+		h.addChatMessage(domain.Message{Text: "the message is not in the chat anymore", ErrorMessage: true})
+		return
+	}
+	h.app.SetFocus(h.chat)
+}
@@ -8,7 +8,9 @@ import (
 	"github.com/yottta/chat/client/domain"
 	"github.com/yottta/chat/client/infra/data"
 	"log"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,33 +18,50 @@ type Handler interface {
 	Start(ctx context.Context) error
 }
 
+// LatencyMeter reports the round-trip time to the other users, like socket.Socket does.
+type LatencyMeter interface {
+	Latency(userId string) (time.Duration, bool)
+}
+
+// latencyRefresh is how often the latency shown in the title of the current chat is refreshed
+const latencyRefresh = 5 * time.Second
+
 type handler struct {
 	users        *CList[*domain.Chat]
 	chat         *tview.List
 	messageField *tview.InputField
 
-	app *tview.Application
+	app   *tview.Application
+	pages *tview.Pages
 
 	currentChat *domain.Chat
+	chatTitle   string
 	s           data.Store
-}
+	latency     LatencyMeter
+	// replyTo is the message that the next message typed replies to, if any
+	replyTo *domain.Message
 
-func New(store data.Store) Handler {
-	users := NewCustomList[*domain.Chat](func(chat *domain.Chat) (string, string) {
-		users := chat.GetOtherUsers()
+	// lm guards the chat lines indexes, used to re-render the lines of the messages that change
+	lm        *sync.Mutex
+	chatLines map[string]int
+	// oldestLine is the id of the oldest message displayed in the chat and olderLines tells if the chat has messages before it,
+	// which are loaded only once the chat is scrolled towards them. Guarded by lm too.
+	oldestLine string
+	olderLines bool
+	// newLinesAfter is the id of the last message read before the chat was opened, the new messages line being displayed
+	// right after it, or at the top of the chat when no message was read. newLines is true until that line is displayed,
+	// which waits for the line of the last read message to be loaded. Guarded by lm too.
+	newLinesAfter string
+	newLines      bool
 
-		userNames := make([]string, len(users))
-		var idx int
-		for _, u := range users {
-			userNames[idx] = u.Name
-			idx++
-		}
-		var offlineTag string
-		if chat.Offline {
-			offlineTag = " (offline)"
-		}
-		return strings.Join(userNames, ",") + offlineTag, chat.Id
-	})
+	typingNotifier *typingNotifier
+	// tm guards the users typing in each chat, together with the timers that mark them as not typing anymore
+	tm     *sync.Mutex
+	typing map[string]map[string]*time.Timer
+}
+
+func New(store data.Store, latency LatencyMeter) Handler {
+	users := NewCustomList[*domain.Chat](formatChatItem)
 	users.SetTitle(fmt.Sprintf("Users(%s)", store.CurrentUser().Name))
 	users.SetBorder(true)
 	users.ShowSecondaryText(false)
@@ -58,14 +77,23 @@ func New(store data.Store) Handler {
 
 	application := tview.NewApplication()
 
-	return &handler{
+	h := &handler{
 		users:        users,
 		chat:         chat,
 		messageField: messageField,
 
-		app: application,
-		s:   store,
+		app:     application,
+		s:       store,
+		latency: latency,
+
+		lm:        &sync.Mutex{},
+		chatLines: map[string]int{},
+
+		tm:     &sync.Mutex{},
+		typing: map[string]map[string]*time.Timer{},
 	}
+	h.typingNotifier = newTypingNotifier(store.CurrentUser().Id, h.publishChatEvent)
+	return h
 }
 
 func (h *handler) Start(ctx context.Context) error {
@@ -73,8 +101,10 @@ func (h *handler) Start(ctx context.Context) error {
 		<-ctx.Done()
 		h.app.Stop()
 	}()
+	go h.refreshLatency(ctx)
 	h.bindActions()
 	h.bindStoreListeners()
+	h.listStoredChats()
 
 	flex := tview.NewFlex().
 		AddItem(h.users, 0, 1, false).
@@ -83,7 +113,8 @@ func (h *handler) Start(ctx context.Context) error {
 			AddItem(h.messageField, 0, 1, false),
 			0, 5, false)
 
-	if err := h.app.SetRoot(flex, true).SetFocus(h.users).Run(); err != nil {
+	h.pages = tview.NewPages().AddPage("main", flex, true, true)
+	if err := h.app.SetRoot(h.pages, true).SetFocus(h.users).Run(); err != nil {
 		return err
 	}
 	return nil
@@ -91,40 +122,24 @@ func (h *handler) Start(ctx context.Context) error {
 
 func (h *handler) bindActions() {
 	h.users.SetSelectedFunc(func(i int, s string, s2 string, r rune) {
-		h.chat.Clear()
-		chat, err := h.s.GetChat(s2)
-		if err != nil {
-			h.chat.AddItem("ERROR, TRY AGAIN", "", 0, nil)
+		h.openChat(s2)
+	})
+
+	h.messageField.SetChangedFunc(func(text string) {
+		if h.currentChat == nil {
 			return
 		}
-		for _, m := range chat.Content {
-			h.addChatMessage(m)
-		}
-
-		//users := chat.GetOtherUsers()
-		//userNames := make([]string, len(users))
-		//var idx int
-		//for _, u := range users {
-		//	userNames[idx] = u.Name
-		//	idx++
-		//}
-		//h.chat.SetTitle(strings.Join(userNames, ","))
-		h.chat.SetTitle(s)
-		h.chat.SetCurrentItem(h.chat.GetItemCount() - 1)
-		h.app.SetFocus(h.messageField)
-		h.users.SetUnreadChat(chat.Id, false)
-		h.currentChat = chat
+		h.typingNotifier.changed(h.currentChat.Id, text)
 	})
 
 	h.messageField.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEscape {
+			h.cancelReply()
+			return
+		}
 		txt := strings.TrimSpace(h.messageField.GetText())
 		if len(txt) > 0 {
-			if err := h.s.AddChatLine(domain.Message{
-				ChatId: h.currentChat.Id,
-				UserId: h.s.CurrentUser().Id,
-				Text:   txt,
-				At:     time.Now(),
-			}); err != nil {
+			if err := h.submit(txt); err != nil {
 				h.addChatMessage(domain.Message{
 					Text:         err.Error(),
 					ErrorMessage: true,
@@ -134,6 +149,27 @@ func (h *handler) bindActions() {
 		h.messageField.SetText("")
 	})
 
+	h.chat.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyRune && event.Rune() == reactionKey {
+			h.showReactionPicker()
+			return nil
+		}
+		if event.Key() == tcell.KeyRune && event.Rune() == threadKey {
+			h.showThread()
+			return nil
+		}
+		return event
+	})
+	h.chat.SetSelectedFunc(func(int, string, string, rune) {
+		h.startReply()
+	})
+	h.chat.SetChangedFunc(func(index int, _ string, _ string, _ rune) {
+		if index < historyMargin {
+			// the lines are changed outside of this handler since it can be called while lm is held
+			go h.app.QueueUpdateDraw(h.loadOlderLines)
+		}
+	})
+
 	focusChain := []tview.Primitive{h.messageField, h.chat, h.users}
 	focusNext := func(focused tview.Primitive) tview.Primitive {
 		focusedIdx := -1
@@ -163,6 +199,60 @@ func (h *handler) bindActions() {
 	h.app.SetFocus(h.messageField)
 }
 
+// openChat displays the latest messages of the given chat and focuses the message field.
+func (h *handler) openChat(chatId string) {
+	h.clearChatMessages()
+	chat, err := h.s.GetChat(chatId)
+	if err != nil {
+		h.chat.AddItem("ERROR, TRY AGAIN", "", 0, nil)
+		return
+	}
+	h.expectNewLines(chat)
+	if err := h.loadLatestLines(chat.Id); err != nil {
+		h.chat.AddItem("ERROR, TRY AGAIN", "", 0, nil)
+		return
+	}
+
+	//users := chat.GetOtherUsers()
+	//userNames := make([]string, len(users))
+	//var idx int
+	//for _, u := range users {
+	//	userNames[idx] = u.Name
+	//	idx++
+	//}
+	//h.chat.SetTitle(strings.Join(userNames, ","))
+	h.chatTitle = formatChatTitle(chat)
+	h.chat.SetCurrentItem(h.chat.GetItemCount() - 1)
+	h.app.SetFocus(h.messageField)
+	h.typingNotifier.stop()
+	h.cancelReply()
+	h.currentChat = chat
+	h.renderChatTitle()
+	h.markChatRead(chat.Id)
+}
+
+// submit handles the text typed in the message field, either by running it as a command or by sending it to the current chat.
+func (h *handler) submit(txt string) error {
+	if isCommand(txt) {
+		return h.runCommand(txt)
+	}
+	if h.currentChat == nil {
+		return NoChatSelectedErr
+	}
+	var parentId string
+	if h.replyTo != nil && h.replyTo.ChatId == h.currentChat.Id {
+		parentId = h.replyTo.Id
+	}
+	h.cancelReply()
+	return h.s.AddChatLine(domain.Message{
+		ChatId:   h.currentChat.Id,
+		UserId:   h.s.CurrentUser().Id,
+		Text:     txt,
+		At:       time.Now(),
+		ParentId: parentId,
+	})
+}
+
 func (h *handler) bindStoreListeners() {
 	h.s.RegisterChatHandler(func(ctx context.Context, cu string) {
 		chat, err := h.s.GetChat(cu)
@@ -175,22 +265,218 @@ func (h *handler) bindStoreListeners() {
 	})
 
 	h.s.RegisterMessageHandler(func(ctx context.Context, msg domain.Message) {
+		if !msg.Kind.IsAddedToChat() {
+			// the changed message is re-rendered by the message update handler
+			return
+		}
+		// the message was sent, so its author is not typing it anymore
+		h.setTyping(msg.ChatId, msg.UserId, false)
 		if h.currentChat == nil || msg.ChatId != h.currentChat.Id {
-			h.users.SetUnreadChat(msg.ChatId, true)
+			// the unread count of the chat changed
+			h.refreshChatItem(msg.ChatId)
 			h.app.QueueUpdateDraw(func() {})
 			return
 		}
+		// the updates are delivered to another handler, so the message could have changed since it was added
+		if latest, err := h.s.GetMessage(msg.ChatId, msg.Id); err == nil {
+			msg = *latest
+		}
 		h.addChatMessage(msg)
 		h.chat.SetCurrentItem(h.chat.GetItemCount() - 1)
+		// the chat is displayed so all its messages are read, including the ones sent from here
+		h.markChatRead(msg.ChatId)
 		h.app.QueueUpdateDraw(func() {})
 	})
+
+	h.s.RegisterChatEventHandler(h.handleChatEvent)
+
+	h.s.RegisterMessageUpdateHandler(func(ctx context.Context, msg domain.Message) {
+		if h.currentChat == nil || msg.ChatId != h.currentChat.Id {
+			return
+		}
+		h.updateChatMessage(msg)
+		h.updateReplies(msg)
+		h.app.QueueUpdateDraw(func() {})
+	})
+}
+
+// listStoredChats adds to the users list the chats that the store already had before the listeners were registered,
+// like the ones loaded from the disk.
+func (h *handler) listStoredChats() {
+	chats := h.s.GetChats()
+	ids := make([]string, 0, len(chats))
+	for id := range chats {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		chat := chats[id]
+		h.users.AddItem(id, &chat)
+	}
+}
+
+// markChatRead marks the chat as read in the store and clears its unread count from the users list.
+func (h *handler) markChatRead(chatId string) {
+	if err := h.s.MarkChatRead(chatId); err != nil {
+		log.Printf("failed to mark chat %s as read: %s", chatId, err)
+		return
+	}
+	h.refreshChatItem(chatId)
+}
+
+// refreshChatItem re-renders the chat in the users list with its latest details, like its unread count.
+func (h *handler) refreshChatItem(chatId string) {
+	chat, err := h.s.GetChat(chatId)
+	if err != nil {
+		log.Printf("failed to refresh chat %s: %s", chatId, err)
+		return
+	}
+	h.users.AddItem(chat.Id, chat)
+}
+
+func (h *handler) clearChatMessages() {
+	h.lm.Lock()
+	defer h.lm.Unlock()
+	h.chat.Clear()
+	h.chatLines = map[string]int{}
+	h.oldestLine, h.olderLines = "", false
+	h.newLinesAfter, h.newLines = "", false
 }
 
 func (h *handler) addChatMessage(msg domain.Message) {
+	h.lm.Lock()
+	defer h.lm.Unlock()
+	if len(msg.Id) > 0 {
+		h.chatLines[msg.Id] = h.chat.GetItemCount()
+	}
+	h.chat.AddItem(h.formatChatMessage(msg), "", 0, nil)
+}
+
+// selectedMessageId returns the id of the message on the line selected in the chat, if any.
+func (h *handler) selectedMessageId() string {
+	h.lm.Lock()
+	defer h.lm.Unlock()
+	selected := h.chat.GetCurrentItem()
+	for id, idx := range h.chatLines {
+		if idx == selected {
+			return id
+		}
+	}
+	return ""
+}
+
+// updateChatMessage re-renders the line of the given message, if it's displayed.
+func (h *handler) updateChatMessage(msg domain.Message) {
+	h.lm.Lock()
+	defer h.lm.Unlock()
+	idx, ok := h.chatLines[msg.Id]
+	if !ok {
+		return
+	}
+	h.chat.SetItemText(idx, h.formatChatMessage(msg), "")
+}
+
+// refreshLatency re-renders the title of the current chat periodically, so the latency shown in it is kept up to date.
+func (h *handler) refreshLatency(ctx context.Context) {
+	tick := time.NewTicker(latencyRefresh)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			h.app.QueueUpdateDraw(h.renderChatTitle)
+		}
+	}
+}
+
+// formatLatency renders the round-trip time to the other user of a direct chat, once it was measured.
+func (h *handler) formatLatency(chat *domain.Chat) string {
+	if chat.Group || len(chat.Users) != 1 {
+		return ""
+	}
+	latency, ok := h.latency.Latency(chat.Users[0].Id)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf(" [%s]", latency.Round(time.Microsecond))
+}
+
+// formatChatItem renders a chat in the users list: its title followed by the number of unread messages, with the id of
+// the chat as secondary text.
+func formatChatItem(chat *domain.Chat) (string, string) {
+	title := formatChatTitle(chat)
+	if chat.Unread > 0 {
+		title += fmt.Sprintf(" (%d)", chat.Unread)
+	}
+	return title, chat.Id
+}
+
+// formatChatTitle renders the name of the group or of the other user of the chat.
+func formatChatTitle(chat *domain.Chat) string {
+	users := chat.GetOtherUsers()
+
+	userNames := make([]string, len(users))
+	var idx int
+	for _, u := range users {
+		userNames[idx] = u.Name
+		idx++
+	}
+	if chat.Group {
+		return fmt.Sprintf("#%s (%s)", chat.Name, strings.Join(userNames, ","))
+	}
+	var offlineTag string
+	if chat.Offline {
+		offlineTag = " (offline)"
+	}
+	return strings.Join(userNames, ",") + offlineTag
+}
+
+// formatChatMessage renders a message line. The status is shown only for the messages of the current user.
+func (h *handler) formatChatMessage(msg domain.Message) string {
 	if msg.ErrorMessage {
-		h.chat.AddItem(msg.Text, "", 0, nil)
-	} else {
-		h.chat.AddItem(formatChatText(msg.Text, msg.UserName, msg.At), "", 0, nil)
+		return msg.Text
+	}
+	if msg.Deleted {
+		return formatChatText("[message deleted]", msg.UserName, msg.At)
+	}
+	text := formatChatText(h.formatQuote(msg)+msg.Text, msg.UserName, msg.At)
+	if msg.Edited {
+		text += " (edited)"
+	}
+	if msg.File != nil {
+		text += formatFile(*msg.File, msg.UserId == h.s.CurrentUser().Id)
+	}
+	if msg.UserId == h.s.CurrentUser().Id {
+		text += formatStatus(msg.Status)
+	}
+	return text + formatReactions(msg)
+}
+
+// formatFile renders the state of a file transfer. The receiver is reminded how to answer to a file that is offered.
+func formatFile(f domain.FileTransfer, sender bool) string {
+	switch f.State {
+	case domain.FileStateOffered:
+		if sender {
+			return " [waiting for answer]"
+		}
+		return " [/accept or /decline]"
+	case domain.FileStateAccepted:
+		return fmt.Sprintf(" [%d%%]", f.Progress())
+	case domain.FileStateDeclined:
+		return " [declined]"
+	case domain.FileStateCompleted:
+		if sender {
+			return " [transferred]"
+		}
+		return fmt.Sprintf(" [saved to %s]", f.Path)
+	case domain.FileStateFailed:
+		if sender {
+			return " [transfer failed]"
+		}
+		return " [transfer failed, /accept to retry]"
+	default:
+		return ""
 	}
 }
 
@@ -198,3 +484,20 @@ func formatChatText(text, userName string, at time.Time) string {
 	formatted := at.Format(time.Stamp)
 	return fmt.Sprintf("%s (%s): %s", userName, formatted, text)
 }
+
+func formatStatus(status domain.MessageStatus) string {
+	switch status {
+	case domain.MessageStatusPending:
+		return " [sending]"
+	case domain.MessageStatusFailed:
+		return " [failed]"
+	case domain.MessageStatusSent:
+		return " [sent]"
+	case domain.MessageStatusDelivered:
+		return " [delivered]"
+	case domain.MessageStatusRead:
+		return " [read]"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,156 @@
+package tui
+
+import (
+	"context"
+	"fmt"
+	"github.com/yottta/chat/client/domain"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// typingRefresh is how often domain.TypingStarted is sent again while the current user keeps typing
+	typingRefresh = 3 * time.Second
+	// typingIdle is the time without any change of the message after which the current user stops typing
+	typingIdle = 5 * time.Second
+	// typingExpiry is for how long another user is shown as typing without receiving domain.TypingStarted again
+	typingExpiry = 2 * typingRefresh
+)
+
+// typingNotifier publishes the typing events of the current user. The changes of the message field are throttled,
+// so only one domain.TypingStarted is published for each typingRefresh, no matter how many keystrokes are done meanwhile.
+type typingNotifier struct {
+	publish func(e domain.ChatEvent)
+	userId  string
+
+	m *sync.Mutex
+	// chatId is the chat in which the current user is typing, empty when not typing
+	chatId string
+	sentAt time.Time
+	idle   *time.Timer
+}
+
+func newTypingNotifier(userId string, publish func(e domain.ChatEvent)) *typingNotifier {
+	return &typingNotifier{
+		publish: publish,
+		userId:  userId,
+		m:       &sync.Mutex{},
+	}
+}
+
+// changed is called with the text of the message field every time it changes while the given chat is selected.
+func (n *typingNotifier) changed(chatId, text string) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if len(strings.TrimSpace(text)) == 0 || isCommand(text) || n.chatId != chatId {
+		n.stopNoLock()
+	}
+	if len(strings.TrimSpace(text)) == 0 || isCommand(text) {
+		return
+	}
+	if len(n.chatId) == 0 || time.Since(n.sentAt) >= typingRefresh {
+		n.chatId, n.sentAt = chatId, time.Now()
+		n.publish(domain.ChatEvent{Type: domain.TypingStarted, ChatId: chatId, UserId: n.userId})
+	}
+	if n.idle != nil {
+		n.idle.Stop()
+	}
+	n.idle = time.AfterFunc(typingIdle, n.stop)
+}
+
+// stop publishes domain.TypingStopped when the current user was typing.
+func (n *typingNotifier) stop() {
+	n.m.Lock()
+	defer n.m.Unlock()
+	n.stopNoLock()
+}
+
+func (n *typingNotifier) stopNoLock() {
+	if n.idle != nil {
+		n.idle.Stop()
+		n.idle = nil
+	}
+	if len(n.chatId) == 0 {
+		return
+	}
+	n.publish(domain.ChatEvent{Type: domain.TypingStopped, ChatId: n.chatId, UserId: n.userId})
+	n.chatId = ""
+}
+
+// publishChatEvent passes the chat event of the current user to the store, so it's sent to the other users.
+func (h *handler) publishChatEvent(e domain.ChatEvent) {
+	if err := h.s.PublishChatEvent(e); err != nil {
+		log.Printf("failed to publish the %s event in chat %s: %s", e.Type, e.ChatId, err)
+	}
+}
+
+// handleChatEvent keeps track of the other users that are typing and shows them in the title of the current chat.
+func (h *handler) handleChatEvent(ctx context.Context, e domain.ChatEvent) {
+	if e.UserId == h.s.CurrentUser().Id {
+		return
+	}
+	switch e.Type {
+	case domain.TypingStarted:
+		h.setTyping(e.ChatId, e.UserId, true)
+	case domain.TypingStopped:
+		h.setTyping(e.ChatId, e.UserId, false)
+	}
+}
+
+// setTyping marks the user as typing in the chat, for at most typingExpiry, or as not typing anymore.
+func (h *handler) setTyping(chatId, userId string, typing bool) {
+	h.tm.Lock()
+	users, ok := h.typing[chatId]
+	if !ok {
+		users = map[string]*time.Timer{}
+		h.typing[chatId] = users
+	}
+	expiry, wasTyping := users[userId]
+	if wasTyping {
+		expiry.Stop()
+		delete(users, userId)
+	}
+	if typing {
+		users[userId] = time.AfterFunc(typingExpiry, func() {
+			h.setTyping(chatId, userId, false)
+		})
+	}
+	h.tm.Unlock()
+
+	if !wasTyping && !typing {
+		return
+	}
+	if h.currentChat != nil && h.currentChat.Id == chatId {
+		h.renderChatTitle()
+		h.app.QueueUpdateDraw(func() {})
+	}
+}
+
+// renderChatTitle shows the name of the current chat together with the latency to its user and the users typing in it.
+func (h *handler) renderChatTitle() {
+	chat := h.currentChat
+	if chat == nil {
+		return
+	}
+	title := h.chatTitle + h.formatLatency(chat)
+	h.tm.Lock()
+	var names []string
+	for userId := range h.typing[chat.Id] {
+		if u, err := chat.GetUser(userId); err == nil {
+			names = append(names, u.Name)
+		}
+	}
+	h.tm.Unlock()
+	switch len(names) {
+	case 0:
+		h.chat.SetTitle(title)
+	case 1:
+		h.chat.SetTitle(fmt.Sprintf("%s - %s is typing...", title, names[0]))
+	default:
+		sort.Strings(names)
+		h.chat.SetTitle(fmt.Sprintf("%s - %s are typing...", title, strings.Join(names, ", ")))
+	}
+}
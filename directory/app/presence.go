@@ -0,0 +1,129 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"github.com/yottta/chat/directory/domain"
+	"log"
+	"sync"
+	"time"
+)
+
+const watcherBufferSize = 64
+
+// presence keeps track of the clients that are online and fans out the changes to the watchers.
+type presence struct {
+	m        *sync.Mutex
+	online   map[string]domain.Client
+	watchers map[chan domain.ClientEvent]struct{}
+}
+
+func newPresence() *presence {
+	return &presence{
+		m:        &sync.Mutex{},
+		online:   map[string]domain.Client{},
+		watchers: map[chan domain.ClientEvent]struct{}{},
+	}
+}
+
+// registered is called for every client registration and emits a join or update event when needed.
+func (p *presence) registered(c domain.Client) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	existing, ok := p.online[c.ID]
+	p.online[c.ID] = c
+	switch {
+	case !ok:
+		p.broadcast(domain.ClientEvent{Type: domain.ClientJoined, Client: &c})
+	case existing.Name != c.Name || existing.IP != c.IP || existing.Port != c.Port || !bytes.Equal(existing.PublicKey, c.PublicKey):
+		p.broadcast(domain.ClientEvent{Type: domain.ClientUpdated, Client: &c})
+	}
+}
+
+// sync compares the given online clients with the known ones and emits the events for the differences.
+func (p *presence) sync(clients []domain.Client) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	current := make(map[string]domain.Client, len(clients))
+	for _, c := range clients {
+		current[c.ID] = c
+	}
+	for id, c := range p.online {
+		if _, ok := current[id]; ok {
+			continue
+		}
+		c := c
+		delete(p.online, id)
+		p.broadcast(domain.ClientEvent{Type: domain.ClientLeft, Client: &c})
+	}
+	for id, c := range current {
+		if _, ok := p.online[id]; ok {
+			continue
+		}
+		c := c
+		p.online[id] = c
+		p.broadcast(domain.ClientEvent{Type: domain.ClientJoined, Client: &c})
+	}
+}
+
+// watch registers a new watcher. The returned channel receives first one join event for each online client
+// followed by a domain.ClientsSynced event and afterwards all the changes until the context is done.
+func (p *presence) watch(ctx context.Context) <-chan domain.ClientEvent {
+	p.m.Lock()
+	defer p.m.Unlock()
+	ch := make(chan domain.ClientEvent, len(p.online)+watcherBufferSize)
+	for _, c := range p.online {
+		c := c
+		ch <- domain.ClientEvent{Type: domain.ClientJoined, Client: &c}
+	}
+	ch <- domain.ClientEvent{Type: domain.ClientsSynced}
+	p.watchers[ch] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		p.m.Lock()
+		defer p.m.Unlock()
+		p.removeWatcherNoLock(ch)
+	}()
+	return ch
+}
+
+func (p *presence) broadcast(e domain.ClientEvent) {
+	for w := range p.watchers {
+		select {
+		case w <- e:
+		default:
+			// a watcher that is not keeping up would receive an incomplete view, so it's better to close it
+			// and let it reconnect and sync again
+			log.Printf("closing presence watcher because it is too slow")
+			p.removeWatcherNoLock(w)
+		}
+	}
+}
+
+func (p *presence) removeWatcherNoLock(w chan domain.ClientEvent) {
+	if _, ok := p.watchers[w]; !ok {
+		return
+	}
+	delete(p.watchers, w)
+	close(w)
+}
+
+// runExpiry periodically checks the store for the clients that went offline.
+func (c *clientsSvc) runExpiry(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			clients, err := c.store.OnlineClients(ctx)
+			if err != nil {
+				log.Printf("failed to get the online clients for presence check: %s", err)
+				continue
+			}
+			c.presence.sync(clients)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/yottta/chat/directory/domain"
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	alice := domain.Client{ID: "alice_id", Name: "alice", IP: "127.0.0.1", Port: 5000}
+	bob := domain.Client{ID: "bob_id", Name: "bob", IP: "127.0.0.1", Port: 5001}
+
+	t.Run(`Given a presence with an online client,
+	When a watcher is registered,
+	Then it receives a join event for the client followed by the synced event`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		p := newPresence()
+		p.sync([]domain.Client{alice})
+
+		// When
+		ch := p.watch(ctx)
+
+		// Then
+		expectEvent(t, ch, domain.ClientJoined, alice.ID)
+		expectEvent(t, ch, domain.ClientsSynced, "")
+	})
+
+	t.Run(`Given a watcher that received the online clients,
+	When a client registers, registers again with another address, registers again unchanged and goes offline,
+	Then the watcher receives the join, the update and the leave of the client, in order`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		p := newPresence()
+		p.sync([]domain.Client{alice})
+		ch := p.watch(ctx)
+		expectEvent(t, ch, domain.ClientJoined, alice.ID)
+		expectEvent(t, ch, domain.ClientsSynced, "")
+
+		// When
+		p.registered(bob)
+		moved := bob
+		moved.Port = 6000
+		p.registered(moved)
+		p.registered(moved)
+		p.sync([]domain.Client{alice})
+
+		// Then
+		expectEvent(t, ch, domain.ClientJoined, bob.ID)
+		if e := expectEvent(t, ch, domain.ClientUpdated, bob.ID); e.Client.Port != moved.Port {
+			t.Fatalf("expected the update to hold the port %d but it holds %d", moved.Port, e.Client.Port)
+		}
+		expectEvent(t, ch, domain.ClientLeft, bob.ID)
+		select {
+		case e := <-ch:
+			t.Fatalf("expected no other event but received %+v", e)
+		default:
+		}
+	})
+
+	t.Run(`Given a watcher that is not reading its events and one that is done,
+	When more clients join than the watcher can hold,
+	Then both watchers are closed and the slow one receives only what it could hold`, func(t *testing.T) {
+		// Given
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		p := newPresence()
+		slow := p.watch(ctx)
+		doneCtx, done := context.WithCancel(ctx)
+		finished := p.watch(doneCtx)
+		done()
+
+		// When
+		for i := 0; i <= watcherBufferSize; i++ {
+			p.registered(domain.Client{ID: fmt.Sprintf("id%d", i), Name: fmt.Sprintf("client%d", i)})
+		}
+
+		// Then
+		var received int
+		for range slow {
+			received++
+		}
+		// the synced event followed by the join events that fit next to it in the buffer
+		if expected := watcherBufferSize; received != expected {
+			t.Fatalf("expected %d events before the slow watcher was closed but received %d", expected, received)
+		}
+		expectClosed(t, finished)
+	})
+}
+
+// expectEvent waits for the next event of the watcher and checks its type and client.
+func expectEvent(t *testing.T, ch <-chan domain.ClientEvent, eventType domain.ClientEventType, clientId string) domain.ClientEvent {
+	select {
+	case e, ok := <-ch:
+		if !ok {
+			t.Fatalf("expected a %s event but the watcher was closed", eventType)
+		}
+		if e.Type != eventType || (e.Client == nil && len(clientId) > 0) || (e.Client != nil && e.Client.ID != clientId) {
+			t.Fatalf("expected a %s event for client %q but received %+v", eventType, clientId, e)
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatalf("expected a %s event", eventType)
+	}
+	return domain.ClientEvent{}
+}
+
+// expectClosed drains the watcher and waits for it to be closed.
+func expectClosed(t *testing.T, ch <-chan domain.ClientEvent) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("expected the watcher to be closed")
+		}
+	}
+}
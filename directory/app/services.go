@@ -3,37 +3,63 @@ package app
 import (
 	"context"
 	"github.com/yottta/chat/directory/domain"
-	"github.com/yottta/go-cache"
+	"log"
 	"time"
 )
 
+const presenceCheckInterval = time.Second
+
 type Clients interface {
 	GetClients(ctx context.Context) ([]domain.Client, error)
 	RegisterClient(ctx context.Context, client domain.Client) error
+	// WatchClients returns a channel that is receiving the presence changes of the clients.
+	// The channel is closed once the given context is done or when the watcher is not consuming the events fast enough.
+	WatchClients(ctx context.Context) (<-chan domain.ClientEvent, error)
+}
+
+// ClientsStore is the storage layer used by the Clients service.
+// Implementations are responsible for considering a client offline once its domain.Client.LastSeen is older than their TTL.
+type ClientsStore interface {
+	SaveClient(ctx context.Context, client domain.Client) error
+	OnlineClients(ctx context.Context) ([]domain.Client, error)
+	Close() error
 }
 
 type clientsSvc struct {
-	clients *cache.Cache[domain.Client]
+	store    ClientsStore
+	presence *presence
 }
 
-func NewClientsSvc() Clients {
-	return &clientsSvc{
-		clients: cache.New[domain.Client](time.Second*30, time.Second*5, func() domain.Client { return domain.Client{} }),
+// NewClientsSvc creates the service handling the clients registrations.
+// This spawns a goroutine that is checking for the clients going offline, so be sure that the given context is cancelled
+// once the service is not needed anymore.
+func NewClientsSvc(ctx context.Context, store ClientsStore) Clients {
+	c := &clientsSvc{
+		store:    store,
+		presence: newPresence(),
+	}
+	clients, err := store.OnlineClients(ctx)
+	if err != nil {
+		log.Printf("failed to load the online clients from the store: %s", err)
 	}
+	c.presence.sync(clients)
+	go c.runExpiry(ctx, presenceCheckInterval)
+	return c
 }
 
 func (c *clientsSvc) GetClients(ctx context.Context) ([]domain.Client, error) {
-	clients := c.clients.Items()
-	res := make([]domain.Client, len(clients))
-	var idx int
-	for _, c := range clients {
-		res[idx] = c.Object
-		idx++
-	}
-	return res, nil
+	return c.store.OnlineClients(ctx)
 }
 
 func (c *clientsSvc) RegisterClient(ctx context.Context, client domain.Client) error {
-	c.clients.AddOrReplace(client.ID, client, cache.DefaultExpiration)
+	client.LastSeen = time.Now().UTC()
+	if err := c.store.SaveClient(ctx, client); err != nil {
+		return err
+	}
+	c.presence.registered(client)
 	return nil
 }
+
+func (c *clientsSvc) WatchClients(ctx context.Context) (<-chan domain.ClientEvent, error) {
+	return c.presence.watch(ctx), nil
+}
@@ -1,14 +1,41 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/yottta/chat/directory/app"
+	"github.com/yottta/chat/directory/infra/data/bolt"
+	"github.com/yottta/chat/directory/infra/data/inmemory"
 	httpx "github.com/yottta/chat/directory/infra/http"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const clientsTTL = 30 * time.Second
+
+var (
+	storeType = EnvOrDefault("STORE_TYPE", "memory")
+	storePath = EnvOrDefault("STORE_PATH", "directory.db")
 )
 
 func main() {
-	clientsSvc := app.NewClientsSvc()
+	store, err := newStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			log.Printf("failed to close the clients store: %s", err)
+		}
+	}()
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	clientsSvc := app.NewClientsSvc(ctx, store)
 	app := app.App{
 		Clients: clientsSvc,
 	}
@@ -17,3 +44,22 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+func newStore() (app.ClientsStore, error) {
+	switch storeType {
+	case "memory":
+		return inmemory.NewStore(clientsTTL), nil
+	case "bolt":
+		return bolt.NewStore(storePath, clientsTTL)
+	default:
+		return nil, fmt.Errorf("unknown STORE_TYPE %q. supported values: memory, bolt", storeType)
+	}
+}
+
+func EnvOrDefault(key, def string) string {
+	e := strings.TrimSpace(os.Getenv(key))
+	if len(e) == 0 {
+		return def
+	}
+	return e
+}
@@ -1,15 +1,23 @@
 package domain
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"strings"
+	"time"
 )
 
+// publicKeySize is the size of the X25519 identity public keys of the clients
+const publicKeySize = 32
+
 type Client struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-	IP   string `json:"address"`
-	Port int    `json:"port"`
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	IP        string    `json:"address"`
+	Port      int       `json:"port"`
+	PublicKey []byte    `json:"public_key"`
+	LastSeen  time.Time `json:"last_seen"`
 }
 
 func (c Client) Validate() error {
@@ -25,5 +33,19 @@ func (c Client) Validate() error {
 	if c.Port < 1000 {
 		return fmt.Errorf("invalid client port")
 	}
+	if len(c.PublicKey) != publicKeySize {
+		return fmt.Errorf("invalid client public key")
+	}
+	// the id is bound to the public key so a client keeps a single entry even when its address changes
+	// and nobody else can register under the same id with another key
+	if c.ID != Fingerprint(c.PublicKey) {
+		return fmt.Errorf("client id is not the fingerprint of the public key")
+	}
 	return nil
 }
+
+// Fingerprint returns the id of the client owning the given public key: the hex encoded SHA-256 of it.
+func Fingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,19 @@
+package domain
+
+type ClientEventType string
+
+const (
+	// ClientJoined is emitted when a client that was not online registers in the directory
+	ClientJoined ClientEventType = "join"
+	// ClientLeft is emitted when a client did not ping the directory for long enough to be considered offline
+	ClientLeft ClientEventType = "leave"
+	// ClientUpdated is emitted when an online client registers again with different details
+	ClientUpdated ClientEventType = "update"
+	// ClientsSynced is emitted once, after the join events describing the clients that were online when the watch started
+	ClientsSynced ClientEventType = "synced"
+)
+
+type ClientEvent struct {
+	Type   ClientEventType `json:"type"`
+	Client *Client         `json:"client,omitempty"`
+}
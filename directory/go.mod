@@ -2,4 +2,9 @@ module github.com/yottta/chat/directory
 
 go 1.19
 
-require github.com/yottta/go-cache v0.1.1
+require (
+	github.com/yottta/go-cache v0.1.1
+	go.etcd.io/bbolt v1.3.7
+)
+
+require golang.org/x/sys v0.13.0 // indirect
@@ -0,0 +1,169 @@
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/yottta/chat/directory/app"
+	"github.com/yottta/chat/directory/domain"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"sync"
+	"time"
+)
+
+var clientsBucket = []byte("clients")
+
+type store struct {
+	db  *bolt.DB
+	ttl time.Duration
+
+	m      *sync.Mutex
+	online map[string]domain.Client
+	// closed is set once Close was called, so no more expired clients are removed from the database
+	closed bool
+	// deleting tracks the removals of the expired clients, so Close waits for them before closing the database
+	deleting *sync.WaitGroup
+}
+
+// NewStore opens (or creates) the bbolt database at the given path and returns an app.ClientsStore backed by it.
+// Every saved client is persisted together with its last seen timestamp. On startup, the clients that were seen
+// in the last ttl are loaded back as online and the ones older than that are removed from the database.
+func NewStore(path string, ttl time.Duration) (app.ClientsStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the clients database %s: %w", path, err)
+	}
+	s := &store{
+		db:  db,
+		ttl: ttl,
+
+		m:        &sync.Mutex{},
+		online:   map[string]domain.Client{},
+		deleting: &sync.WaitGroup{},
+	}
+	if err := s.load(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *store) SaveClient(ctx context.Context, client domain.Client) error {
+	b, err := json.Marshal(client)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(clientsBucket).Put([]byte(client.ID), b)
+	}); err != nil {
+		return fmt.Errorf("failed to save client %s: %w", client.ID, err)
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.online[client.ID] = client
+	return nil
+}
+
+func (s *store) OnlineClients(ctx context.Context) ([]domain.Client, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	res := make([]domain.Client, 0, len(s.online))
+	var expired []string
+	for id, c := range s.online {
+		if s.isExpired(c) {
+			expired = append(expired, id)
+			continue
+		}
+		res = append(res, c)
+	}
+	for _, id := range expired {
+		delete(s.online, id)
+	}
+	if len(expired) > 0 && !s.closed {
+		s.deleting.Add(1)
+		go func() {
+			defer s.deleting.Done()
+			s.deleteClients(expired)
+		}()
+	}
+	return res, nil
+}
+
+// Close waits for the expired clients to be removed from the database and closes it.
+func (s *store) Close() error {
+	s.m.Lock()
+	s.closed = true
+	s.m.Unlock()
+	s.deleting.Wait()
+	return s.db.Close()
+}
+
+// load rebuilds the online set from the database and drops the clients that are already expired.
+func (s *store) load() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(clientsBucket)
+		if err != nil {
+			return err
+		}
+		var expired [][]byte
+		if err := b.ForEach(func(k, v []byte) error {
+			var c domain.Client
+			if err := json.Unmarshal(v, &c); err != nil {
+				log.Printf("dropping unreadable client entry %s: %s", k, err)
+				expired = append(expired, k)
+				return nil
+			}
+			if err := c.Validate(); err != nil {
+				// entries saved before the ids were bound to the public keys would show up as duplicates
+				log.Printf("dropping invalid client entry %s: %s", k, err)
+				expired = append(expired, k)
+				return nil
+			}
+			if s.isExpired(c) {
+				expired = append(expired, k)
+				return nil
+			}
+			s.online[c.ID] = c
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *store) deleteClients(ids []string) {
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(clientsBucket)
+		for _, id := range ids {
+			// a client could have pinged again in the meantime so check it before removing it
+			v := b.Get([]byte(id))
+			if v == nil {
+				continue
+			}
+			var c domain.Client
+			if err := json.Unmarshal(v, &c); err == nil && !s.isExpired(c) {
+				continue
+			}
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Printf("failed to remove expired clients: %s", err)
+	}
+}
+
+func (s *store) isExpired(c domain.Client) bool {
+	return time.Since(c.LastSeen) > s.ttl
+}
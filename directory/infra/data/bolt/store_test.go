@@ -0,0 +1,154 @@
+package bolt
+
+import (
+	"context"
+	"github.com/yottta/chat/directory/app"
+	"github.com/yottta/chat/directory/domain"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	t.Run(`Given a store with a client seen recently and one seen before the ttl,
+	When the online clients are listed and the store is opened again,
+	Then only the recent client is listed and the other one is removed from the database`, func(t *testing.T) {
+		// Given
+		ctx := context.Background()
+		path := filepath.Join(t.TempDir(), "clients.db")
+		s := openStore(t, path, time.Minute)
+		recent, old := newClient("recent", time.Now()), newClient("old", time.Now().Add(-time.Hour))
+		for _, c := range []domain.Client{recent, old} {
+			if err := s.SaveClient(ctx, c); err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+
+		// When
+		online, err := s.OnlineClients(ctx)
+		closeErr := s.Close()
+
+		// Then
+		if err != nil || closeErr != nil {
+			t.Fatalf("expected to receive no error but received %v and %v", err, closeErr)
+		}
+		if names(online) != "recent" {
+			t.Fatalf("expected only the recent client to be online but received %s", names(online))
+		}
+		// a ttl that covers both clients shows what is left in the database
+		reopened := openStore(t, path, 24*time.Hour)
+		defer reopened.Close()
+		if online, _ := reopened.OnlineClients(ctx); names(online) != "recent" {
+			t.Fatalf("expected only the recent client in the database but found %s", names(online))
+		}
+	})
+
+	t.Run(`Given a store with clients,
+	When the store is closed and opened again,
+	Then the clients are loaded back as online together with the time they were last seen`, func(t *testing.T) {
+		// Given
+		ctx := context.Background()
+		path := filepath.Join(t.TempDir(), "clients.db")
+		s := openStore(t, path, time.Minute)
+		alice, bob := newClient("alice", time.Now().Add(-time.Second)), newClient("bob", time.Now())
+		for _, c := range []domain.Client{alice, bob} {
+			if err := s.SaveClient(ctx, c); err != nil {
+				t.Fatalf("expected to receive no error but received %s", err)
+			}
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// When
+		reopened := openStore(t, path, time.Minute)
+		defer reopened.Close()
+		online, err := reopened.OnlineClients(ctx)
+
+		// Then
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if names(online) != "alice,bob" {
+			t.Fatalf("expected alice and bob to be online but received %s", names(online))
+		}
+		for _, c := range online {
+			expected := alice
+			if c.Name == bob.Name {
+				expected = bob
+			}
+			if c.ID != expected.ID || c.Port != expected.Port || !c.LastSeen.Equal(expected.LastSeen) {
+				t.Fatalf("expected client %+v but received %+v", expected, c)
+			}
+		}
+	})
+
+	t.Run(`Given a store with a client,
+	When the store is opened again with a ttl shorter than the time since the client was last seen,
+	Then the client is not online anymore and it's removed from the database`, func(t *testing.T) {
+		// Given
+		ctx := context.Background()
+		path := filepath.Join(t.TempDir(), "clients.db")
+		s := openStore(t, path, time.Hour)
+		if err := s.SaveClient(ctx, newClient("alice", time.Now().Add(-time.Minute))); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+
+		// When
+		reopened := openStore(t, path, time.Second)
+		online, err := reopened.OnlineClients(ctx)
+		if closeErr := reopened.Close(); closeErr != nil {
+			t.Fatalf("expected to receive no error but received %s", closeErr)
+		}
+
+		// Then
+		if err != nil {
+			t.Fatalf("expected to receive no error but received %s", err)
+		}
+		if len(online) != 0 {
+			t.Fatalf("expected no client to be online but received %s", names(online))
+		}
+		again := openStore(t, path, time.Hour)
+		defer again.Close()
+		if online, _ := again.OnlineClients(ctx); len(online) != 0 {
+			t.Fatalf("expected no client in the database but found %s", names(online))
+		}
+	})
+}
+
+func openStore(t *testing.T, path string, ttl time.Duration) app.ClientsStore {
+	s, err := NewStore(path, ttl)
+	if err != nil {
+		t.Fatalf("failed to open the store: %s", err)
+	}
+	return s
+}
+
+// newClient returns a valid client with the given name, its key being derived from the name.
+func newClient(name string, lastSeen time.Time) domain.Client {
+	key := make([]byte, 32)
+	copy(key, name)
+	return domain.Client{
+		ID:        domain.Fingerprint(key),
+		Name:      name,
+		IP:        "127.0.0.1",
+		Port:      5000,
+		PublicKey: key,
+		LastSeen:  lastSeen,
+	}
+}
+
+// names returns the sorted names of the clients, joined by commas.
+func names(clients []domain.Client) string {
+	res := make([]string, len(clients))
+	for i, c := range clients {
+		res[i] = c.Name
+	}
+	sort.Strings(res)
+	return strings.Join(res, ",")
+}
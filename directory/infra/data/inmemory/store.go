@@ -0,0 +1,41 @@
+package inmemory
+
+import (
+	"context"
+	"github.com/yottta/chat/directory/app"
+	"github.com/yottta/chat/directory/domain"
+	"github.com/yottta/go-cache"
+	"time"
+)
+
+type store struct {
+	clients *cache.Cache[domain.Client]
+}
+
+// NewStore returns an app.ClientsStore that keeps the clients only in memory.
+// The clients are evicted once they were not saved again for the given ttl.
+func NewStore(ttl time.Duration) app.ClientsStore {
+	return &store{
+		clients: cache.New[domain.Client](ttl, time.Second*5, func() domain.Client { return domain.Client{} }),
+	}
+}
+
+func (s *store) SaveClient(ctx context.Context, client domain.Client) error {
+	s.clients.AddOrReplace(client.ID, client, cache.DefaultExpiration)
+	return nil
+}
+
+func (s *store) OnlineClients(ctx context.Context) ([]domain.Client, error) {
+	clients := s.clients.Items()
+	res := make([]domain.Client, len(clients))
+	var idx int
+	for _, c := range clients {
+		res[idx] = c.Object
+		idx++
+	}
+	return res, nil
+}
+
+func (s *store) Close() error {
+	return nil
+}
@@ -26,6 +26,7 @@ func NewHandler(app *app.App) http.Handler {
 		handlers: map[handlerDescriptor]http.HandlerFunc{},
 	}
 	handler.registerClientsListHandler()
+	handler.registerClientsWatchHandler()
 	handler.registerPingHandler()
 
 	return &handler
@@ -76,6 +77,45 @@ func (h *Handler) registerClientsListHandler() {
 	}
 }
 
+// registerClientsWatchHandler registers the handler streaming the presence changes of the clients.
+// The response is a stream of newline delimited JSON objects, each one being a domain.ClientEvent.
+func (h *Handler) registerClientsWatchHandler() {
+	hd := handlerDescriptor{
+		url:    "/clients/watch",
+		method: http.MethodGet,
+	}
+	h.handlers[hd] = func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			log.Printf("the response writer does not support streaming")
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("error"))
+			return
+		}
+		events, err := h.app.Clients.WatchClients(r.Context())
+		if err != nil {
+			log.Printf("error during watching the clients: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		enc := json.NewEncoder(w)
+		for e := range events {
+			if err := enc.Encode(e); err != nil {
+				log.Printf("error during writing the clients event: %s", err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
 func (h *Handler) registerPingHandler() {
 	hd := handlerDescriptor{
 		url:    "/ping",